@@ -1,14 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"regexp"
+	"sync"
 	"time"
 
-	"github.com/jeffail/tunny"
+	"github.com/Sirupsen/logrus"
 	"github.com/oschwald/maxminddb-golang"
-	"gopkg.in/vmihailenco/msgpack.v2"
 
 	"github.com/TykTechnologies/tyk/config"
 )
@@ -40,6 +41,7 @@ type AnalyticsRecord struct {
 	Tags          []string
 	Alias         string
 	TrackPath     bool
+	Retries       int
 	ExpireAt      time.Time `bson:"expireAt" json:"expireAt"`
 }
 
@@ -142,7 +144,7 @@ func (a *AnalyticsRecord) SetExpiry(expiresInSeconds int64) {
 	a.ExpireAt = t2
 }
 
-var AnalyticsPool *tunny.WorkPool
+var errAnalyticsBufferFull = errors.New("analytics buffer is full, record dropped")
 
 // RedisAnalyticsHandler will record analytics data to a redis back end
 // as defined in the Config object
@@ -150,10 +152,17 @@ type RedisAnalyticsHandler struct {
 	Store   StorageHandler
 	Clean   Purger
 	GeoIPDB *maxminddb.Reader
+	Sinks   []AnalyticsSink
+
+	buffer    *analyticsRingBuffer
+	batchSize int
+	stop      chan struct{}
+	writers   sync.WaitGroup
+	// held for reading while a batch is being written
+	inflight sync.RWMutex
 }
 
 func (r *RedisAnalyticsHandler) Init() {
-	var err error
 	if globalConf.AnalyticsConfig.EnableGeoIP {
 		db, err := maxminddb.Open(globalConf.AnalyticsConfig.GeoIPDBLocation)
 		if err != nil {
@@ -163,56 +172,75 @@ func (r *RedisAnalyticsHandler) Init() {
 		}
 	}
 
-	analytics.Store.Connect()
-
-	ps := globalConf.AnalyticsConfig.PoolSize
-	if ps == 0 {
-		ps = 50
+	// On reload, write what the old sinks were given before closing them
+	r.stopWriters()
+	r.closeSinks()
+	for _, name := range analyticsSinkTypes() {
+		sink, err := newAnalyticsSink(name, r.Store)
+		if err == nil {
+			err = sink.Init()
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": "analytics",
+			}).Error("Failed to init analytics sink ", name, ": ", err)
+			continue
+		}
+		log.WithFields(logrus.Fields{
+			"prefix": "analytics",
+		}).Info("Analytics sink enabled: ", name)
+		r.Sinks = append(r.Sinks, sink)
 	}
 
-	AnalyticsPool, err = tunny.CreatePoolGeneric(ps).Open()
-	if err != nil {
-		log.Error("Failed to init analytics pool")
-	}
+	r.startWriters()
 }
 
-// RecordHit will store an AnalyticsRecord in Redis
-func (r *RedisAnalyticsHandler) RecordHit(record AnalyticsRecord) error {
-
-	AnalyticsPool.SendWork(func() {
-		// If we are obfuscating API Keys, store the hashed representation (config check handled in hashing function)
-		record.APIKey = publicHash(record.APIKey)
-
-		if globalConf.SlaveOptions.UseRPC {
-			// Extend tag list to include this data so wecan segment by node if necessary
-			record.Tags = append(record.Tags, "tyk-hybrid-rpc")
-		}
-
-		if globalConf.DBAppConfOptions.NodeIsSegmented {
-			// Extend tag list to include this data so wecan segment by node if necessary
-			record.Tags = append(record.Tags, globalConf.DBAppConfOptions.Tags...)
+// closeSinks closes the sinks, once no writer is using them.
+func (r *RedisAnalyticsHandler) closeSinks() {
+	for _, sink := range r.Sinks {
+		if err := sink.Close(); err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": "analytics",
+			}).Error("Failed to close analytics sink: ", err)
 		}
+	}
+	r.Sinks = nil
+}
 
-		// Lets add some metadata
-		if record.APIKey != "" {
-			record.Tags = append(record.Tags, "key-"+record.APIKey)
-		}
+// RecordHit queues an AnalyticsRecord to be written to all the configured
+// sinks, it never blocks. It returns an error if the buffer is full and
+// the record was dropped.
+func (r *RedisAnalyticsHandler) RecordHit(record AnalyticsRecord) error {
+	// If we are obfuscating API Keys, store the hashed representation (config check handled in hashing function)
+	record.APIKey = publicHash(record.APIKey)
 
-		if record.OrgID != "" {
-			record.Tags = append(record.Tags, "org-"+record.OrgID)
-		}
+	if globalConf.SlaveOptions.UseRPC {
+		// Extend tag list to include this data so wecan segment by node if necessary
+		record.Tags = append(record.Tags, "tyk-hybrid-rpc")
+	}
 
-		record.Tags = append(record.Tags, "api-"+record.APIID)
+	if globalConf.DBAppConfOptions.NodeIsSegmented {
+		// Extend tag list to include this data so wecan segment by node if necessary
+		record.Tags = append(record.Tags, globalConf.DBAppConfOptions.Tags...)
+	}
 
-		encoded, err := msgpack.Marshal(record)
+	// Lets add some metadata
+	if record.APIKey != "" {
+		record.Tags = append(record.Tags, "key-"+record.APIKey)
+	}
 
-		if err != nil {
-			log.Error("Error encoding analytics data: ", err)
-		}
+	if record.OrgID != "" {
+		record.Tags = append(record.Tags, "org-"+record.OrgID)
+	}
 
-		r.Store.AppendToSet(analyticsKeyName, string(encoded))
-	})
+	record.Tags = append(record.Tags, "api-"+record.APIID)
 
+	if r.buffer == nil {
+		return errAnalyticsBufferFull
+	}
+	// Under drop_oldest the record is queued in place of an older one
+	if queued, _ := r.buffer.Push(record); !queued {
+		return errAnalyticsBufferFull
+	}
 	return nil
-
 }
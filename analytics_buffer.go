@@ -0,0 +1,209 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultAnalyticsBufferSize    = 10000
+	defaultAnalyticsBatchSize     = 100
+	defaultAnalyticsFlushInterval = 200 // milliseconds
+	defaultAnalyticsPoolSize      = 50
+
+	analyticsDropNewest = "drop_newest"
+	analyticsDropOldest = "drop_oldest"
+)
+
+// analyticsRingBuffer holds analytics records waiting to be written to
+// the sinks. It never grows past its capacity, once full records are
+// dropped according to the drop policy.
+type analyticsRingBuffer struct {
+	mu         sync.Mutex
+	records    []AnalyticsRecord
+	head, size int
+	dropOldest bool
+	dropped    uint64
+
+	// notify is signalled once a batch is ready to be written
+	notify    chan struct{}
+	batchSize int
+}
+
+func newAnalyticsRingBuffer(capacity, batchSize int, dropPolicy string) *analyticsRingBuffer {
+	return &analyticsRingBuffer{
+		records:    make([]AnalyticsRecord, capacity),
+		dropOldest: dropPolicy == analyticsDropOldest,
+		notify:     make(chan struct{}, 1),
+		batchSize:  batchSize,
+	}
+}
+
+// Push adds a record without blocking. It reports whether the record was
+// queued, and whether an older one was dropped to make room for it.
+func (b *analyticsRingBuffer) Push(record AnalyticsRecord) (queued, droppedOld bool) {
+	b.mu.Lock()
+	switch {
+	case b.size < len(b.records):
+		b.records[(b.head+b.size)%len(b.records)] = record
+		b.size++
+		queued = true
+	case b.dropOldest:
+		b.records[b.head] = record
+		b.head = (b.head + 1) % len(b.records)
+		queued, droppedOld = true, true
+	}
+	ready := b.size >= b.batchSize
+	b.mu.Unlock()
+
+	if !queued || droppedOld {
+		atomic.AddUint64(&b.dropped, 1)
+	}
+	if ready {
+		select {
+		case b.notify <- struct{}{}:
+		default:
+		}
+	}
+	return queued, droppedOld
+}
+
+// Pop removes and returns up to max records, oldest first.
+func (b *analyticsRingBuffer) Pop(max int) []AnalyticsRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if max > b.size {
+		max = b.size
+	}
+	if max == 0 {
+		return nil
+	}
+	batch := make([]AnalyticsRecord, max)
+	for i := range batch {
+		j := (b.head + i) % len(b.records)
+		batch[i] = b.records[j]
+		// let the GC reclaim the record's fields
+		b.records[j] = AnalyticsRecord{}
+	}
+	b.head = (b.head + max) % len(b.records)
+	b.size -= max
+	return batch
+}
+
+// Len returns the number of records waiting to be written.
+func (b *analyticsRingBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// Dropped returns the number of records dropped since start.
+func (b *analyticsRingBuffer) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// analyticsBufferStats returns the depth of the analytics buffer and
+// the number of records it dropped, zero if analytics are disabled.
+func analyticsBufferStats() (depth int, dropped uint64) {
+	if analytics.buffer == nil {
+		return 0, 0
+	}
+	return analytics.buffer.Len(), analytics.buffer.Dropped()
+}
+
+func (r *RedisAnalyticsHandler) startWriters() {
+	conf := globalConf.AnalyticsConfig
+	size := conf.BufferSize
+	if size <= 0 {
+		size = defaultAnalyticsBufferSize
+	}
+	batchSize := conf.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultAnalyticsBatchSize
+	}
+	interval := time.Duration(conf.FlushInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultAnalyticsFlushInterval * time.Millisecond
+	}
+	workers := conf.PoolSize
+	if workers <= 0 {
+		workers = defaultAnalyticsPoolSize
+	}
+	switch conf.DropPolicy {
+	case "", analyticsDropNewest, analyticsDropOldest:
+	default:
+		log.WithFields(logrus.Fields{
+			"prefix": "analytics",
+		}).Warning("Unknown analytics drop policy ", conf.DropPolicy, ", using ", analyticsDropNewest)
+	}
+
+	r.stopWriters()
+	r.buffer = newAnalyticsRingBuffer(size, batchSize, conf.DropPolicy)
+	r.batchSize = batchSize
+	r.stop = make(chan struct{})
+	for i := 0; i < workers; i++ {
+		r.writers.Add(1)
+		go r.writeLoop(interval)
+	}
+}
+
+func (r *RedisAnalyticsHandler) stopWriters() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	r.writers.Wait()
+	r.stop = nil
+}
+
+func (r *RedisAnalyticsHandler) writeLoop(interval time.Duration) {
+	defer r.writers.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.buffer.notify:
+		case <-ticker.C:
+		case <-r.stop:
+			r.drain()
+			return
+		}
+		r.drain()
+	}
+}
+
+// Flush writes all buffered records to the sinks and waits for the
+// batches other writers are busy with.
+func (r *RedisAnalyticsHandler) Flush() {
+	r.drain()
+	r.inflight.Lock()
+	r.inflight.Unlock()
+}
+
+func (r *RedisAnalyticsHandler) drain() {
+	if r.buffer == nil {
+		return
+	}
+	r.inflight.RLock()
+	defer r.inflight.RUnlock()
+	for {
+		batch := r.buffer.Pop(r.batchSize)
+		if len(batch) == 0 {
+			return
+		}
+		r.writeBatch(batch)
+	}
+}
+
+func (r *RedisAnalyticsHandler) writeBatch(batch []AnalyticsRecord) {
+	for _, sink := range r.Sinks {
+		if err := sink.Write(batch); err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": "analytics",
+			}).Error("Failed to write analytics records: ", err)
+		}
+	}
+}
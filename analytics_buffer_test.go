@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestAnalyticsRingBufferDropPolicy(t *testing.T) {
+	tests := []struct {
+		policy      string
+		wantAPIIDs  []string
+		wantDropped uint64
+		wantQueued  bool
+	}{
+		{"", []string{"0", "1", "2"}, 2, false},
+		{analyticsDropNewest, []string{"0", "1", "2"}, 2, false},
+		{analyticsDropOldest, []string{"2", "3", "4"}, 2, true},
+	}
+	for _, tc := range tests {
+		b := newAnalyticsRingBuffer(3, 10, tc.policy)
+		var queued, droppedOld bool
+		for i := 0; i < 5; i++ {
+			queued, droppedOld = b.Push(AnalyticsRecord{APIID: strconv.Itoa(i)})
+		}
+		// The last record went into a full buffer
+		if queued != tc.wantQueued || droppedOld != tc.wantQueued {
+			t.Errorf("policy %q: wanted last record queued=%v droppedOld=%v, got %v %v",
+				tc.policy, tc.wantQueued, tc.wantQueued, queued, droppedOld)
+		}
+		if b.Len() != 3 {
+			t.Errorf("policy %q: wanted depth 3, got %d", tc.policy, b.Len())
+		}
+		if b.Dropped() != tc.wantDropped {
+			t.Errorf("policy %q: wanted %d dropped, got %d", tc.policy, tc.wantDropped, b.Dropped())
+		}
+		var got []string
+		for _, batch := range [][]AnalyticsRecord{b.Pop(2), b.Pop(2)} {
+			for _, record := range batch {
+				got = append(got, record.APIID)
+			}
+		}
+		if len(got) != len(tc.wantAPIIDs) {
+			t.Fatalf("policy %q: wanted %v, got %v", tc.policy, tc.wantAPIIDs, got)
+		}
+		for i := range got {
+			if got[i] != tc.wantAPIIDs[i] {
+				t.Errorf("policy %q: wanted %v, got %v", tc.policy, tc.wantAPIIDs, got)
+				break
+			}
+		}
+		if b.Len() != 0 {
+			t.Errorf("policy %q: wanted empty buffer, got %d", tc.policy, b.Len())
+		}
+	}
+}
+
+func TestAnalyticsRingBufferNotify(t *testing.T) {
+	b := newAnalyticsRingBuffer(10, 2, "")
+	b.Push(AnalyticsRecord{})
+	select {
+	case <-b.notify:
+		t.Fatal("notified before a batch was ready")
+	default:
+	}
+	b.Push(AnalyticsRecord{})
+	select {
+	case <-b.notify:
+	default:
+		t.Fatal("wanted a notification once a batch was ready")
+	}
+}
+
+func TestAnalyticsFlushPipelined(t *testing.T) {
+	analytics.Flush()
+	analytics.Store.GetAndDeleteSet(analyticsKeyName)
+
+	for i := 0; i < 5; i++ {
+		analytics.RecordHit(AnalyticsRecord{APIID: "buffered", ResponseCode: 200})
+	}
+	analytics.Flush()
+
+	if depth, _ := analyticsBufferStats(); depth != 0 {
+		t.Errorf("wanted an empty buffer after flushing, got %d", depth)
+	}
+	if got := len(analytics.Store.GetAndDeleteSet(analyticsKeyName)); got != 5 {
+		t.Errorf("wanted 5 records in Redis, got %d", got)
+	}
+}
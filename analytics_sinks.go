@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	defaultAnalyticsFileMaxSizeMB     = 100
+	defaultAnalyticsFileMaxBackups    = 5
+	defaultAnalyticsHTTPBatchSize     = 100
+	defaultAnalyticsHTTPFlushInterval = 1000 // milliseconds
+	defaultAnalyticsHTTPTimeout       = 10   // seconds
+	defaultAnalyticsSyslogTag         = "tyk-analytics"
+
+	// analyticsHTTPMaxPendingBatches bounds how many batches are kept
+	// for a collector that is down
+	analyticsHTTPMaxPendingBatches = 10
+)
+
+// AnalyticsSink is a destination for analytics records. Several sinks
+// can be enabled at once, each record is written to all of them.
+type AnalyticsSink interface {
+	Init() error
+	Write(records []AnalyticsRecord) error
+	Close() error
+}
+
+// analyticsSinkTypes returns the sink names listed in analytics_config.type,
+// which is a comma separated list. The legacy pump types all mean the
+// Redis list is used.
+func analyticsSinkTypes() []string {
+	var types []string
+	seen := make(map[string]bool)
+	for _, t := range strings.Split(globalConf.AnalyticsConfig.Type, ",") {
+		switch t = strings.ToLower(strings.TrimSpace(t)); t {
+		case "", "mongo", "csv", "rpc":
+			t = "redis"
+		}
+		if !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+func analyticsTypeEnabled(name string) bool {
+	for _, t := range strings.Split(globalConf.AnalyticsConfig.Type, ",") {
+		if strings.ToLower(strings.TrimSpace(t)) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func newAnalyticsSink(name string, store StorageHandler) (AnalyticsSink, error) {
+	conf := globalConf.AnalyticsConfig
+	switch name {
+	case "redis":
+		return &RedisAnalyticsSink{Store: store}, nil
+	case "file":
+		return &FileAnalyticsSink{
+			Path:       conf.File.Path,
+			MaxSize:    int64(conf.File.MaxSizeMB) << 20,
+			MaxBackups: conf.File.MaxBackups,
+		}, nil
+	case "http":
+		return &HTTPAnalyticsSink{
+			URL:           conf.HTTP.URL,
+			Headers:       conf.HTTP.Headers,
+			BatchSize:     conf.HTTP.BatchSize,
+			FlushInterval: time.Duration(conf.HTTP.FlushInterval) * time.Millisecond,
+			Timeout:       time.Duration(conf.HTTP.Timeout) * time.Second,
+		}, nil
+	case "syslog":
+		return &SyslogAnalyticsSink{
+			Network: conf.Syslog.Network,
+			Addr:    conf.Syslog.Addr,
+			Tag:     conf.Syslog.Tag,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown analytics sink type %q", name)
+}
+
+// RedisAnalyticsSink appends msgpack encoded records to the analytics
+// set that is drained by tyk-pump.
+type RedisAnalyticsSink struct {
+	Store StorageHandler
+}
+
+func (s *RedisAnalyticsSink) Init() error {
+	if s.Store == nil {
+		return errors.New("no analytics store set")
+	}
+	s.Store.Connect()
+	return nil
+}
+
+func (s *RedisAnalyticsSink) Write(records []AnalyticsRecord) error {
+	values := make([]string, 0, len(records))
+	for _, record := range records {
+		encoded, err := msgpack.Marshal(record)
+		if err != nil {
+			log.Error("Error encoding analytics data: ", err)
+			continue
+		}
+		values = append(values, string(encoded))
+	}
+	s.Store.AppendToSetPipelined(analyticsKeyName, values)
+	return nil
+}
+
+func (s *RedisAnalyticsSink) Close() error { return nil }
+
+// FileAnalyticsSink writes newline delimited JSON records to a file,
+// rotating it to Path.1, Path.2 and so on once it grows past MaxSize.
+type FileAnalyticsSink struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func (s *FileAnalyticsSink) Init() error {
+	if s.Path == "" {
+		return errors.New("no analytics file path set")
+	}
+	if s.MaxSize <= 0 {
+		s.MaxSize = defaultAnalyticsFileMaxSizeMB << 20
+	}
+	if s.MaxBackups <= 0 {
+		s.MaxBackups = defaultAnalyticsFileMaxBackups
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.open()
+}
+
+// open must be called with the lock held.
+func (s *FileAnalyticsSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.size = f, info.Size()
+	return nil
+}
+
+// rotate must be called with the lock held.
+func (s *FileAnalyticsSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	// the oldest backup is overwritten by the one before it
+	for i := s.MaxBackups - 1; i > 0; i-- {
+		from := s.Path + "." + strconv.Itoa(i)
+		if _, err := os.Stat(from); err == nil {
+			os.Rename(from, s.Path+"."+strconv.Itoa(i+1))
+		}
+	}
+	if err := os.Rename(s.Path, s.Path+".1"); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileAnalyticsSink) Write(records []AnalyticsRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			log.Error("Error encoding analytics data: ", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return errors.New("analytics file is closed")
+	}
+	if s.size > 0 && s.size+int64(buf.Len()) > s.MaxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(buf.Bytes())
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileAnalyticsSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// HTTPAnalyticsSink posts records to a collector as a JSON array, once
+// BatchSize records are pending or every FlushInterval.
+type HTTPAnalyticsSink struct {
+	URL           string
+	Headers       map[string]string
+	BatchSize     int
+	FlushInterval time.Duration
+	Timeout       time.Duration
+
+	client  *http.Client
+	mu      sync.Mutex
+	pending []AnalyticsRecord
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func (s *HTTPAnalyticsSink) Init() error {
+	if s.URL == "" {
+		return errors.New("no analytics collector URL set")
+	}
+	if s.BatchSize <= 0 {
+		s.BatchSize = defaultAnalyticsHTTPBatchSize
+	}
+	if s.FlushInterval <= 0 {
+		s.FlushInterval = defaultAnalyticsHTTPFlushInterval * time.Millisecond
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = defaultAnalyticsHTTPTimeout * time.Second
+	}
+	s.client = &http.Client{Timeout: s.Timeout}
+	s.stop = make(chan struct{})
+	s.stopped = make(chan struct{})
+	go s.flushLoop()
+	return nil
+}
+
+func (s *HTTPAnalyticsSink) flushLoop() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Flush()
+		case <-s.stop:
+			s.Flush()
+			return
+		}
+	}
+}
+
+func (s *HTTPAnalyticsSink) Write(records []AnalyticsRecord) error {
+	s.mu.Lock()
+	s.pending = append(s.pending, records...)
+	full := len(s.pending) >= s.BatchSize
+	s.mu.Unlock()
+	if full {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Flush posts all pending records, in batches of at most BatchSize. If a
+// batch fails, it and the ones after it are kept for the next flush, up
+// to analyticsHTTPMaxPendingBatches, the oldest being dropped beyond that.
+func (s *HTTPAnalyticsSink) Flush() error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	for len(pending) > 0 {
+		n := len(pending)
+		if n > s.BatchSize {
+			n = s.BatchSize
+		}
+		if err := s.post(pending[:n]); err != nil {
+			dropped := s.requeue(pending)
+			log.WithFields(logrus.Fields{
+				"prefix": "analytics",
+			}).Error("Failed to post analytics batch, retrying ", len(pending)-dropped,
+				" records on the next flush and dropping ", dropped, ": ", err)
+			return err
+		}
+		pending = pending[n:]
+	}
+	return nil
+}
+
+// requeue puts unsent records back before those written since, returning
+// how many didn't fit.
+func (s *HTTPAnalyticsSink) requeue(unsent []AnalyticsRecord) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(unsent, s.pending...)
+	dropped := len(s.pending) - analyticsHTTPMaxPendingBatches*s.BatchSize
+	if dropped <= 0 {
+		return 0
+	}
+	s.pending = s.pending[dropped:]
+	return dropped
+}
+
+func (s *HTTPAnalyticsSink) post(batch []AnalyticsRecord) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *HTTPAnalyticsSink) Close() error {
+	if s.stop == nil {
+		return nil
+	}
+	close(s.stop)
+	<-s.stopped
+	s.stop = nil
+	return nil
+}
+
+// SyslogAnalyticsSink writes each record as a JSON message to syslog,
+// the local daemon is used if Network and Addr are empty.
+type SyslogAnalyticsSink struct {
+	Network string
+	Addr    string
+	Tag     string
+
+	writer *syslog.Writer
+}
+
+func (s *SyslogAnalyticsSink) Init() error {
+	if s.Tag == "" {
+		s.Tag = defaultAnalyticsSyslogTag
+	}
+	w, err := syslog.Dial(s.Network, s.Addr, syslog.LOG_INFO|syslog.LOG_LOCAL0, s.Tag)
+	if err != nil {
+		return err
+	}
+	s.writer = w
+	return nil
+}
+
+func (s *SyslogAnalyticsSink) Write(records []AnalyticsRecord) error {
+	for _, record := range records {
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			log.Error("Error encoding analytics data: ", err)
+			continue
+		}
+		if err := s.writer.Info(string(encoded)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SyslogAnalyticsSink) Close() error {
+	return s.writer.Close()
+}
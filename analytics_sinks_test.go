@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestAnalyticsSinkTypes(t *testing.T) {
+	defer func(old string) { globalConf.AnalyticsConfig.Type = old }(globalConf.AnalyticsConfig.Type)
+
+	for typ, want := range map[string][]string{
+		"":                  {"redis"},
+		"mongo":             {"redis"},
+		"rpc, file":         {"redis", "file"},
+		"file,http,syslog":  {"file", "http", "syslog"},
+		"redis,mongo,HTTP ": {"redis", "http"},
+	} {
+		globalConf.AnalyticsConfig.Type = typ
+		if got := analyticsSinkTypes(); !reflect.DeepEqual(got, want) {
+			t.Errorf("type %q: wanted sinks %v, got %v", typ, want, got)
+		}
+	}
+}
+
+func TestFileAnalyticsSinkRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tyk-analytics-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "analytics.log")
+	sink := &FileAnalyticsSink{Path: path, MaxSize: 300, MaxBackups: 2}
+	if err := sink.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := sink.Write([]AnalyticsRecord{{APIID: "rotated", ResponseCode: 200}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.Close()
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(f)
+		lines := 0
+		for scanner.Scan() {
+			var record AnalyticsRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Fatalf("%s: line is not a JSON record: %v", name, err)
+			}
+			lines++
+		}
+		f.Close()
+		if lines == 0 {
+			t.Errorf("%s: wanted records, got none", name)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("wanted at most 2 backups")
+	}
+}
+
+func TestHTTPAnalyticsSinkBatches(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]AnalyticsRecord
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []AnalyticsRecord
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		mu.Lock()
+		batches = append(batches, batch)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	sink := &HTTPAnalyticsSink{URL: collector.URL, BatchSize: 3}
+	if err := sink.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		sink.Write([]AnalyticsRecord{{APIID: "batched"}})
+	}
+	// the remainder is sent on close
+	sink.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	var sizes []int
+	for _, batch := range batches {
+		sizes = append(sizes, len(batch))
+	}
+	if want := []int{3, 3, 1}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("wanted batch sizes %v, got %v", want, sizes)
+	}
+}
+
+func TestHTTPAnalyticsSinkRetries(t *testing.T) {
+	var mu sync.Mutex
+	failing := true
+	received := 0
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			http.Error(w, "down", 503)
+			return
+		}
+		var batch []AnalyticsRecord
+		json.NewDecoder(r.Body).Decode(&batch)
+		received += len(batch)
+	}))
+	defer collector.Close()
+
+	sink := &HTTPAnalyticsSink{URL: collector.URL, BatchSize: 2}
+	if err := sink.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	sink.Write(make([]AnalyticsRecord, 5))
+	if err := sink.Flush(); err == nil {
+		t.Fatal("wanted the flush to fail")
+	}
+	// More than fits is dropped, the oldest first
+	sink.Write(make([]AnalyticsRecord, analyticsHTTPMaxPendingBatches*2))
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := analyticsHTTPMaxPendingBatches * 2; received != want {
+		t.Errorf("wanted %d records kept for retry, got %d", want, received)
+	}
+}
+
+type closeRecordingSink struct {
+	closed bool
+}
+
+func (s *closeRecordingSink) Init() error                           { return nil }
+func (s *closeRecordingSink) Write(records []AnalyticsRecord) error { return nil }
+func (s *closeRecordingSink) Close() error                          { s.closed = true; return nil }
+
+func TestAnalyticsReloadClosesSinks(t *testing.T) {
+	old := &closeRecordingSink{}
+	handler := &RedisAnalyticsHandler{Store: analytics.Store, Sinks: []AnalyticsSink{old}}
+	handler.Init()
+	defer handler.stopWriters()
+
+	if !old.closed {
+		t.Error("wanted the old sink to be closed on reload")
+	}
+	for _, sink := range handler.Sinks {
+		if sink == AnalyticsSink(old) {
+			t.Error("wanted the old sink to be replaced")
+		}
+	}
+}
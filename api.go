@@ -131,7 +131,7 @@ func doAddOrUpdate(keyName string, newSession *SessionState, dontReset bool) err
 				// Reset quote by default
 				if !dontReset {
 					apiSpec.SessionManager.ResetQuota(keyName, newSession)
-					newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
+					newSession.QuotaRenews = newSession.nextQuotaRenewal(time.Now())
 				}
 
 				err := apiSpec.SessionManager.UpdateSession(keyName, newSession, getLifetime(apiSpec, newSession))
@@ -152,7 +152,7 @@ func doAddOrUpdate(keyName string, newSession *SessionState, dontReset bool) err
 		for _, spec := range apisByID {
 			if !dontReset {
 				spec.SessionManager.ResetQuota(keyName, newSession)
-				newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
+				newSession.QuotaRenews = newSession.nextQuotaRenewal(time.Now())
 			}
 			checkAndApplyTrialPeriod(keyName, spec.APIID, newSession)
 			err := spec.SessionManager.UpdateSession(keyName, newSession, getLifetime(spec, newSession))
@@ -218,6 +218,12 @@ func handleAddOrUpdate(keyName string, r *http.Request) (interface{}, int) {
 		log.Error("Couldn't decode new session object: ", err)
 		return apiError("Request malformed"), 400
 	}
+	if err := newSession.QuotaSchedule.validate(); err != nil {
+		return apiError("Invalid quota schedule: " + err.Error()), 400
+	}
+	if err := validateQuotaWindows(newSession.QuotaWindows); err != nil {
+		return apiError("Invalid quota windows: " + err.Error()), 400
+	}
 	// DO ADD OR UPDATE
 	// Update our session object (create it)
 	if newSession.BasicAuthData.Password != "" {
@@ -291,6 +297,10 @@ func handleGetDetail(sessionKey, apiID string) (interface{}, int) {
 	if !ok {
 		return apiError("Key not found"), 404
 	}
+	session.QuotaRenews = session.quotaResetsAt(time.Now())
+	for i := range session.QuotaWindows {
+		session.QuotaWindows[i].QuotaRenews = session.QuotaWindows[i].resetsAt(time.Now())
+	}
 
 	log.WithFields(logrus.Fields{
 		"prefix": "api",
@@ -758,7 +768,7 @@ func handleOrgAddOrUpdate(keyName string, r *http.Request) (interface{}, int) {
 
 	if r.FormValue("reset_quota") == "1" {
 		sessionManager.ResetQuota(keyName, newSession)
-		newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
+		newSession.QuotaRenews = newSession.nextQuotaRenewal(time.Now())
 		rawKey := QuotaKeyPrefix + publicHash(keyName)
 
 		// manage quotas separately
@@ -883,6 +893,14 @@ func createKeyHandler(w http.ResponseWriter, r *http.Request) {
 		doJSONWrite(w, 500, apiError("Unmarshalling failed"))
 		return
 	}
+	if err := newSession.QuotaSchedule.validate(); err != nil {
+		doJSONWrite(w, 400, apiError("Invalid quota schedule: "+err.Error()))
+		return
+	}
+	if err := validateQuotaWindows(newSession.QuotaWindows); err != nil {
+		doJSONWrite(w, 400, apiError("Invalid quota windows: "+err.Error()))
+		return
+	}
 
 	newKey := keyGen.GenerateAuthKey(newSession.OrgID)
 	if newSession.HMACEnabled {
@@ -900,7 +918,7 @@ func createKeyHandler(w http.ResponseWriter, r *http.Request) {
 				if !apiSpec.DontSetQuotasOnCreate {
 					// Reset quota by default
 					apiSpec.SessionManager.ResetQuota(newKey, newSession)
-					newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
+					newSession.QuotaRenews = newSession.nextQuotaRenewal(time.Now())
 				}
 				err := apiSpec.SessionManager.UpdateSession(newKey, newSession, getLifetime(apiSpec, newSession))
 				if err != nil {
@@ -910,7 +928,7 @@ func createKeyHandler(w http.ResponseWriter, r *http.Request) {
 			} else {
 				// Use fallback
 				sessionManager := FallbackKeySesionManager
-				newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
+				newSession.QuotaRenews = newSession.nextQuotaRenewal(time.Now())
 				sessionManager.ResetQuota(newKey, newSession)
 				err := sessionManager.UpdateSession(newKey, newSession, -1)
 				if err != nil {
@@ -940,7 +958,7 @@ func createKeyHandler(w http.ResponseWriter, r *http.Request) {
 				if !spec.DontSetQuotasOnCreate {
 					// Reset quote by default
 					spec.SessionManager.ResetQuota(newKey, newSession)
-					newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
+					newSession.QuotaRenews = newSession.nextQuotaRenewal(time.Now())
 				}
 				err := spec.SessionManager.UpdateSession(newKey, newSession, getLifetime(spec, newSession))
 				if err != nil {
@@ -999,11 +1017,13 @@ func createKeyHandler(w http.ResponseWriter, r *http.Request) {
 
 // NewClientRequest is an outward facing JSON object translated from osin OAuthClients
 type NewClientRequest struct {
-	ClientID          string `json:"client_id"`
-	ClientRedirectURI string `json:"redirect_uri"`
-	APIID             string `json:"api_id"`
-	PolicyID          string `json:"policy_id"`
-	ClientSecret      string `json:"secret"`
+	ClientID          string   `json:"client_id"`
+	ClientRedirectURI string   `json:"redirect_uri"`
+	APIID             string   `json:"api_id"`
+	PolicyID          string   `json:"policy_id"`
+	ClientSecret      string   `json:"secret"`
+	AllowedGrantTypes []string `json:"allowed_grant_types"`
+	PublicClient      bool     `json:"public_client"`
 }
 
 func createOauthClientStorageID(clientID string) string {
@@ -1031,8 +1051,11 @@ func createOauthClient(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Allow the secret to be set
+	// Public clients, like mobile apps, have no secret to keep
 	secret := newOauthClient.ClientSecret
-	if newOauthClient.ClientSecret == "" {
+	if newOauthClient.PublicClient {
+		secret = ""
+	} else if newOauthClient.ClientSecret == "" {
 		u5Secret := uuid.NewV4()
 		secret = base64.StdEncoding.EncodeToString([]byte(u5Secret.String()))
 	}
@@ -1042,6 +1065,7 @@ func createOauthClient(w http.ResponseWriter, r *http.Request) {
 		ClientRedirectURI: newOauthClient.ClientRedirectURI,
 		ClientSecret:      secret,
 		PolicyID:          newOauthClient.PolicyID,
+		AllowedGrantTypes: newOauthClient.AllowedGrantTypes,
 	}
 
 	storageID := createOauthClientStorageID(newClient.GetId())
@@ -1335,7 +1359,7 @@ func UserRatesCheck() http.HandlerFunc {
 		}
 
 		returnSession := PublicSessionState{}
-		returnSession.Quota.QuotaRenews = session.QuotaRenews
+		returnSession.Quota.QuotaRenews = session.quotaResetsAt(time.Now())
 		returnSession.Quota.QuotaRemaining = session.QuotaRemaining
 		returnSession.Quota.QuotaMax = session.QuotaMax
 		returnSession.RateLimit.Rate = session.Rate
@@ -1463,6 +1487,79 @@ func ctxSetDoNotTrack(r *http.Request, b bool) {
 	setCtxValue(r, DoNotTrackThisEndpoint, b)
 }
 
+func ctxGetInFlightHost(r *http.Request) string {
+	if v := r.Context().Value(InFlightHost); v != nil {
+		return v.(string)
+	}
+	return ""
+}
+
+func ctxSetInFlightHost(r *http.Request, host string) {
+	setCtxValue(r, InFlightHost, host)
+}
+
+func ctxGetUpstreamTarget(r *http.Request) string {
+	if v := r.Context().Value(UpstreamTarget); v != nil {
+		return v.(string)
+	}
+	return ""
+}
+
+func ctxSetUpstreamTarget(r *http.Request, target string) {
+	setCtxValue(r, UpstreamTarget, target)
+}
+
+func ctxGetTriedTargets(r *http.Request) map[string]bool {
+	if v := r.Context().Value(TriedTargets); v != nil {
+		return v.(map[string]bool)
+	}
+	return nil
+}
+
+func ctxGetRetries(r *http.Request) int {
+	if v := r.Context().Value(RetryAttempts); v != nil {
+		return v.(int)
+	}
+	return 0
+}
+
+func ctxSetRetries(r *http.Request, n int) {
+	setCtxValue(r, RetryAttempts, n)
+}
+
+func ctxGetTrustedProxies(r *http.Request) *trustedProxies {
+	if v := r.Context().Value(TrustedProxyConfig); v != nil {
+		return v.(*trustedProxies)
+	}
+	return nil
+}
+
+func ctxSetTrustedProxies(r *http.Request, tp *trustedProxies) {
+	setCtxValue(r, TrustedProxyConfig, tp)
+}
+
+func ctxGetRateLimitState(r *http.Request) *rateLimitState {
+	if v := r.Context().Value(RateLimitData); v != nil {
+		return v.(*rateLimitState)
+	}
+	return nil
+}
+
+func ctxSetRateLimitState(r *http.Request, s *rateLimitState) {
+	setCtxValue(r, RateLimitData, s)
+}
+
+func ctxGetConcurrencySlots(r *http.Request) []concurrencySlot {
+	if v := r.Context().Value(ConcurrencySlots); v != nil {
+		return v.([]concurrencySlot)
+	}
+	return nil
+}
+
+func ctxSetConcurrencySlots(r *http.Request, slots []concurrencySlot) {
+	setCtxValue(r, ConcurrencySlots, slots)
+}
+
 func ctxGetVersionInfo(r *http.Request) *apidef.VersionInfo {
 	if v := r.Context().Value(VersionData); v != nil {
 		return v.(*apidef.VersionInfo)
@@ -48,6 +48,9 @@ const (
 	MethodTransformed
 	RequestTracked
 	RequestNotTracked
+	UpstreamRetry
+	CacheConfigured
+	RateLimited
 )
 
 // RequestStatus is a custom type to avoid collisions
@@ -76,6 +79,9 @@ const (
 	StatusRequestSizeControlled    RequestStatus = "Request Size Limited"
 	StatusRequesTracked            RequestStatus = "Request Tracked"
 	StatusRequestNotTracked        RequestStatus = "Request Not Tracked"
+	StatusUpstreamRetry            RequestStatus = "Upstream retries enabled on path"
+	StatusCacheConfigured          RequestStatus = "Cached path with key configuration"
+	StatusRateLimited              RequestStatus = "Rate limit enforced on path"
 )
 
 // URLSpec represents a flattened specification for URLs, used to check if a proxy URL
@@ -97,6 +103,9 @@ type URLSpec struct {
 	MethodTransform         apidef.MethodTransformMeta
 	TrackEndpoint           apidef.TrackEndpointMeta
 	DoNotTrackEndpoint      apidef.TrackEndpointMeta
+	Retry                   apidef.RetryMeta
+	CacheConfig             apidef.CacheMeta
+	RateLimit               apidef.RateLimitMeta
 }
 
 type TransformSpec struct {
@@ -126,8 +135,12 @@ type APISpec struct {
 	JSVM                     JSVM
 	ResponseChain            []TykResponseHandler
 	RoundRobin               RoundRobin
+	WeightedRoundRobin       WeightedRoundRobin
+	UpstreamLoad             UpstreamLoad
+	Outliers                 OutlierDetector
 	URLRewriteEnabled        bool
 	CircuitBreakerEnabled    bool
+	RetryPathsEnabled        bool
 	EnforcedTimeoutEnabled   bool
 	ResponseHandlersActive   bool
 	LastGoodHostList         *apidef.HostList
@@ -455,6 +468,20 @@ func (a APIDefinitionLoader) compileCachedPathSpec(paths []string) []URLSpec {
 	return urlSpec
 }
 
+func (a APIDefinitionLoader) compileCacheConfigPathSpec(paths []apidef.CacheMeta, stat URLStatus) []URLSpec {
+	urlSpec := []URLSpec{}
+
+	for _, stringSpec := range paths {
+		newSpec := URLSpec{}
+		a.generateRegex(stringSpec.Path, &newSpec, stat)
+		// Extend with method actions
+		newSpec.CacheConfig = stringSpec
+		urlSpec = append(urlSpec, newSpec)
+	}
+
+	return urlSpec
+}
+
 func (a APIDefinitionLoader) loadFileTemplate(path string) (*textTemplate.Template, error) {
 	log.Debug("-- Loading template: ", path)
 	return textTemplate.ParseFiles(path)
@@ -719,6 +746,34 @@ func (a APIDefinitionLoader) compileUnTrackedEndpointPathspathSpec(paths []apide
 	return urlSpec
 }
 
+func (a APIDefinitionLoader) compileRetryPathSpec(paths []apidef.RetryMeta, stat URLStatus) []URLSpec {
+	urlSpec := []URLSpec{}
+
+	for _, stringSpec := range paths {
+		newSpec := URLSpec{}
+		a.generateRegex(stringSpec.Path, &newSpec, stat)
+		// Extend with method actions
+		newSpec.Retry = stringSpec
+		urlSpec = append(urlSpec, newSpec)
+	}
+
+	return urlSpec
+}
+
+func (a APIDefinitionLoader) compileRateLimitPathSpec(paths []apidef.RateLimitMeta, stat URLStatus) []URLSpec {
+	urlSpec := []URLSpec{}
+
+	for _, stringSpec := range paths {
+		newSpec := URLSpec{}
+		a.generateRegex(stringSpec.Path, &newSpec, stat)
+		// Extend with method actions
+		newSpec.RateLimit = stringSpec
+		urlSpec = append(urlSpec, newSpec)
+	}
+
+	return urlSpec
+}
+
 func (a APIDefinitionLoader) getExtendedPathSpecs(apiVersionDef apidef.VersionInfo, apiSpec *APISpec) ([]URLSpec, bool) {
 	// TODO: New compiler here, needs to put data into a different structure
 
@@ -726,6 +781,7 @@ func (a APIDefinitionLoader) getExtendedPathSpecs(apiVersionDef apidef.VersionIn
 	blackListPaths := a.compileExtendedPathSpec(apiVersionDef.ExtendedPaths.BlackList, BlackList)
 	whiteListPaths := a.compileExtendedPathSpec(apiVersionDef.ExtendedPaths.WhiteList, WhiteList)
 	cachedPaths := a.compileCachedPathSpec(apiVersionDef.ExtendedPaths.Cached)
+	cacheConfigPaths := a.compileCacheConfigPathSpec(apiVersionDef.ExtendedPaths.CacheConfig, CacheConfigured)
 	transformPaths := a.compileTransformPathSpec(apiVersionDef.ExtendedPaths.Transform, Transformed)
 	transformResponsePaths := a.compileTransformPathSpec(apiVersionDef.ExtendedPaths.TransformResponse, TransformedResponse)
 	headerTransformPaths := a.compileInjectedHeaderSpec(apiVersionDef.ExtendedPaths.TransformHeader, HeaderInjected)
@@ -738,12 +794,15 @@ func (a APIDefinitionLoader) getExtendedPathSpecs(apiVersionDef apidef.VersionIn
 	methodTransforms := a.compileMethodTransformSpec(apiVersionDef.ExtendedPaths.MethodTransforms, MethodTransformed)
 	trackedPaths := a.compileTrackedEndpointPathspathSpec(apiVersionDef.ExtendedPaths.TrackEndpoints, RequestTracked)
 	unTrackedPaths := a.compileUnTrackedEndpointPathspathSpec(apiVersionDef.ExtendedPaths.DoNotTrackEndpoints, RequestNotTracked)
+	retryPaths := a.compileRetryPathSpec(apiVersionDef.ExtendedPaths.Retries, UpstreamRetry)
+	rateLimitPaths := a.compileRateLimitPathSpec(apiVersionDef.ExtendedPaths.RateLimit, RateLimited)
 
 	combinedPath := []URLSpec{}
 	combinedPath = append(combinedPath, ignoredPaths...)
 	combinedPath = append(combinedPath, blackListPaths...)
 	combinedPath = append(combinedPath, whiteListPaths...)
 	combinedPath = append(combinedPath, cachedPaths...)
+	combinedPath = append(combinedPath, cacheConfigPaths...)
 	combinedPath = append(combinedPath, transformPaths...)
 	combinedPath = append(combinedPath, transformResponsePaths...)
 	combinedPath = append(combinedPath, headerTransformPaths...)
@@ -756,6 +815,8 @@ func (a APIDefinitionLoader) getExtendedPathSpecs(apiVersionDef apidef.VersionIn
 	combinedPath = append(combinedPath, methodTransforms...)
 	combinedPath = append(combinedPath, trackedPaths...)
 	combinedPath = append(combinedPath, unTrackedPaths...)
+	combinedPath = append(combinedPath, retryPaths...)
+	combinedPath = append(combinedPath, rateLimitPaths...)
 
 	return combinedPath, len(whiteListPaths) > 0
 }
@@ -801,6 +862,12 @@ func (a *APISpec) getURLStatus(stat URLStatus) RequestStatus {
 		return StatusRequesTracked
 	case RequestNotTracked:
 		return StatusRequestNotTracked
+	case UpstreamRetry:
+		return StatusUpstreamRetry
+	case CacheConfigured:
+		return StatusCacheConfigured
+	case RateLimited:
+		return StatusRateLimited
 	default:
 		log.Error("URL Status was not one of Ignored, Blacklist or WhiteList! Blocking.")
 		return EndPointNotAllowed
@@ -925,6 +992,18 @@ func (a *APISpec) CheckSpecMatchesStatus(r *http.Request, rxPaths []URLSpec, mod
 			if r.Method == v.DoNotTrackEndpoint.Method {
 				return true, &v.DoNotTrackEndpoint
 			}
+		case UpstreamRetry:
+			if r.Method == v.Retry.Method {
+				return true, &v.Retry
+			}
+		case CacheConfigured:
+			if r.Method == v.CacheConfig.Method {
+				return true, &v.CacheConfig
+			}
+		case RateLimited:
+			if r.Method == v.RateLimit.Method {
+				return true, &v.RateLimit
+			}
 		}
 	}
 	return false, nil
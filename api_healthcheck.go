@@ -28,6 +28,9 @@ type HealthCheckValues struct {
 	KeyFailuresPS       float64 `bson:"key_failures_per_second,omitempty" json:"key_failures_per_second"`
 	AvgUpstreamLatency  float64 `bson:"average_upstream_latency,omitempty" json:"average_upstream_latency"`
 	AvgRequestsPS       float64 `bson:"average_requests_per_second,omitempty" json:"average_requests_per_second"`
+
+	AnalyticsBufferDepth    int    `bson:"analytics_buffer_depth,omitempty" json:"analytics_buffer_depth"`
+	AnalyticsDroppedRecords uint64 `bson:"analytics_dropped_records,omitempty" json:"analytics_dropped_records"`
 }
 
 type DefaultHealthChecker struct {
@@ -102,6 +105,7 @@ func (h *DefaultHealthChecker) ApiHealthValues() (HealthCheckValues, error) {
 	values.QuotaViolationsPS = h.getAvgCount(QuotaViolation)
 	values.KeyFailuresPS = h.getAvgCount(KeyFailure)
 	values.AvgRequestsPS = h.getAvgCount(RequestLog)
+	values.AnalyticsBufferDepth, values.AnalyticsDroppedRecords = analyticsBufferStats()
 
 	// Get the micro latency graph, an average upstream latency
 	searchStr := h.APIID + "." + string(RequestLog)
@@ -268,6 +268,7 @@ func processSpec(spec *APISpec,
 	baseMid := &BaseMiddleware{spec, proxy}
 	CheckCBEnabled(baseMid)
 	CheckETEnabled(baseMid)
+	CheckRetriesEnabled(baseMid)
 
 	keyPrefix := "cache-" + spec.APIID
 	cacheStore := &RedisClusterStorageManager{KeyPrefix: keyPrefix, IsCache: true}
@@ -289,9 +290,13 @@ func processSpec(spec *APISpec,
 		baseChainArray := []alice.Constructor{}
 		AppendMiddleware(&baseChainArray, &RateCheckMW{BaseMiddleware: baseMid})
 		AppendMiddleware(&baseChainArray, &IPWhiteListMiddleware{BaseMiddleware: baseMid})
+		AppendMiddleware(&baseChainArray, &IPBlackListMiddleware{BaseMiddleware: baseMid})
+		AppendMiddleware(&baseChainArray, &GeoAccessMiddleware{BaseMiddleware: baseMid})
 		AppendMiddleware(&baseChainArray, &OrganizationMonitor{BaseMiddleware: baseMid})
 		AppendMiddleware(&baseChainArray, &MiddlewareContextVars{BaseMiddleware: baseMid})
 		AppendMiddleware(&baseChainArray, &VersionCheck{BaseMiddleware: baseMid})
+		AppendMiddleware(&baseChainArray, &RateLimitForAPI{BaseMiddleware: baseMid})
+		AppendMiddleware(&baseChainArray, &ConcurrencyLimit{BaseMiddleware: baseMid})
 		AppendMiddleware(&baseChainArray, &RequestSizeLimitMiddleware{baseMid})
 		AppendMiddleware(&baseChainArray, &TrackEndpointMiddleware{baseMid})
 		AppendMiddleware(&baseChainArray, &TransformMiddleware{baseMid})
@@ -338,11 +343,18 @@ func processSpec(spec *APISpec,
 
 		handleCORS(&chainArray, spec)
 
+		// Shared with the rate limit endpoint's chain
+		var accessRulesArray []alice.Constructor
+		AppendMiddleware(&accessRulesArray, &IPBlackListMiddleware{BaseMiddleware: baseMid})
+		AppendMiddleware(&accessRulesArray, &GeoAccessMiddleware{BaseMiddleware: baseMid})
+
 		var baseChainArray_PreAuth []alice.Constructor
 		AppendMiddleware(&baseChainArray_PreAuth, &RateCheckMW{BaseMiddleware: baseMid})
 		AppendMiddleware(&baseChainArray_PreAuth, &IPWhiteListMiddleware{BaseMiddleware: baseMid})
+		baseChainArray_PreAuth = append(baseChainArray_PreAuth, accessRulesArray...)
 		AppendMiddleware(&baseChainArray_PreAuth, &OrganizationMonitor{BaseMiddleware: baseMid})
 		AppendMiddleware(&baseChainArray_PreAuth, &VersionCheck{BaseMiddleware: baseMid})
+		AppendMiddleware(&baseChainArray_PreAuth, &RateLimitForAPI{BaseMiddleware: baseMid})
 		AppendMiddleware(&baseChainArray_PreAuth, &RequestSizeLimitMiddleware{baseMid})
 		AppendMiddleware(&baseChainArray_PreAuth, &MiddlewareContextVars{BaseMiddleware: baseMid})
 		AppendMiddleware(&baseChainArray_PreAuth, &TrackEndpointMiddleware{baseMid})
@@ -374,6 +386,15 @@ func processSpec(spec *APISpec,
 
 		}
 
+		if spec.UseIntrospection {
+			// OAuth2 token introspection
+			log.WithFields(logrus.Fields{
+				"prefix":   "main",
+				"api_name": spec.Name,
+			}).Info("Checking security policy: Token introspection")
+			authArray = append(authArray, CreateMiddleware(&IntrospectionMW{BaseMiddleware: baseMid}))
+		}
+
 		useCoProcessAuth := EnableCoProcess && mwDriver != apidef.OttoDriver && spec.EnableCoProcessAuth
 
 		useOttoAuth := false
@@ -405,7 +426,7 @@ func processSpec(spec *APISpec,
 				"prefix":   "main",
 				"api_name": spec.Name,
 			}).Info("Checking security policy: JWT")
-			authArray = append(authArray, CreateMiddleware(&JWTMiddleware{baseMid}))
+			authArray = append(authArray, CreateMiddleware(&JWTMiddleware{BaseMiddleware: baseMid}))
 		}
 
 		if spec.UseOpenID {
@@ -445,7 +466,7 @@ func processSpec(spec *APISpec,
 			authArray = append(authArray, CreateDynamicAuthMiddleware(mwAuthCheckFunc.Name, baseMid))
 		}
 
-		if spec.UseStandardAuth || (!spec.UseOpenID && !spec.EnableJWT && !spec.EnableSignatureChecking && !spec.UseBasicAuth && !spec.UseOauth2 && !useCoProcessAuth && !useOttoAuth) {
+		if spec.UseStandardAuth || (!spec.UseOpenID && !spec.EnableJWT && !spec.EnableSignatureChecking && !spec.UseBasicAuth && !spec.UseOauth2 && !spec.UseIntrospection && !useCoProcessAuth && !useOttoAuth) {
 			// Auth key
 			log.WithFields(logrus.Fields{
 				"prefix":   "main",
@@ -468,6 +489,7 @@ func processSpec(spec *APISpec,
 		AppendMiddleware(&baseChainArray_PostAuth, &KeyExpired{baseMid})
 		AppendMiddleware(&baseChainArray_PostAuth, &AccessRightsCheck{baseMid})
 		AppendMiddleware(&baseChainArray_PostAuth, &RateLimitAndQuotaCheck{baseMid})
+		AppendMiddleware(&baseChainArray_PostAuth, &ConcurrencyLimit{baseMid})
 		AppendMiddleware(&baseChainArray_PostAuth, &GranularAccessMiddleware{baseMid})
 		AppendMiddleware(&baseChainArray_PostAuth, &TransformMiddleware{baseMid})
 		AppendMiddleware(&baseChainArray_PostAuth, &TransformHeaders{BaseMiddleware: baseMid})
@@ -501,10 +523,11 @@ func processSpec(spec *APISpec,
 		log.Debug("Chain completed")
 
 		userCheckHandler := UserRatesCheck()
-		simpleChain_PreAuth := []alice.Constructor{
-			CreateMiddleware(&IPWhiteListMiddleware{baseMid}),
+		simpleChain_PreAuth := []alice.Constructor{CreateMiddleware(&IPWhiteListMiddleware{baseMid})}
+		simpleChain_PreAuth = append(simpleChain_PreAuth, accessRulesArray...)
+		simpleChain_PreAuth = append(simpleChain_PreAuth,
 			CreateMiddleware(&OrganizationMonitor{BaseMiddleware: baseMid}),
-			CreateMiddleware(&VersionCheck{BaseMiddleware: baseMid})}
+			CreateMiddleware(&VersionCheck{BaseMiddleware: baseMid}))
 
 		simpleChain_PostAuth := []alice.Constructor{
 			CreateMiddleware(&KeyExpired{baseMid}),
@@ -533,6 +556,20 @@ func processSpec(spec *APISpec,
 	}).Debug("Setting Listen Path: ", spec.Proxy.ListenPath)
 	//subrouter.Handle(spec.Proxy.ListenPath+"{rest:.*}", chain)
 
+	if globalConf.Prometheus.Enabled {
+		chain = PrometheusMiddleware(spec, chain)
+	}
+	if globalConf.Tracing.Enabled {
+		chain = TracingMiddleware(spec, chain)
+	}
+	if len(spec.TrustedProxies) > 0 || spec.TrustedProxyHops > 0 {
+		tp := newTrustedProxies(spec.TrustedProxies, spec.TrustedProxyHops)
+		chain = TrustedProxiesMiddleware(tp, chain)
+		if chainDef.RateLimitChain != nil {
+			chainDef.RateLimitChain = TrustedProxiesMiddleware(tp, chainDef.RateLimitChain)
+		}
+	}
+
 	chainDef.ThisHandler = chain
 	chainDef.ListenOn = spec.Proxy.ListenPath + "{rest:.*}"
 
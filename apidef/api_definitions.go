@@ -20,6 +20,8 @@ type MiddlewareDriver string
 type IdExtractorSource string
 type IdExtractorType string
 type AuthTypeEnum string
+type LoadBalancingStrategy string
+type LoadBalancingHashSource string
 
 const (
 	NoAction EndpointMethodAction = "no_action"
@@ -46,13 +48,23 @@ const (
 	RegexExtractor IdExtractorType = "regex"
 
 	// For multi-type auth
-	AuthToken     AuthTypeEnum = "auth_token"
-	HMACKey       AuthTypeEnum = "hmac_key"
-	BasicAuthUser AuthTypeEnum = "basic_auth_user"
-	JWTClaim      AuthTypeEnum = "jwt_claim"
-	OIDCUser      AuthTypeEnum = "oidc_user"
-	OAuthKey      AuthTypeEnum = "oauth_key"
-	UnsetAuth     AuthTypeEnum = ""
+	AuthToken         AuthTypeEnum = "auth_token"
+	HMACKey           AuthTypeEnum = "hmac_key"
+	BasicAuthUser     AuthTypeEnum = "basic_auth_user"
+	JWTClaim          AuthTypeEnum = "jwt_claim"
+	OIDCUser          AuthTypeEnum = "oidc_user"
+	OAuthKey          AuthTypeEnum = "oauth_key"
+	IntrospectedToken AuthTypeEnum = "introspected_token"
+	UnsetAuth         AuthTypeEnum = ""
+
+	// Load balancing strategies for Proxy.Targets
+	RoundRobinStrategy         LoadBalancingStrategy = "round_robin"
+	WeightedRoundRobinStrategy LoadBalancingStrategy = "weighted_round_robin"
+	LeastConnectionsStrategy   LoadBalancingStrategy = "least_connections"
+	ConsistentHashStrategy     LoadBalancingStrategy = "consistent_hash"
+
+	HashOnKey    LoadBalancingHashSource = "key"
+	HashOnHeader LoadBalancingHashSource = "header"
 )
 
 type EndpointMethodMeta struct {
@@ -135,11 +147,69 @@ type MethodTransformMeta struct {
 	ToMethod string `bson:"to_method" json:"to_method"`
 }
 
+// RetryPolicy controls retries of failed upstream requests. MaxAttempts
+// includes the first attempt, so anything below 2 disables retries.
+type RetryPolicy struct {
+	MaxAttempts             int   `bson:"max_attempts" json:"max_attempts"`
+	RetryOnStatusCodes      []int `bson:"retry_on_status_codes" json:"retry_on_status_codes"`
+	RetryOnConnectionErrors bool  `bson:"retry_on_connection_errors" json:"retry_on_connection_errors"`
+	RetryOnTimeouts         bool  `bson:"retry_on_timeouts" json:"retry_on_timeouts"`
+	RetryNonIdempotent      bool  `bson:"retry_non_idempotent" json:"retry_non_idempotent"`
+}
+
+// RateLimitMeta limits requests to a path to Rate every Per seconds. On
+// keyed APIs each key gets its own limit, on keyless ones it's shared.
+type RateLimitMeta struct {
+	Path   string  `bson:"path" json:"path"`
+	Method string  `bson:"method" json:"method"`
+	Rate   float64 `bson:"rate" json:"rate"`
+	Per    float64 `bson:"per" json:"per"`
+}
+
+// GlobalRateLimit limits requests to a whole API to Rate every Per
+// seconds, whoever makes them. A zero Rate disables it.
+type GlobalRateLimit struct {
+	Rate float64 `bson:"rate" json:"rate"`
+	Per  float64 `bson:"per" json:"per"`
+}
+
+// ConcurrencyLimit limits how many requests to an API may be in flight at
+// once. Requests over the limit wait up to WaitTimeout milliseconds for
+// one to finish. Distributed limits are counted across gateways in Redis.
+type ConcurrencyLimit struct {
+	MaxConcurrent int64 `bson:"max_concurrent" json:"max_concurrent"`
+	WaitTimeout   int64 `bson:"wait_timeout" json:"wait_timeout"`
+	Distributed   bool  `bson:"distributed" json:"distributed"`
+}
+
+type RetryMeta struct {
+	Path        string `bson:"path" json:"path"`
+	Method      string `bson:"method" json:"method"`
+	RetryPolicy `bson:",inline"`
+}
+
+// CacheMeta caches a path, keying the cached response on the listed
+// request headers as well as the method and URL. Query parameters listed
+// in IgnoreQueryParams are left out of the key.
+//
+// POST and PUT requests are only cached if CacheRequestBody is set, the
+// normalised body is then part of the key. BodyKeyPaths limits that to
+// the values at the given JSON paths, e.g. "$.query.term".
+type CacheMeta struct {
+	Path              string   `bson:"path" json:"path"`
+	Method            string   `bson:"method" json:"method"`
+	CacheKeyHeaders   []string `bson:"cache_key_headers" json:"cache_key_headers"`
+	IgnoreQueryParams []string `bson:"ignore_query_params" json:"ignore_query_params"`
+	CacheRequestBody  bool     `bson:"cache_request_body" json:"cache_request_body"`
+	BodyKeyPaths      []string `bson:"body_key_paths" json:"body_key_paths"`
+}
+
 type ExtendedPathsSet struct {
 	Ignored                 []EndPointMeta        `bson:"ignored" json:"ignored,omitempty"`
 	WhiteList               []EndPointMeta        `bson:"white_list" json:"white_list,omitempty"`
 	BlackList               []EndPointMeta        `bson:"black_list" json:"black_list,omitempty"`
 	Cached                  []string              `bson:"cache" json:"cache,omitempty"`
+	CacheConfig             []CacheMeta           `bson:"cache_config" json:"cache_config,omitempty"`
 	Transform               []TemplateMeta        `bson:"transform" json:"transform,omitempty"`
 	TransformResponse       []TemplateMeta        `bson:"transform_response" json:"transform_response,omitempty"`
 	TransformHeader         []HeaderInjectionMeta `bson:"transform_headers" json:"transform_headers,omitempty"`
@@ -152,6 +222,26 @@ type ExtendedPathsSet struct {
 	MethodTransforms        []MethodTransformMeta `bson:"method_transforms" json:"method_transforms,omitempty"`
 	TrackEndpoints          []TrackEndpointMeta   `bson:"track_endpoints" json:"track_endpoints,omitempty"`
 	DoNotTrackEndpoints     []TrackEndpointMeta   `bson:"do_not_track_endpoints" json:"do_not_track_endpoints,omitempty"`
+	Retries                 []RetryMeta           `bson:"retries" json:"retries,omitempty"`
+	RateLimit               []RateLimitMeta       `bson:"rate_limit" json:"rate_limit,omitempty"`
+}
+
+// GeoAccessRules allow or deny requests by the ISO code of the country
+// the client IP is located in. Once AllowedCountries is set, requests
+// from anywhere else, including unknown locations, are denied.
+type GeoAccessRules struct {
+	AllowedCountries []string `bson:"allowed_countries" json:"allowed_countries"`
+	DeniedCountries  []string `bson:"denied_countries" json:"denied_countries"`
+}
+
+// JWTClaimMatcher checks the value of a JWT claim. Match is "exact" or
+// "regex" against Value, "one_of" against Values, or "contains" for a
+// claim holding an array that must include Value.
+type JWTClaimMatcher struct {
+	Claim  string   `bson:"claim" json:"claim"`
+	Match  string   `bson:"match" json:"match"`
+	Value  string   `bson:"value" json:"value"`
+	Values []string `bson:"values" json:"values"`
 }
 
 type VersionInfo struct {
@@ -168,6 +258,8 @@ type VersionInfo struct {
 	GlobalHeadersRemove []string          `bson:"global_headers_remove" json:"global_headers_remove"`
 	GlobalSizeLimit     int64             `bson:"global_size_limit" json:"global_size_limit"`
 	OverrideTarget      string            `bson:"override_target" json:"override_target"`
+	BlacklistedIPs      []string          `bson:"blacklisted_ips" json:"blacklisted_ips"`
+	GeoAccessRules      GeoAccessRules    `bson:"geo_access_rules" json:"geo_access_rules"`
 }
 
 type AuthProviderMeta struct {
@@ -214,12 +306,18 @@ type MiddlewareSection struct {
 	IdExtractor MiddlewareIdExtractor  `bson:"id_extractor" json:"id_extractor"`
 }
 
+// CacheOptions configures the response cache. Once an entry expires it
+// is served for another StaleWhileRevalidate seconds while it is
+// refreshed in the background, and for StaleIfError seconds if the
+// upstream fails.
 type CacheOptions struct {
 	CacheTimeout               int64 `bson:"cache_timeout" json:"cache_timeout"`
 	EnableCache                bool  `bson:"enable_cache" json:"enable_cache"`
 	CacheAllSafeRequests       bool  `bson:"cache_all_safe_requests" json:"cache_all_safe_requests"`
 	CacheOnlyResponseCodes     []int `bson:"cache_response_codes" json:"cache_response_codes"`
 	EnableUpstreamCacheControl bool  `bson:"enable_upstream_cache_control" json:"enable_upstream_cache_control"`
+	StaleWhileRevalidate       int64 `bson:"stale_while_revalidate" json:"stale_while_revalidate"`
+	StaleIfError               int64 `bson:"stale_if_error" json:"stale_if_error"`
 }
 
 type ResponseProcessor struct {
@@ -247,6 +345,27 @@ type ServiceDiscoveryConfiguration struct {
 	EndpointReturnsList bool   `bson:"endpoint_returns_list" json:"endpoint_returns_list"`
 }
 
+// LoadBalancingOptions selects how a request is spread over
+// Proxy.Targets. Weights are matched to targets by index, any target
+// without a weight (or with a weight below 1) gets a weight of 1.
+type LoadBalancingOptions struct {
+	Strategy       LoadBalancingStrategy   `bson:"strategy" json:"strategy"`
+	Weights        []int                   `bson:"weights" json:"weights"`
+	HashOn         LoadBalancingHashSource `bson:"hash_on" json:"hash_on"`
+	HashHeaderName string                  `bson:"hash_header_name" json:"hash_header_name"`
+}
+
+// PassiveHealthCheckOptions configures ejection of load balanced
+// targets that keep failing live traffic. Times are in seconds, the
+// ejection time doubles every time a host is ejected again without a
+// successful request in between, up to MaxEjectionTime.
+type PassiveHealthCheckOptions struct {
+	Enabled             bool `bson:"enabled" json:"enabled"`
+	ConsecutiveFailures int  `bson:"consecutive_failures" json:"consecutive_failures"`
+	EjectionTime        int  `bson:"ejection_time" json:"ejection_time"`
+	MaxEjectionTime     int  `bson:"max_ejection_time" json:"max_ejection_time"`
+}
+
 type OIDProviderConfig struct {
 	Issuer    string            `bson:"issuer" json:"issuer"`
 	ClientIDs map[string]string `bson:"client_ids" json:"client_ids"`
@@ -257,6 +376,18 @@ type OpenIDOptions struct {
 	SegregateByClient bool                `bson:"segregate_by_client" json:"segregate_by_client"`
 }
 
+// IntrospectionOptions configures validating tokens against an OAuth2
+// token introspection endpoint (RFC 7662).
+type IntrospectionOptions struct {
+	URL                  string            `bson:"url" json:"url"`
+	ClientID             string            `bson:"client_id" json:"client_id"`
+	ClientSecret         string            `bson:"client_secret" json:"client_secret"`
+	PolicyID             string            `bson:"policy_id" json:"policy_id"`
+	ScopeToPolicyMapping map[string]string `bson:"scope_to_policy_mapping" json:"scope_to_policy_mapping"`
+	CacheTTL             int64             `bson:"cache_ttl" json:"cache_ttl"`
+	NegativeCacheTTL     int64             `bson:"negative_cache_ttl" json:"negative_cache_ttl"`
+}
+
 // APIDefinition represents the configuration for a single proxied API and it's versions.
 type APIDefinition struct {
 	Id               bson.ObjectId `bson:"_id,omitempty" json:"id,omitempty"`
@@ -269,9 +400,11 @@ type APIDefinition struct {
 	UseOpenID        bool          `bson:"use_openid" json:"use_openid"`
 	OpenIDOptions    OpenIDOptions `bson:"openid_options" json:"openid_options"`
 	Oauth2Meta       struct {
-		AllowedAccessTypes     []osin.AccessRequestType    `bson:"allowed_access_types" json:"allowed_access_types"`
-		AllowedAuthorizeTypes  []osin.AuthorizeRequestType `bson:"allowed_authorize_types" json:"allowed_authorize_types"`
-		AuthorizeLoginRedirect string                      `bson:"auth_login_redirect" json:"auth_login_redirect"`
+		AllowedAccessTypes          []osin.AccessRequestType    `bson:"allowed_access_types" json:"allowed_access_types"`
+		AllowedAuthorizeTypes       []osin.AuthorizeRequestType `bson:"allowed_authorize_types" json:"allowed_authorize_types"`
+		AuthorizeLoginRedirect      string                      `bson:"auth_login_redirect" json:"auth_login_redirect"`
+		RefreshTokenReuseDetection  bool                        `bson:"refresh_token_reuse_detection" json:"refresh_token_reuse_detection"`
+		RequirePKCEForPublicClients bool                        `bson:"require_pkce_for_public_clients" json:"require_pkce_for_public_clients"`
 	} `bson:"oauth_meta" json:"oauth_meta"`
 	Auth struct {
 		UseParam       bool   `mapstructure:"use_param" bson:"use_param" json:"use_param"`
@@ -289,9 +422,20 @@ type APIDefinition struct {
 	JWTIdentityBaseField    string               `bson:"jwt_identit_base_field" json:"jwt_identity_base_field"`
 	JWTClientIDBaseField    string               `bson:"jwt_client_base_field" json:"jwt_client_base_field"`
 	JWTPolicyFieldName      string               `bson:"jwt_policy_field_name" json:"jwt_policy_field_name"`
+	JWTAllowedIssuers       []string             `bson:"jwt_allowed_issuers" json:"jwt_allowed_issuers"`
+	JWTAllowedAudiences     []string             `bson:"jwt_allowed_audiences" json:"jwt_allowed_audiences"`
+	JWTLeeway               int64                `bson:"jwt_leeway" json:"jwt_leeway"`
+	JWTRequiredClaims       []string             `bson:"jwt_required_claims" json:"jwt_required_claims"`
+	JWTClaimMatchers        []JWTClaimMatcher    `bson:"jwt_claim_matchers" json:"jwt_claim_matchers"`
+	JWTScopeClaimName       string               `bson:"jwt_scope_claim_name" json:"jwt_scope_claim_name"`
+	JWTScopeToPolicyMapping map[string]string    `bson:"jwt_scope_to_policy_mapping" json:"jwt_scope_to_policy_mapping"`
+	UseIntrospection        bool                 `bson:"use_introspection" json:"use_introspection"`
+	IntrospectionOptions    IntrospectionOptions `bson:"introspection_options" json:"introspection_options"`
 	NotificationsDetails    NotificationsManager `bson:"notifications" json:"notifications"`
 	EnableSignatureChecking bool                 `bson:"enable_signature_checking" json:"enable_signature_checking"`
 	HmacAllowedClockSkew    float64              `bson:"hmac_allowed_clock_skew" json:"hmac_allowed_clock_skew"`
+	HmacAllowedAlgorithms   []string             `bson:"hmac_allowed_algorithms" json:"hmac_allowed_algorithms"`
+	HmacValidateDigest      bool                 `bson:"hmac_validate_digest" json:"hmac_validate_digest"`
 	BaseIdentityProvidedBy  AuthTypeEnum         `bson:"base_identity_provided_by" json:"base_identity_provided_by"`
 	VersionDefinition       struct {
 		Location string `bson:"location" json:"location"`
@@ -316,12 +460,17 @@ type APIDefinition struct {
 		StripListenPath             bool                          `bson:"strip_listen_path" json:"strip_listen_path"`
 		EnableLoadBalancing         bool                          `bson:"enable_load_balancing" json:"enable_load_balancing"`
 		Targets                     []string                      `bson:"target_list" json:"target_list"`
+		LoadBalancing               LoadBalancingOptions          `bson:"load_balancing" json:"load_balancing"`
+		PassiveHealthCheck          PassiveHealthCheckOptions     `bson:"passive_health_check" json:"passive_health_check"`
+		RetryPolicy                 RetryPolicy                   `bson:"retry_policy" json:"retry_policy"`
 		StructuredTargetList        *HostList                     `bson:"-" json:"-"`
 		CheckHostAgainstUptimeTests bool                          `bson:"check_host_against_uptime_tests" json:"check_host_against_uptime_tests"`
 		ServiceDiscovery            ServiceDiscoveryConfiguration `bson:"service_discovery" json:"service_discovery"`
 	} `bson:"proxy" json:"proxy"`
 	DisableRateLimit          bool                   `bson:"disable_rate_limit" json:"disable_rate_limit"`
 	DisableQuota              bool                   `bson:"disable_quota" json:"disable_quota"`
+	GlobalRateLimit           GlobalRateLimit        `bson:"global_rate_limit" json:"global_rate_limit"`
+	ConcurrencyLimit          ConcurrencyLimit       `bson:"concurrency_limit" json:"concurrency_limit"`
 	CustomMiddleware          MiddlewareSection      `bson:"custom_middleware" json:"custom_middleware"`
 	CustomMiddlewareBundle    string                 `bson:"custom_middleware_bundle" json:"custom_middleware_bundle"`
 	CacheOptions              CacheOptions           `bson:"cache_options" json:"cache_options"`
@@ -333,6 +482,11 @@ type APIDefinition struct {
 	EnableBatchRequestSupport bool                   `bson:"enable_batch_request_support" json:"enable_batch_request_support"`
 	EnableIpWhiteListing      bool                   `mapstructure:"enable_ip_whitelisting" bson:"enable_ip_whitelisting" json:"enable_ip_whitelisting"`
 	AllowedIPs                []string               `mapstructure:"allowed_ips" bson:"allowed_ips" json:"allowed_ips"`
+	EnableIpBlacklisting      bool                   `mapstructure:"enable_ip_blacklisting" bson:"enable_ip_blacklisting" json:"enable_ip_blacklisting"`
+	BlacklistedIPs            []string               `mapstructure:"blacklisted_ips" bson:"blacklisted_ips" json:"blacklisted_ips"`
+	GeoAccessRules            GeoAccessRules         `mapstructure:"geo_access_rules" bson:"geo_access_rules" json:"geo_access_rules"`
+	TrustedProxies            []string               `mapstructure:"trusted_proxies" bson:"trusted_proxies" json:"trusted_proxies"`
+	TrustedProxyHops          int                    `mapstructure:"trusted_proxy_hops" bson:"trusted_proxy_hops" json:"trusted_proxy_hops"`
 	DontSetQuotasOnCreate     bool                   `mapstructure:"dont_set_quota_on_create" bson:"dont_set_quota_on_create" json:"dont_set_quota_on_create"`
 	ExpireAnalyticsAfter      int64                  `mapstructure:"expire_analytics_after" bson:"expire_analytics_after" json:"expire_analytics_after"` // must have an expireAt TTL index set (http://docs.mongodb.org/manual/tutorial/expire-data/)
 	ResponseProcessors        []ResponseProcessor    `bson:"response_processors" json:"response_processors"`
@@ -101,6 +101,9 @@ func (b *DefaultSessionManager) ResetQuota(keyName string, session *SessionState
 	go b.Store.DeleteRawKey(rateLimiterSentinelKey)
 	// Fix the raw key
 	go b.Store.DeleteRawKey(rawKey)
+	for i, window := range session.QuotaWindows {
+		go b.Store.DeleteRawKey(quotaWindowKey(keyName, quotaWindowName(window, i)))
+	}
 	//go b.Store.SetKey(rawKey, "0", session.QuotaRenewalRate)
 }
 
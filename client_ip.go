@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// globalTrustedProxies is used for APIs without trusted proxies of their
+// own, it is set up with the config.
+var globalTrustedProxies *trustedProxies
+
+// trustedProxies decides which forwarding headers to believe when
+// resolving the client address of a request. With hops set, at most
+// that many proxies are skipped; with no networks set, any peer is
+// trusted for that many hops.
+type trustedProxies struct {
+	nets []*net.IPNet
+	hops int
+}
+
+func newTrustedProxies(cidrs []string, hops int) *trustedProxies {
+	tp := &trustedProxies{hops: hops}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			// a single address
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": "main",
+			}).Error("Ignoring invalid trusted proxy ", cidr, ": ", err)
+			continue
+		}
+		tp.nets = append(tp.nets, ipNet)
+	}
+	return tp
+}
+
+func (tp *trustedProxies) enabled() bool {
+	return tp != nil && (len(tp.nets) > 0 || tp.hops > 0)
+}
+
+func (tp *trustedProxies) trusts(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	if len(tp.nets) == 0 {
+		return true
+	}
+	for _, ipNet := range tp.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP walks the forwarding chain back from the immediate peer and
+// returns the first address that isn't a trusted proxy. If an address in
+// the chain is unusable, the last proxy that reported it is returned.
+func (tp *trustedProxies) clientIP(peer string, chain []string) string {
+	addr := peer
+	for skipped, i := 0, len(chain); i > 0; skipped, i = skipped+1, i-1 {
+		if !tp.trusts(addr) || (tp.hops > 0 && skipped >= tp.hops) {
+			break
+		}
+		if net.ParseIP(chain[i-1]) == nil {
+			break
+		}
+		addr = chain[i-1]
+	}
+	return addr
+}
+
+// forwardedChain returns the addresses a request was forwarded for,
+// client first. The RFC 7239 Forwarded header takes precedence over
+// X-Forwarded-For, which takes precedence over X-Real-IP.
+func forwardedChain(r *http.Request) []string {
+	if fwd := r.Header["Forwarded"]; len(fwd) > 0 {
+		return parseForwardedFor(fwd)
+	}
+	if xff := r.Header["X-Forwarded-For"]; len(xff) > 0 {
+		var chain []string
+		for _, v := range xff {
+			for _, addr := range strings.Split(v, ",") {
+				chain = append(chain, strings.TrimSpace(addr))
+			}
+		}
+		return chain
+	}
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		return []string{strings.TrimSpace(realIP)}
+	}
+	return nil
+}
+
+// parseForwardedFor extracts the "for" parameters of RFC 7239 Forwarded
+// headers, without ports. Obfuscated and unknown identifiers are kept
+// as they are.
+func parseForwardedFor(values []string) []string {
+	var chain []string
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				i := strings.IndexByte(pair, '=')
+				if i < 0 || !strings.EqualFold(strings.TrimSpace(pair[:i]), "for") {
+					continue
+				}
+				chain = append(chain, forwardedNode(strings.Trim(strings.TrimSpace(pair[i+1:]), `"`)))
+			}
+		}
+	}
+	return chain
+}
+
+// forwardedNode strips the port from a Forwarded node, e.g.
+// "[2001:db8::1]:4711" or "192.0.2.43:80".
+func forwardedNode(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if i := strings.IndexByte(node, ']'); i > 0 {
+			return node[1:i]
+		}
+		return node
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+// TrustedProxiesMiddleware makes requestIP use an API's own trusted
+// proxies instead of the global ones.
+func TrustedProxiesMiddleware(tp *trustedProxies, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctxSetTrustedProxies(r, tp)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -55,14 +55,41 @@ type NormaliseURLPatterns struct {
 	Custom []*regexp.Regexp
 }
 
+type AnalyticsFileSinkConfig struct {
+	Path       string `json:"path"`
+	MaxSizeMB  int    `json:"max_size_mb"`
+	MaxBackups int    `json:"max_backups"`
+}
+
+type AnalyticsHTTPSinkConfig struct {
+	URL           string            `json:"url"`
+	Headers       map[string]string `json:"headers"`
+	BatchSize     int               `json:"batch_size"`
+	FlushInterval int               `json:"flush_interval"`
+	Timeout       int               `json:"timeout"`
+}
+
+type AnalyticsSyslogSinkConfig struct {
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+	Tag     string `json:"tag"`
+}
+
 type AnalyticsConfigConfig struct {
-	Type                    string              `json:"type"`
-	IgnoredIPs              []string            `json:"ignored_ips"`
-	EnableDetailedRecording bool                `json:"enable_detailed_recording"`
-	EnableGeoIP             bool                `json:"enable_geo_ip"`
-	GeoIPDBLocation         string              `json:"geo_ip_db_path"`
-	NormaliseUrls           NormalisedURLConfig `json:"normalise_urls"`
-	PoolSize                int                 `json:"pool_size"`
+	Type                    string                    `json:"type"`
+	IgnoredIPs              []string                  `json:"ignored_ips"`
+	EnableDetailedRecording bool                      `json:"enable_detailed_recording"`
+	EnableGeoIP             bool                      `json:"enable_geo_ip"`
+	GeoIPDBLocation         string                    `json:"geo_ip_db_path"`
+	NormaliseUrls           NormalisedURLConfig       `json:"normalise_urls"`
+	PoolSize                int                       `json:"pool_size"`
+	BufferSize              int                       `json:"records_buffer_size"`
+	BatchSize               int                       `json:"batch_size"`
+	FlushInterval           int                       `json:"flush_interval"`
+	DropPolicy              string                    `json:"drop_policy"`
+	File                    AnalyticsFileSinkConfig   `json:"file"`
+	HTTP                    AnalyticsHTTPSinkConfig   `json:"http"`
+	Syslog                  AnalyticsSyslogSinkConfig `json:"syslog"`
 	ignoredIPsCompiled      map[string]bool
 }
 
@@ -130,6 +157,27 @@ type AuthOverrideConf struct {
 	SessionProvider      apidef.SessionProviderMeta `json:"session_provider"`
 }
 
+type PrometheusConfig struct {
+	Enabled bool `json:"enabled"`
+	// MetricsPath is served by the control API, under /tyk
+	MetricsPath string `json:"metrics_path"`
+}
+
+type TracingConfig struct {
+	Enabled       bool              `json:"enabled"`
+	ServiceName   string            `json:"service_name"`
+	Exporter      string            `json:"exporter"`
+	OTLPEndpoint  string            `json:"otlp_endpoint"`
+	OTLPHeaders   map[string]string `json:"otlp_headers"`
+	BatchSize     int               `json:"batch_size"`
+	FlushInterval int               `json:"flush_interval"`
+}
+
+type JWKSCacheConfig struct {
+	TTL                int `json:"ttl"`
+	MinRefetchInterval int `json:"min_refetch_interval"`
+}
+
 type UptimeTestsConfigDetail struct {
 	FailureTriggerSampleSize int  `json:"failure_trigger_sample_size"`
 	TimeWait                 int  `json:"time_wait"`
@@ -194,6 +242,8 @@ type Config struct {
 	SyslogNetworkAddr                 string                 `json:"syslog_network_addr"`
 	StatsdConnectionString            string                 `json:"statsd_connection_string"`
 	StatsdPrefix                      string                 `json:"statsd_prefix"`
+	Prometheus                        PrometheusConfig       `json:"prometheus"`
+	Tracing                           TracingConfig          `json:"tracing"`
 	EnforceOrgDataAge                 bool                   `json:"enforce_org_data_age"`
 	EnforceOrgDataDeailLogging        bool                   `json:"enforce_org_data_detail_logging"`
 	EnforceOrgQuotas                  bool                   `json:"enforce_org_quotas"`
@@ -201,6 +251,7 @@ type Config struct {
 	EnableNonTransactionalRateLimiter bool                   `json:"enable_non_transactional_rate_limiter"`
 	EnableSentinelRateLImiter         bool                   `json:"enable_sentinel_rate_limiter"`
 	EnableRedisRollingLimiter         bool                   `json:"enable_redis_rolling_limiter"`
+	EnableIETFRateLimitHeaders        bool                   `json:"enable_ietf_rate_limit_headers"`
 	ManagementNode                    bool                   `json:"management_node"`
 	Monitor                           MonitorConfig
 	OauthRefreshExpire                int64                                 `json:"oauth_refresh_token_expire"`
@@ -239,6 +290,9 @@ type Config struct {
 	ReloadWaitTime                    int                                   `bson:"reload_wait_time" json:"reload_wait_time"`
 	ProxySSLInsecureSkipVerify        bool                                  `json:"proxy_ssl_insecure_skip_verify"`
 	ProxyDefaultTimeout               int                                   `json:"proxy_default_timeout"`
+	TrustedProxies                    []string                              `json:"trusted_proxies"`
+	TrustedProxyHops                  int                                   `json:"trusted_proxy_hops"`
+	JWKSCache                         JWKSCacheConfig                       `json:"jwks_cache"`
 }
 
 type CertData struct {
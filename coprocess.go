@@ -235,7 +235,14 @@ func (m *CoProcessMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Requ
 
 	object := coProcessor.ObjectFromRequest(r)
 
+	span := StartSpan(r, "coprocess "+m.HookName, spanKindInternal)
+	span.SetAttribute("tyk.coprocess.hook_type", m.HookType.String())
+	span.SetAttribute("tyk.coprocess.driver", string(m.MiddlewareDriver))
 	returnObject, err := coProcessor.Dispatch(object)
+	if err != nil {
+		span.SetError(err.Error())
+	}
+	span.Finish()
 	if err != nil {
 		if m.HookType == coprocess.HookType_CustomKeyCheck {
 			return errors.New("Key not authorised"), 403
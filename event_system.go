@@ -52,6 +52,7 @@ type EventQuotaExceededMeta struct {
 	Path   string
 	Origin string
 	Key    string
+	Window string
 }
 
 // EventRateLimitExceededMeta is the metadata structure for a rate limit exceeded event (EventRateLimitExceeded)
@@ -68,6 +69,8 @@ type EventAuthFailureMeta struct {
 	Path   string
 	Origin string
 	Key    string
+	// Rule is the access rule that rejected the request, if any
+	Rule string
 }
 
 // EventCurcuitBreakerMeta is the event status for a circuit breaker tripping
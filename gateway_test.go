@@ -743,6 +743,7 @@ func TestWithAnalytics(t *testing.T) {
 		t.Error("Initial request failed with non-200 code: \n", recorder.Code)
 	}
 
+	analytics.Flush()
 	results := analytics.Store.GetKeysAndValues()
 
 	if len(results) < 1 {
@@ -770,6 +771,7 @@ func TestWithAnalyticsErrorResponse(t *testing.T) {
 		t.Error("Request failed with 200 code: \n", recorder.Code)
 	}
 
+	analytics.Flush()
 	results := analytics.Store.GetKeysAndValues()
 	if len(results) < 1 {
 		t.Error("Not enough results! Should be 1, is: ", len(results))
@@ -62,6 +62,8 @@ func (e *ErrorHandler) HandleError(w http.ResponseWriter, r *http.Request, errMs
 		w.Header().Set("Content-Type", defaultContentType)
 	}
 
+	setRateLimitHeaders(w.Header(), r)
+
 	// Need to return the correct error code!
 	w.WriteHeader(errCode)
 
@@ -153,6 +155,7 @@ func (e *ErrorHandler) HandleError(w http.ResponseWriter, r *http.Request, errMs
 			tags,
 			alias,
 			trackEP,
+			ctxGetRetries(r),
 			time.Now(),
 		}
 
@@ -173,7 +176,7 @@ func (e *ErrorHandler) HandleError(w http.ResponseWriter, r *http.Request, errMs
 			record.NormalisePath()
 		}
 
-		go analytics.RecordHit(record)
+		analytics.RecordHit(record)
 	}
 
 	// Report in health check
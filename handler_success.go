@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"io"
 	"net/http"
 	"runtime/pprof"
@@ -25,11 +27,26 @@ const (
 	RetainHost
 	TrackThisEndpoint
 	DoNotTrackThisEndpoint
+	InFlightHost
+	UpstreamTarget
+	TriedTargets
+	RetryAttempts
+	TraceSpan
+	TrustedProxyConfig
+	RateLimitData
+	ConcurrencySlots
 )
 
 var SessionCache = cache.New(10*time.Second, 5*time.Second)
 var ExpiryCache = cache.New(600*time.Second, 10*time.Minute)
 
+// sessionCacheKey is what a key's session is cached under in SessionCache,
+// so that the cache can be cleared without knowing the key itself.
+func sessionCacheKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
 type ReturningHttpHandler interface {
 	Init(*APISpec) error
 	ServeHTTP(http.ResponseWriter, *http.Request) *http.Response
@@ -84,6 +101,10 @@ func (t *BaseMiddleware) OrgSessionExpiry(orgid string) int64 {
 
 // ApplyPolicyIfExists will check if a policy is loaded, if it is, it will overwrite the session state to use the policy values
 func (t *BaseMiddleware) ApplyPolicyIfExists(key string, session *SessionState) {
+	if len(session.ApplyPolicies) > 0 {
+		t.applyPolicies(key, session)
+		return
+	}
 	if session.ApplyPolicyID == "" {
 		return
 	}
@@ -106,6 +127,8 @@ func (t *BaseMiddleware) ApplyPolicyIfExists(key string, session *SessionState)
 			// Quotas
 			session.QuotaMax = policy.QuotaMax
 			session.QuotaRenewalRate = policy.QuotaRenewalRate
+			session.QuotaSchedule = policy.QuotaSchedule
+			setQuotaWindows(session, policy.QuotaWindows)
 		}
 
 		if policy.Partitions.RateLimit {
@@ -113,6 +136,7 @@ func (t *BaseMiddleware) ApplyPolicyIfExists(key string, session *SessionState)
 			session.Allowance = policy.Rate // This is a legacy thing, merely to make sure output is consistent. Needs to be purged
 			session.Rate = policy.Rate
 			session.Per = policy.Per
+			session.MaxConcurrent = policy.MaxConcurrent
 			if policy.LastUpdated != "" {
 				session.LastUpdated = policy.LastUpdated
 			}
@@ -129,11 +153,14 @@ func (t *BaseMiddleware) ApplyPolicyIfExists(key string, session *SessionState)
 		// Quotas
 		session.QuotaMax = policy.QuotaMax
 		session.QuotaRenewalRate = policy.QuotaRenewalRate
+		session.QuotaSchedule = policy.QuotaSchedule
+		setQuotaWindows(session, policy.QuotaWindows)
 
 		// Rate limting
 		session.Allowance = policy.Rate // This is a legacy thing, merely to make sure output is consistent. Needs to be purged
 		session.Rate = policy.Rate
 		session.Per = policy.Per
+		session.MaxConcurrent = policy.MaxConcurrent
 		if policy.LastUpdated != "" {
 			session.LastUpdated = policy.LastUpdated
 		}
@@ -158,7 +185,7 @@ func (t *BaseMiddleware) CheckSessionAndIdentityForValidKey(key string) (Session
 	log.Debug("Querying local cache")
 	// Check in-memory cache
 	if !globalConf.LocalSessionCache.DisableCacheSessionState {
-		cachedVal, found := SessionCache.Get(key)
+		cachedVal, found := SessionCache.Get(sessionCacheKey(key))
 		if found {
 			log.Debug("--> Key found in local cache")
 			session := cachedVal.(SessionState)
@@ -173,7 +200,7 @@ func (t *BaseMiddleware) CheckSessionAndIdentityForValidKey(key string) (Session
 	if found {
 		// If exists, assume it has been authorized and pass on
 		// cache it
-		go SessionCache.Set(key, session, cache.DefaultExpiration)
+		go SessionCache.Set(sessionCacheKey(key), session, cache.DefaultExpiration)
 
 		// Check for a policy, if there is a policy, pull it and overwrite the session values
 		t.ApplyPolicyIfExists(key, &session)
@@ -189,7 +216,7 @@ func (t *BaseMiddleware) CheckSessionAndIdentityForValidKey(key string) (Session
 		log.Info("Recreating session for key: ", key)
 
 		// cache it
-		go SessionCache.Set(key, session, cache.DefaultExpiration)
+		go SessionCache.Set(sessionCacheKey(key), session, cache.DefaultExpiration)
 
 		// Check for a policy, if there is a policy, pull it and overwrite the session values
 		t.ApplyPolicyIfExists(key, &session)
@@ -286,6 +313,7 @@ func (s *SuccessHandler) RecordHit(r *http.Request, timing int64, code int, requ
 			tags,
 			alias,
 			trackEP,
+			ctxGetRetries(r),
 			time.Now(),
 		}
 
@@ -306,7 +334,7 @@ func (s *SuccessHandler) RecordHit(r *http.Request, timing int64, code int, requ
 			record.NormalisePath()
 		}
 
-		go analytics.RecordHit(record)
+		analytics.RecordHit(record)
 	}
 
 	// Report in health check
@@ -199,6 +199,9 @@ func (hc *HostCheckerManager) getHostKey(report HostHealthReport) string {
 }
 
 func (hc *HostCheckerManager) OnHostReport(report HostHealthReport) {
+	if !report.IsTCPError && report.ResponseCode == 200 {
+		reportHostStatus(report, true)
+	}
 	if globalConf.UptimeTests.Config.EnableUptimeAnalytics {
 		go hc.RecordUptimeAnalytics(report)
 	}
@@ -209,6 +212,7 @@ func (hc *HostCheckerManager) OnHostDown(report HostHealthReport) {
 		"prefix": "host-check-mgr",
 	}).Debug("Update key: ", hc.getHostKey(report))
 	hc.store.SetKey(hc.getHostKey(report), "1", int64(hc.checker.checkTimeout+1))
+	reportHostStatus(report, false)
 
 	spec := getApiSpec(report.MetaData[UnHealthyHostMetaDataAPIKey])
 	if spec == nil {
@@ -252,6 +256,7 @@ func (hc *HostCheckerManager) OnHostBackUp(report HostHealthReport) {
 		"prefix": "host-check-mgr",
 	}).Debug("Delete key: ", hc.getHostKey(report))
 	hc.store.DeleteKey(hc.getHostKey(report))
+	reportHostStatus(report, true)
 
 	spec := getApiSpec(report.MetaData[UnHealthyHostMetaDataAPIKey])
 	if spec == nil {
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultOutlierConsecutiveFailures = 5
+	defaultOutlierEjectionTime        = 30
+	defaultOutlierMaxEjectionTime     = 300
+)
+
+type outlierHostState struct {
+	consecutiveFailures int
+	// ejections counts ejections since the last successful request,
+	// it drives the back-off of the ejection time
+	ejections int
+	ejected   bool
+}
+
+// OutlierDetector passively tracks the results of proxied requests per
+// load balanced target, and ejects targets from selection after too many
+// consecutive connection errors or 5xx responses.
+type OutlierDetector struct {
+	mu    sync.Mutex
+	hosts map[string]*outlierHostState
+}
+
+// IsEjected returns true if target is currently out of rotation.
+func (o *OutlierDetector) IsEjected(target string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	state, ok := o.hosts[target]
+	return ok && state.ejected
+}
+
+// RecordResult counts the outcome of a request sent to target, ejecting
+// it once the configured number of consecutive failures is reached.
+func (o *OutlierDetector) RecordResult(spec *APISpec, target string, res *http.Response, err error) {
+	failed := err != nil || (res != nil && res.StatusCode >= 500)
+
+	o.mu.Lock()
+	if o.hosts == nil {
+		o.hosts = make(map[string]*outlierHostState)
+	}
+	state, ok := o.hosts[target]
+	if !ok {
+		state = &outlierHostState{}
+		o.hosts[target] = state
+	}
+
+	if !failed {
+		state.consecutiveFailures = 0
+		state.ejections = 0
+		o.mu.Unlock()
+		return
+	}
+
+	state.consecutiveFailures++
+	if state.ejected || state.consecutiveFailures < outlierConsecutiveFailures(spec) {
+		o.mu.Unlock()
+		return
+	}
+
+	state.ejected = true
+	state.consecutiveFailures = 0
+	state.ejections++
+	ejectFor := outlierEjectionTime(spec, state.ejections)
+	o.mu.Unlock()
+
+	report := outlierHostReport(spec, target, res, err)
+	log.WithFields(logrus.Fields{
+		"prefix": "host-check-mgr",
+		"api_id": spec.APIID,
+	}).Warning("[PASSIVE HEALTH CHECK] Ejecting host for ", ejectFor, ": ", target)
+	spec.FireEvent(EventHOSTDOWN, EventHostStatusMeta{
+		EventMetaDefault: EventMetaDefault{Message: "Host ejected after consecutive failures"},
+		HostInfo:         report,
+	})
+
+	time.AfterFunc(ejectFor, func() {
+		o.readmit(spec, target, report)
+	})
+}
+
+func (o *OutlierDetector) readmit(spec *APISpec, target string, report HostHealthReport) {
+	o.mu.Lock()
+	state, ok := o.hosts[target]
+	if ok {
+		state.ejected = false
+	}
+	o.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"prefix": "host-check-mgr",
+		"api_id": spec.APIID,
+	}).Info("[PASSIVE HEALTH CHECK] Re-admitting host: ", target)
+	report.ResponseCode = 0
+	report.IsTCPError = false
+	spec.FireEvent(EventHOSTUP, EventHostStatusMeta{
+		EventMetaDefault: EventMetaDefault{Message: "Ejected host re-admitted"},
+		HostInfo:         report,
+	})
+}
+
+func outlierConsecutiveFailures(spec *APISpec) int {
+	if n := spec.Proxy.PassiveHealthCheck.ConsecutiveFailures; n > 0 {
+		return n
+	}
+	return defaultOutlierConsecutiveFailures
+}
+
+// outlierEjectionTime doubles the base ejection time for every repeated
+// ejection, capped at the maximum ejection time.
+func outlierEjectionTime(spec *APISpec, ejections int) time.Duration {
+	base := spec.Proxy.PassiveHealthCheck.EjectionTime
+	if base <= 0 {
+		base = defaultOutlierEjectionTime
+	}
+	max := spec.Proxy.PassiveHealthCheck.MaxEjectionTime
+	if max <= 0 {
+		max = defaultOutlierMaxEjectionTime
+	}
+	secs := base
+	for i := 1; i < ejections && secs < max; i++ {
+		secs *= 2
+	}
+	if secs > max {
+		secs = max
+	}
+	return time.Duration(secs) * time.Second
+}
+
+func outlierHostReport(spec *APISpec, target string, res *http.Response, err error) HostHealthReport {
+	var hostName string
+	if u, perr := url.Parse(target); perr == nil {
+		hostName = u.Host
+	}
+	report := HostHealthReport{
+		HostData: HostData{
+			CheckURL: target,
+			MetaData: map[string]string{
+				UnHealthyHostMetaDataTargetKey: target,
+				UnHealthyHostMetaDataAPIKey:    spec.APIID,
+				UnHealthyHostMetaDataHostKey:   hostName,
+			},
+		},
+		IsTCPError: err != nil,
+	}
+	if res != nil {
+		report.ResponseCode = res.StatusCode
+	}
+	return report
+}
+
+// targetIsDown returns true if a load balanced target should be skipped,
+// either because it fails its uptime tests or because it was ejected by
+// the passive health check.
+func targetIsDown(host string, spec *APISpec) bool {
+	if spec.Proxy.PassiveHealthCheck.Enabled && spec.Outliers.IsEjected(host) {
+		return true
+	}
+	return spec.Proxy.CheckHostAgainstUptimeTests && GlobalHostChecker.IsHostDown(host)
+}
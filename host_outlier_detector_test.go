@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk/apidef"
+	"github.com/TykTechnologies/tyk/config"
+)
+
+type testEventRecorder chan apidef.TykEvent
+
+func (r testEventRecorder) Init(interface{}) error { return nil }
+
+func (r testEventRecorder) HandleEvent(em config.EventMessage) { r <- em.Type }
+
+func (r testEventRecorder) wait(t *testing.T, want apidef.TykEvent) {
+	select {
+	case got := <-r:
+		if got != want {
+			t.Fatalf("wanted event %q, got %q", want, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for event %q", want)
+	}
+}
+
+func TestOutlierEjection(t *testing.T) {
+	spec := &APISpec{APIDefinition: &apidef.APIDefinition{APIID: "outliers"}}
+	spec.Proxy.EnableLoadBalancing = true
+	spec.Proxy.PassiveHealthCheck = apidef.PassiveHealthCheckOptions{
+		Enabled:             true,
+		ConsecutiveFailures: 2,
+		EjectionTime:        1,
+	}
+	recorder := make(testEventRecorder, 2)
+	spec.EventPaths = map[apidef.TykEvent][]config.TykEventHandler{
+		EventHOSTDOWN: {recorder},
+		EventHOSTUP:   {recorder},
+	}
+	hostList := apidef.NewHostListFromList([]string{"http://bad.com", "http://good.com"})
+
+	bad500 := &http.Response{StatusCode: 500}
+	spec.Outliers.RecordResult(spec, "http://bad.com", bad500, nil)
+	spec.Outliers.RecordResult(spec, "http://bad.com", &http.Response{StatusCode: 200}, nil)
+	spec.Outliers.RecordResult(spec, "http://bad.com", bad500, nil)
+	if spec.Outliers.IsEjected("http://bad.com") {
+		t.Fatal("failures were not consecutive, host should not be ejected")
+	}
+
+	spec.Outliers.RecordResult(spec, "http://bad.com", nil, errors.New("connection refused"))
+	if !spec.Outliers.IsEjected("http://bad.com") {
+		t.Fatal("host should be ejected after consecutive failures")
+	}
+	recorder.wait(t, EventHOSTDOWN)
+	for i := 0; i < 4; i++ {
+		if got := nextTarget(hostList, spec, testReq(t, "GET", "/", nil)); got != "http://good.com" {
+			t.Fatalf("wanted ejected host to be skipped, got %q", got)
+		}
+	}
+
+	recorder.wait(t, EventHOSTUP)
+	if spec.Outliers.IsEjected("http://bad.com") {
+		t.Fatal("host should be re-admitted after the ejection time")
+	}
+}
+
+func TestOutlierEjectionTimeBackoff(t *testing.T) {
+	spec := &APISpec{APIDefinition: &apidef.APIDefinition{}}
+	spec.Proxy.PassiveHealthCheck.EjectionTime = 10
+	spec.Proxy.PassiveHealthCheck.MaxEjectionTime = 60
+
+	for ejections, want := range map[int]time.Duration{
+		1: 10 * time.Second,
+		2: 20 * time.Second,
+		3: 40 * time.Second,
+		4: 60 * time.Second,
+		9: 60 * time.Second,
+	} {
+		if got := outlierEjectionTime(spec, ejections); got != want {
+			t.Errorf("ejection %d: wanted %v, got %v", ejections, want, got)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultPrometheusMetricsPath = "/metrics"
+
+// Same defaults as the official Prometheus client, in seconds
+var defaultPrometheusBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	promRequests = newPromMetric("tyk_http_requests_total", "counter",
+		"Total number of requests handled, by API, version, response code and method.",
+		"api_id", "version", "code", "method")
+	promRequestDuration = newPromMetric("tyk_http_request_duration_seconds", "histogram",
+		"Time taken to handle requests, including the upstream round trip.",
+		"api_id", "version", "code", "method")
+	promUpstreamErrors = newPromMetric("tyk_upstream_errors_total", "counter",
+		"Upstream requests that failed to connect or returned a 5xx response, code is 0 for connection errors.",
+		"api_id", "version", "code", "method")
+	promRateLimitRejections = newPromMetric("tyk_rate_limit_rejections_total", "counter",
+		"Requests rejected because the key exceeded its rate limit.",
+		"api_id", "version", "method")
+	promQuotaRejections = newPromMetric("tyk_quota_rejections_total", "counter",
+		"Requests rejected because the key exceeded its quota.",
+		"api_id", "version", "method")
+	promCircuitBreakerOpen = newPromMetric("tyk_circuit_breaker_open", "gauge",
+		"Whether the circuit breaker for a path is tripped (1) or closed (0).",
+		"api_id", "version", "path", "method")
+	promHostUp = newPromMetric("tyk_host_up", "gauge",
+		"Whether the uptime tests for a host are passing (1) or failing (0).",
+		"api_id", "host")
+
+	promMetrics = []*promMetric{
+		promRequests,
+		promRequestDuration,
+		promUpstreamErrors,
+		promRateLimitRejections,
+		promQuotaRejections,
+		promCircuitBreakerOpen,
+		promHostUp,
+	}
+)
+
+type promSeries struct {
+	labels []string
+	value  float64
+	// histograms only, buckets are not cumulative
+	buckets []uint64
+	count   uint64
+}
+
+// promMetric is a counter, gauge or histogram with a fixed set of labels,
+// rendered in the Prometheus text exposition format.
+type promMetric struct {
+	name, kind, help string
+	labels           []string
+
+	mu     sync.Mutex
+	series map[string]*promSeries
+}
+
+func newPromMetric(name, kind, help string, labels ...string) *promMetric {
+	return &promMetric{
+		name:   name,
+		kind:   kind,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*promSeries),
+	}
+}
+
+// get must be called with the lock held.
+func (m *promMetric) get(values []string) *promSeries {
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &promSeries{labels: values}
+		if m.kind == "histogram" {
+			s.buckets = make([]uint64, len(defaultPrometheusBuckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Add increments a counter or gauge.
+func (m *promMetric) Add(v float64, values ...string) {
+	m.mu.Lock()
+	m.get(values).value += v
+	m.mu.Unlock()
+}
+
+// Set sets a gauge.
+func (m *promMetric) Set(v float64, values ...string) {
+	m.mu.Lock()
+	m.get(values).value = v
+	m.mu.Unlock()
+}
+
+// Observe adds a sample to a histogram.
+func (m *promMetric) Observe(v float64, values ...string) {
+	m.mu.Lock()
+	s := m.get(values)
+	s.value += v
+	s.count++
+	for i, le := range defaultPrometheusBuckets {
+		if v <= le {
+			s.buckets[i]++
+			break
+		}
+	}
+	m.mu.Unlock()
+}
+
+// Reset drops all series, used by gauges that are collected on scrape.
+func (m *promMetric) Reset() {
+	m.mu.Lock()
+	m.series = make(map[string]*promSeries)
+	m.mu.Unlock()
+}
+
+func (m *promMetric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		labels := promLabels(m.labels, s.labels)
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s{%s} %s\n", m.name, labels, promFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, le := range defaultPrometheusBuckets {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", m.name, labels, promFloat(le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", m.name, labels, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", m.name, labels, promFloat(s.value))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", m.name, labels, s.count)
+	}
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + promLabelEscaper.Replace(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func promFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func prometheusEnabled() bool {
+	return globalConf.Prometheus.Enabled
+}
+
+func prometheusMetricsPath() string {
+	if globalConf.Prometheus.MetricsPath != "" {
+		return globalConf.Prometheus.MetricsPath
+	}
+	return defaultPrometheusMetricsPath
+}
+
+func metricsVersion(spec *APISpec, r *http.Request) string {
+	if version := spec.getVersionFromRequest(r); version != "" {
+		return version
+	}
+	return "Non Versioned"
+}
+
+// prometheusHandler serves all metrics, refreshing the circuit breaker
+// states first.
+func prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	collectCircuitBreakerStates()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, m := range promMetrics {
+		m.write(bw)
+	}
+	bw.Flush()
+}
+
+func collectCircuitBreakerStates() {
+	promCircuitBreakerOpen.Reset()
+
+	apisMu.RLock()
+	defer apisMu.RUnlock()
+	for _, spec := range apisByID {
+		if !spec.CircuitBreakerEnabled {
+			continue
+		}
+		for version, paths := range spec.RxPaths {
+			for _, path := range paths {
+				if path.Status != CircuitBreaker || path.CircuitBreaker.CB == nil {
+					continue
+				}
+				open := 0.0
+				if path.CircuitBreaker.CB.Tripped() {
+					open = 1
+				}
+				promCircuitBreakerOpen.Set(open, spec.APIID, version, path.CircuitBreaker.Path, path.CircuitBreaker.Method)
+			}
+		}
+	}
+}
+
+func reportUpstreamError(spec *APISpec, r *http.Request, res *http.Response, err error) {
+	if !prometheusEnabled() {
+		return
+	}
+	code := 0
+	if err == nil {
+		if res.StatusCode < 500 {
+			return
+		}
+		code = res.StatusCode
+	}
+	promUpstreamErrors.Add(1, spec.APIID, metricsVersion(spec, r), strconv.Itoa(code), r.Method)
+}
+
+func reportRateLimitRejection(spec *APISpec, r *http.Request) {
+	if prometheusEnabled() {
+		promRateLimitRejections.Add(1, spec.APIID, metricsVersion(spec, r), r.Method)
+	}
+}
+
+func reportQuotaRejection(spec *APISpec, r *http.Request) {
+	if prometheusEnabled() {
+		promQuotaRejections.Add(1, spec.APIID, metricsVersion(spec, r), r.Method)
+	}
+}
+
+func reportHostStatus(report HostHealthReport, up bool) {
+	if !prometheusEnabled() {
+		return
+	}
+	value := 0.0
+	if up {
+		value = 1
+	}
+	promHostUp.Set(value, report.MetaData[UnHealthyHostMetaDataAPIKey], report.CheckURL)
+}
+
+// statusRecordingWriter records the status code written to the client.
+type statusRecordingWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusRecordingWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecordingWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecordingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecordingWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+func (w *statusRecordingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	w.code = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+// PrometheusMiddleware counts every request going through an API chain
+// and times it, including requests rejected by middleware.
+func PrometheusMiddleware(spec *APISpec, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the path may be stripped further down the chain
+		version := metricsVersion(spec, r)
+		method := r.Method
+		sw := &statusRecordingWriter{ResponseWriter: w}
+
+		start := time.Now()
+		next.ServeHTTP(sw, r)
+		elapsed := time.Since(start).Seconds()
+
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+		code := strconv.Itoa(sw.code)
+		promRequests.Add(1, spec.APIID, version, code, method)
+		promRequestDuration.Observe(elapsed, spec.APIID, version, code, method)
+	})
+}
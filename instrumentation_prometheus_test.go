@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPromMetricWrite(t *testing.T) {
+	counter := newPromMetric("test_total", "counter", "A test counter.", "api_id", "code")
+	counter.Add(1, "a", "200")
+	counter.Add(2, "a", "200")
+	counter.Add(1, `quo"te`, "500")
+
+	hist := newPromMetric("test_seconds", "histogram", "A test histogram.", "api_id")
+	hist.Observe(0.02, "a")
+	hist.Observe(3, "a")
+
+	var buf bytes.Buffer
+	counter.write(&buf)
+	hist.write(&buf)
+	got := buf.String()
+
+	for _, want := range []string{
+		"# TYPE test_total counter\n",
+		`test_total{api_id="a",code="200"} 3` + "\n",
+		`test_total{api_id="quo\"te",code="500"} 1` + "\n",
+		"# TYPE test_seconds histogram\n",
+		`test_seconds_bucket{api_id="a",le="0.01"} 0` + "\n",
+		`test_seconds_bucket{api_id="a",le="0.025"} 1` + "\n",
+		`test_seconds_bucket{api_id="a",le="5"} 2` + "\n",
+		`test_seconds_bucket{api_id="a",le="+Inf"} 2` + "\n",
+		`test_seconds_sum{api_id="a"} 3.02` + "\n",
+		`test_seconds_count{api_id="a"} 2` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output is missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestPrometheusMiddleware(t *testing.T) {
+	globalConf.Prometheus.Enabled = true
+	defer func() { globalConf.Prometheus.Enabled = false }()
+
+	spec := createSpecTest(t, nonExpiringDefNoWhiteList)
+	remote, _ := url.Parse(spec.Proxy.TargetURL)
+	proxy := TykNewSingleHostReverseProxy(remote, spec)
+	handler := PrometheusMiddleware(spec, ProxyHandler(proxy, spec))
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		req := testReq(t, "GET", "/v1/get", nil)
+		req.Header.Set("version", "v1")
+		handler.ServeHTTP(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("wanted 200, got %d", rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	prometheusHandler(rec, testReq(t, "GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`tyk_http_requests_total{api_id="` + spec.APIID + `",version="v1",code="200",method="GET"} 2`,
+		`tyk_http_request_duration_seconds_count{api_id="` + spec.APIID + `",version="v1",code="200",method="GET"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics are missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestPrometheusMetricsNeedSecret(t *testing.T) {
+	globalConf.Prometheus.Enabled = true
+	defer func() { globalConf.Prometheus.Enabled = false }()
+
+	muxer := mux.NewRouter()
+	loadAPIEndpoints(muxer)
+
+	rec := httptest.NewRecorder()
+	muxer.ServeHTTP(rec, testReq(t, "GET", "/tyk/metrics", nil))
+	if rec.Code != 403 {
+		t.Errorf("wanted metrics without the secret to be forbidden, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	req := testReq(t, "GET", "/tyk/metrics", nil)
+	req.Header.Set("X-Tyk-Authorization", globalConf.Secret)
+	muxer.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Errorf("wanted metrics with the secret, got %d", rec.Code)
+	}
+
+	// APIs listening on / keep their /metrics path
+	rec = httptest.NewRecorder()
+	muxer.ServeHTTP(rec, testReq(t, "GET", "/metrics", nil))
+	if rec.Code != 404 {
+		t.Errorf("wanted /metrics to be left to the APIs, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultJWKSCacheTTL           = 240 // seconds
+	defaultJWKSMinRefetchInterval = 30  // seconds
+)
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+// jwksKeys holds the key sets fetched from JWKS URLs. Sets older than
+// the TTL keep being used while they are refreshed in the background,
+// and a key ID that isn't in a set forces a refetch, at most once per
+// refetch interval.
+var jwksKeys = &jwksCache{entries: make(map[string]*jwksEntry)}
+
+type jwksCache struct {
+	mu      sync.Mutex
+	entries map[string]*jwksEntry
+}
+
+type jwksKey struct {
+	kid, kty string
+	key      crypto.PublicKey
+}
+
+type jwksEntry struct {
+	url string
+
+	// fetchMu serialises the fetches of a set
+	fetchMu sync.Mutex
+
+	mu          sync.Mutex
+	keys        []jwksKey
+	fetched     time.Time
+	refreshing  bool
+	lastAttempt time.Time
+	lastErr     error
+	lastForced  time.Time
+}
+
+func jwksCacheTTL() time.Duration {
+	if ttl := globalConf.JWKSCache.TTL; ttl > 0 {
+		return time.Duration(ttl) * time.Second
+	}
+	return defaultJWKSCacheTTL * time.Second
+}
+
+func jwksMinRefetchInterval() time.Duration {
+	if interval := globalConf.JWKSCache.MinRefetchInterval; interval > 0 {
+		return time.Duration(interval) * time.Second
+	}
+	return defaultJWKSMinRefetchInterval * time.Second
+}
+
+// key returns the public key with the given ID and key type ("RSA" or
+// "EC") from the set at url. Without a key ID, a set holding a single
+// key of that type is used.
+func (c *jwksCache) key(url, kid, keyType string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	e := c.entries[url]
+	if e == nil {
+		e = &jwksEntry{url: url}
+		c.entries[url] = e
+	}
+	c.mu.Unlock()
+
+	keys, err := e.keySet()
+	if err != nil {
+		return nil, err
+	}
+	if key := findJWKSKey(keys, kid, keyType); key != nil {
+		return key, nil
+	}
+	if kid == "" {
+		return nil, errors.New("No matching key could be found")
+	}
+
+	// The key may have been rotated in since the set was fetched
+	if keys, ok := e.forceRefetch(); ok {
+		if key := findJWKSKey(keys, kid, keyType); key != nil {
+			return key, nil
+		}
+	}
+	return nil, errors.New("No matching KID could be found")
+}
+
+func findJWKSKey(keys []jwksKey, kid, keyType string) crypto.PublicKey {
+	var match crypto.PublicKey
+	matches := 0
+	for _, key := range keys {
+		if !strings.EqualFold(key.kty, keyType) {
+			continue
+		}
+		if kid != "" && key.kid == kid {
+			return key.key
+		}
+		match = key.key
+		matches++
+	}
+	if kid == "" && matches == 1 {
+		return match
+	}
+	return nil
+}
+
+// keySet returns the cached keys, fetching them the first time and
+// refreshing them in the background once they are older than the TTL.
+func (e *jwksEntry) keySet() ([]jwksKey, error) {
+	e.mu.Lock()
+	if e.fetched.IsZero() {
+		// don't hammer an identity provider that is down
+		if e.lastErr != nil && time.Since(e.lastAttempt) < jwksMinRefetchInterval() {
+			err := e.lastErr
+			e.mu.Unlock()
+			return nil, err
+		}
+		e.mu.Unlock()
+		return e.refetch(time.Time{})
+	}
+
+	keys := e.keys
+	if time.Since(e.fetched) >= jwksCacheTTL() && !e.refreshing {
+		e.refreshing = true
+		go e.refresh(e.fetched)
+	}
+	e.mu.Unlock()
+	return keys, nil
+}
+
+func (e *jwksEntry) refresh(since time.Time) {
+	if _, err := e.refetch(since); err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": "jwks",
+			"url":    e.url,
+		}).Warning("Failed to refresh JWKS, keeping the cached keys: ", err)
+	}
+	e.mu.Lock()
+	e.refreshing = false
+	e.mu.Unlock()
+}
+
+// forceRefetch fetches the set again, unless that was already done
+// within the minimum refetch interval.
+func (e *jwksEntry) forceRefetch() ([]jwksKey, bool) {
+	e.mu.Lock()
+	if time.Since(e.lastForced) < jwksMinRefetchInterval() {
+		e.mu.Unlock()
+		return nil, false
+	}
+	e.lastForced = time.Now()
+	since := e.fetched
+	e.mu.Unlock()
+
+	keys, err := e.refetch(since)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": "jwks",
+			"url":    e.url,
+		}).Warning("Failed to refetch JWKS: ", err)
+		return nil, false
+	}
+	return keys, true
+}
+
+// refetch fetches the set, unless another fetch completed after since
+// while waiting for it. On failure the cached keys are left alone.
+func (e *jwksEntry) refetch(since time.Time) ([]jwksKey, error) {
+	e.fetchMu.Lock()
+	defer e.fetchMu.Unlock()
+
+	e.mu.Lock()
+	if e.fetched.After(since) {
+		keys := e.keys
+		e.mu.Unlock()
+		return keys, nil
+	}
+	e.mu.Unlock()
+
+	keys, err := fetchJWKSKeys(e.url)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastAttempt = time.Now()
+	e.lastErr = err
+	if err != nil {
+		return nil, err
+	}
+	e.keys = keys
+	e.fetched = time.Now()
+	return keys, nil
+}
+
+func fetchJWKSKeys(url string) ([]jwksKey, error) {
+	log.Debug("Pulling JWK")
+	resp, err := jwksClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS request returned %d", resp.StatusCode)
+	}
+
+	var jwkSet JWKs
+	if err := json.NewDecoder(resp.Body).Decode(&jwkSet); err != nil {
+		return nil, err
+	}
+
+	keys := make([]jwksKey, 0, len(jwkSet.Keys))
+	for _, jwk := range jwkSet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwkPublicKey(jwk)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": "jwks",
+				"url":    url,
+				"kid":    jwk.KID,
+			}).Warning("Skipping unusable JWK: ", err)
+			continue
+		}
+		keys = append(keys, jwksKey{kid: jwk.KID, kty: jwk.Kty, key: key})
+	}
+	return keys, nil
+}
+
+// jwkPublicKey returns the public key of a JWK, from its first
+// certificate or else from its RSA (n, e) or EC (crv, x, y) parameters.
+func jwkPublicKey(jwk JWK) (crypto.PublicKey, error) {
+	if len(jwk.X5c) > 0 {
+		der, err := base64.StdEncoding.DecodeString(jwk.X5c[0])
+		if err != nil {
+			return nil, err
+		}
+		// some providers wrap the certificate or key in PEM
+		if block, _ := pem.Decode(der); block != nil {
+			return parsePublicKeyPEM(der)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+
+	switch strings.ToUpper(jwk.Kty) {
+	case "RSA":
+		n, err := decodeJWKInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeJWKInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// decodeJWKInt decodes a base64url encoded big-endian integer.
+func decodeJWKInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, errors.New("missing key parameter")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
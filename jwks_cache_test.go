@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func rsaJWK(kid string, key *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		KID: kid,
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) JWK {
+	return JWK{
+		Kty: "EC",
+		KID: kid,
+		Crv: key.Curve.Params().Name,
+		X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
+
+// jwksTestServer serves a key set that can be swapped, counting fetches.
+type jwksTestServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    []JWK
+	fetches int32
+}
+
+func newJWKSTestServer(keys ...JWK) *jwksTestServer {
+	s := &jwksTestServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.fetches, 1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		json.NewEncoder(w).Encode(JWKs{Keys: s.keys})
+	}))
+	return s
+}
+
+func (s *jwksTestServer) setKeys(keys ...JWK) {
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+}
+
+func TestJWKSCacheKeyTypes(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	srv := newJWKSTestServer(rsaJWK("rsa", &rsaKey.PublicKey), ecJWK("ec", &ecKey.PublicKey),
+		JWK{Kty: "RSA", KID: "enc", Use: "enc", N: "AQAB", E: "AQAB"})
+	defer srv.Close()
+	c := &jwksCache{entries: make(map[string]*jwksEntry)}
+
+	key, err := c.key(srv.URL, "rsa", "RSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, ok := key.(*rsa.PublicKey); !ok || pub.N.Cmp(rsaKey.N) != 0 || pub.E != rsaKey.E {
+		t.Errorf("wanted the RSA key, got %v", key)
+	}
+	key, err = c.key(srv.URL, "ec", "EC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, ok := key.(*ecdsa.PublicKey); !ok || pub.X.Cmp(ecKey.X) != 0 || pub.Y.Cmp(ecKey.Y) != 0 {
+		t.Errorf("wanted the EC key, got %v", key)
+	}
+	// a single key of the type is used without a key ID
+	if _, err := c.key(srv.URL, "", "EC"); err != nil {
+		t.Error(err)
+	}
+	// the kid and key type must match
+	if _, err := c.key(srv.URL, "rsa", "EC"); err == nil {
+		t.Error("wanted an error for a key of the wrong type")
+	}
+	if got := atomic.LoadInt32(&srv.fetches); got != 2 {
+		t.Errorf("wanted the set fetched once and refetched once for the unknown key, got %d", got)
+	}
+}
+
+func TestJWKSCacheRotation(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	srv := newJWKSTestServer(rsaJWK("old", &oldKey.PublicKey))
+	defer srv.Close()
+	c := &jwksCache{entries: make(map[string]*jwksEntry)}
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.key(srv.URL, "old", "RSA"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := atomic.LoadInt32(&srv.fetches); got != 1 {
+		t.Fatalf("wanted the set to be cached, got %d fetches", got)
+	}
+
+	// an unknown kid forces a refetch
+	srv.setKeys(rsaJWK("old", &oldKey.PublicKey), rsaJWK("new", &newKey.PublicKey))
+	if _, err := c.key(srv.URL, "new", "RSA"); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&srv.fetches); got != 2 {
+		t.Fatalf("wanted a refetch for the unknown kid, got %d fetches", got)
+	}
+
+	// but not again within the refetch interval
+	for i := 0; i < 3; i++ {
+		if _, err := c.key(srv.URL, "bogus", "RSA"); err == nil {
+			t.Fatal("wanted an error for an unknown kid")
+		}
+	}
+	if got := atomic.LoadInt32(&srv.fetches); got != 2 {
+		t.Errorf("wanted refetches to be rate limited, got %d fetches", got)
+	}
+}
+
+func TestJWKSCacheBackgroundRefresh(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	srv := newJWKSTestServer(rsaJWK("kid", &oldKey.PublicKey))
+	defer srv.Close()
+	c := &jwksCache{entries: make(map[string]*jwksEntry)}
+
+	if _, err := c.key(srv.URL, "kid", "RSA"); err != nil {
+		t.Fatal(err)
+	}
+	srv.setKeys(rsaJWK("kid", &newKey.PublicKey))
+	e := c.entries[srv.URL]
+	e.mu.Lock()
+	e.fetched = time.Now().Add(-time.Hour)
+	e.mu.Unlock()
+
+	// the expired set is still served while it is refreshed
+	key, err := c.key(srv.URL, "kid", "RSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.(*rsa.PublicKey).N.Cmp(oldKey.N) != 0 {
+		t.Error("wanted the cached key while refreshing")
+	}
+	time.Sleep(100 * time.Millisecond)
+	key, err = c.key(srv.URL, "kid", "RSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.(*rsa.PublicKey).N.Cmp(newKey.N) != 0 {
+		t.Error("wanted the refreshed key")
+	}
+	if got := atomic.LoadInt32(&srv.fetches); got != 2 {
+		t.Errorf("wanted a single background refresh, got %d fetches", got)
+	}
+
+	// a failing refresh keeps the cached keys
+	srv.Close()
+	e.mu.Lock()
+	e.fetched = time.Now().Add(-time.Hour)
+	e.mu.Unlock()
+	c.key(srv.URL, "kid", "RSA")
+	time.Sleep(100 * time.Millisecond)
+	if _, err := c.key(srv.URL, "kid", "RSA"); err != nil {
+		t.Errorf("wanted the cached key after a failed refresh, got %v", err)
+	}
+}
+
+func TestJWTSessionECDSAWithJWK(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	srv := newJWKSTestServer(ecJWK("ec-key", &ecKey.PublicKey))
+	defer srv.Close()
+
+	spec := createSpecTest(t, jwtWithJWKDef)
+	spec.JWTSigningMethod = "ecdsa"
+	spec.JWTSource = srv.URL
+
+	policiesMu.Lock()
+	policiesByID["987654321"] = Policy{
+		ID:               "987654321",
+		OrgID:            "default",
+		Rate:             1000.0,
+		Per:              1.0,
+		QuotaMax:         -1,
+		QuotaRenewalRate: -1,
+		AccessRights:     map[string]AccessDefinition{},
+		Active:           true,
+		KeyExpiresIn:     60,
+	}
+	policiesMu.Unlock()
+
+	token := jwt.New(jwt.SigningMethodES256)
+	token.Header["kid"] = "ec-key"
+	token.Claims.(jwt.MapClaims)["user_id"] = testKey(t, "token")
+	token.Claims.(jwt.MapClaims)["policy_id"] = "987654321"
+	token.Claims.(jwt.MapClaims)["exp"] = time.Now().Add(time.Hour).Unix()
+	tokenString, err := token.SignedString(ecKey)
+	if err != nil {
+		t.Fatal("Couldn't create JWT token: ", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req := testReq(t, "GET", "/jwt_test/", nil)
+	req.Header.Set("authorization", "Bearer "+tokenString)
+	getJWTChain(spec).ServeHTTP(recorder, req)
+	if recorder.Code != 200 {
+		t.Error("Initial request failed with non-200 code, should have passed!: ", recorder.Code)
+	}
+}
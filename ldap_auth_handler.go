@@ -177,6 +177,10 @@ func (l LDAPStorageHandler) AppendToSet(keyName, value string) {
 	log.Error("Not implemented")
 }
 
+func (l LDAPStorageHandler) AppendToSetPipelined(keyName string, values []string) {
+	log.Error("Not implemented")
+}
+
 func (l LDAPStorageHandler) RemoveFromSet(keyName, value string) {
 	log.Error("Not implemented")
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sync"
+
+	"github.com/TykTechnologies/tyk/apidef"
+)
+
+// WeightedRoundRobin implements the smooth weighted round robin used by
+// nginx, which spreads picks of heavier targets across the whole cycle
+// instead of sending them in bursts.
+type WeightedRoundRobin struct {
+	sync.Mutex
+	current []int
+}
+
+// Next returns the index of the next target to use, only considering
+// targets that are marked as up. It returns -1 if none are.
+func (w *WeightedRoundRobin) Next(weights []int, up []bool) int {
+	w.Lock()
+	defer w.Unlock()
+
+	// Host list changed size, start over
+	if len(w.current) != len(weights) {
+		w.current = make([]int, len(weights))
+	}
+
+	best, total := -1, 0
+	for i, weight := range weights {
+		if !up[i] {
+			continue
+		}
+		w.current[i] += weight
+		total += weight
+		if best < 0 || w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	if best >= 0 {
+		w.current[best] -= total
+	}
+	return best
+}
+
+// UpstreamLoad tracks the number of in-flight requests per upstream
+// host for the least connections strategy.
+type UpstreamLoad struct {
+	sync.Mutex
+	inFlight map[string]int64
+	next     int
+}
+
+// AcquireLeast picks the up host with the fewest in-flight requests
+// relative to its weight and counts a new request against it. Ties are
+// broken by rotating the starting position so that idle hosts share
+// traffic evenly. It returns -1 if no host is up.
+func (u *UpstreamLoad) AcquireLeast(hosts []string, weights []int, up []bool) int {
+	u.Lock()
+	defer u.Unlock()
+	if u.inFlight == nil {
+		u.inFlight = make(map[string]int64)
+	}
+
+	start := u.next % len(hosts)
+	u.next++
+
+	best := -1
+	for n := 0; n < len(hosts); n++ {
+		i := (start + n) % len(hosts)
+		if !up[i] {
+			continue
+		}
+		// load_i/weight_i < load_best/weight_best, without dividing
+		if best < 0 || u.inFlight[hosts[i]]*int64(weights[best]) < u.inFlight[hosts[best]]*int64(weights[i]) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		u.inFlight[hosts[best]]++
+	}
+	return best
+}
+
+// Release marks a request started by AcquireLeast as finished.
+func (u *UpstreamLoad) Release(host string) {
+	u.Lock()
+	defer u.Unlock()
+	if u.inFlight[host]--; u.inFlight[host] <= 0 {
+		delete(u.inFlight, host)
+	}
+}
+
+// InFlight returns the number of requests currently counted against host.
+func (u *UpstreamLoad) InFlight(host string) int64 {
+	u.Lock()
+	defer u.Unlock()
+	return u.inFlight[host]
+}
+
+// targetWeights matches the configured weights to a host list of the
+// given length, defaulting missing or invalid entries to 1.
+func targetWeights(configured []int, n int) []int {
+	weights := make([]int, n)
+	for i := range weights {
+		weights[i] = 1
+		if i < len(configured) && configured[i] > 0 {
+			weights[i] = configured[i]
+		}
+	}
+	return weights
+}
+
+// loadBalancingHashKey returns the value a request is hashed on for the
+// consistent hash strategy, falling back to the client IP when the key
+// or header is not present.
+func loadBalancingHashKey(spec *APISpec, req *http.Request) string {
+	var key string
+	switch spec.Proxy.LoadBalancing.HashOn {
+	case apidef.HashOnHeader:
+		key = req.Header.Get(spec.Proxy.LoadBalancing.HashHeaderName)
+	default:
+		key = ctxGetAuthToken(req)
+	}
+	if key == "" {
+		key = requestIP(req)
+	}
+	return key
+}
+
+// rendezvousHash picks a host for key using weighted rendezvous (highest
+// random weight) hashing. Only the keys mapped to a host that goes down
+// or is removed get moved elsewhere. It returns -1 if no host is up.
+func rendezvousHash(key string, hosts []string, weights []int, up []bool) int {
+	best, bestScore := -1, 0.0
+	for i, host := range hosts {
+		if !up[i] {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(host))
+		// map the hash into (0, 1) and scale it by weight
+		u := (float64(h.Sum64()) + 1) / (math.MaxUint64 + 2)
+		score := -float64(weights[i]) / math.Log(u)
+		if best < 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// balancedTarget picks a target using one of the weighted, least
+// connections or consistent hash strategies. Hosts that fail their
+// uptime tests, were ejected or already failed this request are
+// skipped, unless all of them are.
+func balancedTarget(targetData *apidef.HostList, spec *APISpec, req *http.Request) string {
+	hosts := make([]string, targetData.Len())
+	for i := range hosts {
+		host, err := targetData.GetIndex(i)
+		if err != nil {
+			// the list was swapped for a shorter one
+			hosts = hosts[:i]
+			break
+		}
+		hosts[i] = EnsureTransport(host)
+	}
+	if len(hosts) == 0 {
+		log.Error("[PROXY] [LOAD BALANCING] No upstream targets available")
+		return ""
+	}
+
+	weights := targetWeights(spec.Proxy.LoadBalancing.Weights, len(hosts))
+
+	up := make([]bool, len(hosts))
+	anyUp := false
+	for i, host := range hosts {
+		up[i] = !targetIsDown(host, spec) && !ctxGetTriedTargets(req)[host]
+		anyUp = anyUp || up[i]
+	}
+	if !anyUp {
+		log.Error("[PROXY] [LOAD BALANCING] All hosts seem to be down, all uptime tests are failing!")
+		for i := range up {
+			up[i] = true
+		}
+	}
+
+	var pos int
+	switch spec.Proxy.LoadBalancing.Strategy {
+	case apidef.WeightedRoundRobinStrategy:
+		pos = spec.WeightedRoundRobin.Next(weights, up)
+	case apidef.LeastConnectionsStrategy:
+		pos = spec.UpstreamLoad.AcquireLeast(hosts, weights, up)
+		// released by the proxy once the upstream request is done
+		ctxSetInFlightHost(req, hosts[pos])
+	case apidef.ConsistentHashStrategy:
+		pos = rendezvousHash(loadBalancingHashKey(spec, req), hosts, weights, up)
+	}
+	return hosts[pos]
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/TykTechnologies/tyk/apidef"
+)
+
+func TestWeightedRoundRobin(t *testing.T) {
+	wrr := WeightedRoundRobin{}
+	weights := []int{5, 1, 1}
+
+	counts := make([]int, len(weights))
+	for i := 0; i < 7; i++ {
+		counts[wrr.Next(weights, []bool{true, true, true})]++
+	}
+	if want := []int{5, 1, 1}; fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Errorf("wanted picks %v, got %v", want, counts)
+	}
+
+	for i := 0; i < 10; i++ {
+		if got := wrr.Next(weights, []bool{false, true, true}); got == 0 {
+			t.Fatal("picked a host that is down")
+		}
+	}
+	if got := wrr.Next(weights, []bool{false, false, false}); got != -1 {
+		t.Errorf("wanted -1 with all hosts down, got %d", got)
+	}
+}
+
+func TestUpstreamLoadAcquireLeast(t *testing.T) {
+	load := UpstreamLoad{}
+	hosts := []string{"http://a", "http://b"}
+	weights := []int{1, 2}
+	up := []bool{true, true}
+
+	counts := make([]int, len(hosts))
+	for i := 0; i < 6; i++ {
+		counts[load.AcquireLeast(hosts, weights, up)]++
+	}
+	if counts[0] != 2 || counts[1] != 4 {
+		t.Errorf("wanted in-flight split 2/4 by weight, got %v", counts)
+	}
+
+	for i := 0; i < 4; i++ {
+		load.Release("http://b")
+	}
+	if got := load.AcquireLeast(hosts, weights, up); got != 1 {
+		t.Errorf("wanted least loaded host 1, got %d", got)
+	}
+	if got := load.InFlight("http://b"); got != 1 {
+		t.Errorf("wanted 1 in-flight request, got %d", got)
+	}
+}
+
+func TestRendezvousHash(t *testing.T) {
+	hosts := []string{"http://a", "http://b", "http://c", "http://d"}
+	weights := targetWeights(nil, len(hosts))
+	up := []bool{true, true, true, true}
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprint("key-", i)
+		first := rendezvousHash(key, hosts, weights, up)
+		if got := rendezvousHash(key, hosts, weights, up); got != first {
+			t.Fatalf("same key mapped to %d then %d", first, got)
+		}
+
+		// only keys on the downed host may move
+		other := (first + 1) % len(hosts)
+		partial := []bool{true, true, true, true}
+		partial[other] = false
+		if got := rendezvousHash(key, hosts, weights, partial); got != first {
+			t.Fatalf("key %q moved from %d to %d when host %d went down", key, first, got, other)
+		}
+		partial[first] = false
+		if got := rendezvousHash(key, hosts, weights, partial); got == first {
+			t.Fatalf("key %q stayed on downed host %d", key, first)
+		}
+	}
+}
+
+func TestNextTargetConsistentHashOnHeader(t *testing.T) {
+	spec := &APISpec{APIDefinition: &apidef.APIDefinition{}}
+	spec.Proxy.EnableLoadBalancing = true
+	spec.Proxy.LoadBalancing.Strategy = apidef.ConsistentHashStrategy
+	spec.Proxy.LoadBalancing.HashOn = apidef.HashOnHeader
+	spec.Proxy.LoadBalancing.HashHeaderName = "X-Tenant"
+	hostList := apidef.NewHostListFromList([]string{"a.com", "b.com", "c.com"})
+
+	seen := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		tenant := fmt.Sprint("tenant-", i%5)
+		req := testReq(t, "GET", "/", nil)
+		req.Header.Set("X-Tenant", tenant)
+		host := nextTarget(hostList, spec, req)
+		if prev, ok := seen[tenant]; ok && prev != host {
+			t.Fatalf("tenant %q sent to %q and %q", tenant, prev, host)
+		}
+		seen[tenant] = host
+	}
+}
+
+func TestNextTargetLeastConnections(t *testing.T) {
+	spec := &APISpec{APIDefinition: &apidef.APIDefinition{}}
+	spec.Proxy.EnableLoadBalancing = true
+	spec.Proxy.LoadBalancing.Strategy = apidef.LeastConnectionsStrategy
+	hostList := apidef.NewHostListFromList([]string{"a.com", "b.com"})
+
+	first := testReq(t, "GET", "/", nil)
+	busy := nextTarget(hostList, spec, first)
+	if ctxGetInFlightHost(first) != busy {
+		t.Fatal("in-flight host not recorded on the request")
+	}
+
+	for i := 0; i < 3; i++ {
+		req := testReq(t, "GET", "/", nil)
+		if got := nextTarget(hostList, spec, req); got == busy {
+			t.Fatalf("wanted the idle host, got busy host %q", got)
+		}
+		spec.UpstreamLoad.Release(ctxGetInFlightHost(req))
+	}
+}
@@ -118,7 +118,7 @@ func setupGlobals() {
 		analytics.Store = &analyticsStore
 		analytics.Init()
 
-		if globalConf.AnalyticsConfig.Type == "rpc" {
+		if analyticsTypeEnabled("rpc") {
 			log.Debug("Using RPC cache purge")
 
 			purger := RPCPurger{Store: &analyticsStore}
@@ -295,6 +295,13 @@ func loadAPIEndpoints(muxer *mux.Router) {
 			"prefix": "main",
 		}).Info("Control API hostname set: ", hostname)
 	}
+	if globalConf.Prometheus.Enabled {
+		log.WithFields(logrus.Fields{
+			"prefix": "main",
+		}).Info("Prometheus metrics enabled on: /tyk", prometheusMetricsPath())
+		// Metrics name APIs and keys, so they are part of the control API
+		r.HandleFunc(prometheusMetricsPath(), allowMethods(prometheusHandler, "GET"))
+	}
 	log.WithFields(logrus.Fields{
 		"prefix": "main",
 	}).Info("Initialising Tyk REST API Endpoints")
@@ -355,6 +362,7 @@ func addOAuthHandlers(spec *APISpec, muxer *mux.Router) *OAuthManager {
 	apiAuthorizePath := spec.Proxy.ListenPath + "tyk/oauth/authorize-client{_:/?}"
 	clientAuthPath := spec.Proxy.ListenPath + "oauth/authorize{_:/?}"
 	clientAccessPath := spec.Proxy.ListenPath + "oauth/token{_:/?}"
+	clientRevokePath := spec.Proxy.ListenPath + "oauth/revoke{_:/?}"
 
 	serverConfig := osin.NewServerConfig()
 	serverConfig.ErrorStatusCode = 403
@@ -375,6 +383,7 @@ func addOAuthHandlers(spec *APISpec, muxer *mux.Router) *OAuthManager {
 	muxer.Handle(apiAuthorizePath, checkIsAPIOwner(http.HandlerFunc(allowMethods(oauthHandlers.HandleGenerateAuthCodeData, "POST"))))
 	muxer.HandleFunc(clientAuthPath, allowMethods(oauthHandlers.HandleAuthorizePassthrough, "GET", "POST"))
 	muxer.HandleFunc(clientAccessPath, allowMethods(oauthHandlers.HandleAccessRequest, "GET", "POST"))
+	muxer.HandleFunc(clientRevokePath, allowMethods(oauthHandlers.HandleRevokeRequest, "POST"))
 
 	return &oauthManager
 }
@@ -811,6 +820,7 @@ func initialiseSystem(arguments map[string]interface{}) error {
 	//doInstrumentation, _ := arguments["--log-instrumentation"].(bool)
 	//SetupInstrumentation(doInstrumentation)
 	SetupInstrumentation(true)
+	SetupTracing()
 
 	if globalConf.HttpServerOptions.UseLE_SSL {
 		go StartPeriodicStateBackup(&LE_MANAGER)
@@ -831,6 +841,7 @@ func afterConfSetup(conf *config.Config) {
 	GlobalRPCPingTimeout = time.Second * time.Duration(conf.SlaveOptions.PingTimeout)
 	GlobalRPCCallTimeout = time.Second * time.Duration(conf.SlaveOptions.CallTimeout)
 	conf.EventTriggers = InitGenericEventHandlers(conf.EventHandlers)
+	globalTrustedProxies = newTrustedProxies(conf.TrustedProxies, conf.TrustedProxyHops)
 }
 
 type AuditHostDetails struct {
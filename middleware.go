@@ -24,6 +24,13 @@ type TykMiddleware interface {
 	Name() string
 }
 
+// requestFinisher is implemented by middleware holding on to something
+// while the rest of the chain handles a request, such as a concurrency
+// slot. FinishRequest is called once the chain is done, however it ended.
+type requestFinisher interface {
+	FinishRequest(r *http.Request)
+}
+
 func CreateDynamicMiddleware(name string, isPre, useSession bool, baseMid *BaseMiddleware) func(http.Handler) http.Handler {
 	dMiddleware := &DynamicMiddleware{
 		BaseMiddleware:      baseMid,
@@ -70,7 +77,16 @@ func CreateMiddleware(mw TykMiddleware) func(http.Handler) http.Handler {
 				h.ServeHTTP(w, r)
 				return
 			}
+			span := StartSpan(r, mw.Name(), spanKindInternal)
 			err, errCode := mw.ProcessRequest(w, r, mwConf)
+			if err != nil {
+				span.SetAttribute("http.status_code", errCode)
+				span.SetError(err.Error())
+			}
+			span.Finish()
+			if f, ok := mw.(requestFinisher); ok {
+				defer f.FinishRequest(r)
+			}
 			if err != nil {
 				handler := ErrorHandler{mw.Base()}
 				handler.HandleError(w, r, err.Error(), errCode)
@@ -119,6 +135,16 @@ func CheckETEnabled(baseMid *BaseMiddleware) bool {
 	return false
 }
 
+func CheckRetriesEnabled(baseMid *BaseMiddleware) bool {
+	for _, v := range baseMid.Spec.VersionData.Versions {
+		if len(v.ExtendedPaths.Retries) > 0 {
+			baseMid.Spec.RetryPathsEnabled = true
+			return true
+		}
+	}
+	return false
+}
+
 type TykResponseHandler interface {
 	Init(interface{}, *APISpec) error
 	HandleResponse(http.ResponseWriter, *http.Response, *http.Request, *SessionState) error
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/TykTechnologies/tyk/apidef"
+)
+
+const apiRateLimitKeyPrefix = "apilimiter-"
+
+// RateLimitForAPI enforces the API's global rate limit, which counts the
+// requests of all callers together. On keyless APIs it also enforces the
+// endpoint rate limits, which keyed APIs count per key instead. Requests
+// rejected later on, such as by a key's own limits, still count against
+// these.
+type RateLimitForAPI struct {
+	*BaseMiddleware
+}
+
+func (k *RateLimitForAPI) Name() string {
+	return "RateLimitForAPI"
+}
+
+func (k *RateLimitForAPI) IsEnabledForSpec() bool {
+	if k.Spec.DisableRateLimit {
+		return false
+	}
+	if k.Spec.GlobalRateLimit.Rate > 0 {
+		return true
+	}
+	if !k.Spec.UseKeylessAccess {
+		return false
+	}
+	for _, version := range k.Spec.VersionData.Versions {
+		if len(version.ExtendedPaths.RateLimit) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *RateLimitForAPI) handleRateLimitFailure(r *http.Request) (error, int) {
+	log.WithFields(logrus.Fields{
+		"path":   r.URL.Path,
+		"origin": requestIP(r),
+		"api_id": k.Spec.APIID,
+	}).Info("API rate limit exceeded.")
+
+	// Fire a rate limit exceeded event
+	k.FireEvent(EventRateLimitExceeded, EventRateLimitExceededMeta{
+		EventMetaDefault: EventMetaDefault{Message: "API Rate Limit Exceeded", OriginatingRequest: EncodeRequestToEvent(r)},
+		Path:             r.URL.Path,
+		Origin:           requestIP(r),
+	})
+
+	// Report in health check
+	ReportHealthCheckValue(k.Spec.Health, Throttle, "-1")
+	reportRateLimitRejection(k.Spec, r)
+
+	return errors.New("API rate limit exceeded"), 429
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (k *RateLimitForAPI) ProcessRequest(w http.ResponseWriter, r *http.Request, _ interface{}) (error, int) {
+	store := k.Spec.SessionManager.GetStore()
+
+	var limitKeys []string
+	var limits []apidef.GlobalRateLimit
+	if limit := k.Spec.GlobalRateLimit; limit.Rate > 0 {
+		limitKeys = append(limitKeys, apiRateLimitKeyPrefix+k.Spec.APIID)
+		limits = append(limits, limit)
+	}
+	if k.Spec.UseKeylessAccess {
+		if limit := k.pathRateLimit(r); limit != nil {
+			limitKeys = append(limitKeys, apiRateLimitKeyPrefix+k.Spec.APIID+":"+limit.Method+":"+limit.Path)
+			limits = append(limits, apidef.GlobalRateLimit{Rate: limit.Rate, Per: limit.Per})
+		}
+	}
+	// Limits are counted as they are checked, so a request rejected by
+	// one has already counted against those before it. Check the
+	// tightest first, so that it doesn't use up the looser one.
+	if len(limits) == 2 && tighterRateLimit(limits[1], limits[0]) {
+		limitKeys[0], limitKeys[1] = limitKeys[1], limitKeys[0]
+		limits[0], limits[1] = limits[1], limits[0]
+	}
+
+	// Report whichever limit is closest to being exceeded
+	var reported *rateLimitState
+	for i, limitKey := range limitKeys {
+		state := sessionLimiter.limitRate(limitKey, limitKey, limits[i].Rate, limits[i].Per, store)
+		if state.Exceeded {
+			ctxSetRateLimitState(r, &state)
+			return k.handleRateLimitFailure(r)
+		}
+		if state.Limit > 0 && (reported == nil || state.Remaining < reported.Remaining) {
+			reported = &state
+		}
+	}
+	if reported != nil {
+		ctxSetRateLimitState(r, reported)
+	}
+
+	return nil, 200
+}
+
+// tighterRateLimit reports whether a allows fewer requests per second
+// than b.
+func tighterRateLimit(a, b apidef.GlobalRateLimit) bool {
+	return a.Rate*b.Per < b.Rate*a.Per
+}
+
+// pathRateLimit returns the rate limit of the endpoint a request is for,
+// if there is one.
+func (t *BaseMiddleware) pathRateLimit(r *http.Request) *apidef.RateLimitMeta {
+	_, versionPaths, _, _ := t.Spec.Version(r)
+	found, meta := t.Spec.CheckSpecMatchesStatus(r, versionPaths, RateLimited)
+	if !found {
+		return nil
+	}
+	return meta.(*apidef.RateLimitMeta)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/justinas/alice"
+)
+
+const keylessRateLimitDef = `{
+	"api_id": "keyless-rate-limit",
+	"org_id": "default",
+	"use_keyless": true,
+	"global_rate_limit": {"rate": 3, "per": 60},
+	"version_data": {
+		"not_versioned": true,
+		"versions": {
+			"Default": {
+				"name": "Default",
+				"use_extended_paths": true,
+				"extended_paths": {
+					"rate_limit": [{"path": "/expensive", "method": "GET", "rate": 1, "per": 60}]
+				}
+			}
+		}
+	},
+	"proxy": {
+		"listen_path": "/",
+		"target_url": "` + testHttpAny + `"
+	}
+}`
+
+const keyedRateLimitDef = `{
+	"api_id": "keyed-rate-limit",
+	"org_id": "default",
+	"auth": {"auth_header_name": "authorization"},
+	"version_data": {
+		"not_versioned": true,
+		"versions": {
+			"Default": {
+				"name": "Default",
+				"use_extended_paths": true,
+				"extended_paths": {
+					"rate_limit": [{"path": "/expensive", "method": "GET", "rate": 1, "per": 60}]
+				}
+			}
+		}
+	},
+	"proxy": {
+		"listen_path": "/",
+		"target_url": "` + testHttpAny + `"
+	}
+}`
+
+func getRateLimitChain(spec *APISpec) http.Handler {
+	remote, _ := url.Parse(testHttpAny)
+	proxy := TykNewSingleHostReverseProxy(remote, spec)
+	proxyHandler := ProxyHandler(proxy, spec)
+	baseMid := &BaseMiddleware{spec, proxy}
+	constructors := []alice.Constructor{
+		CreateMiddleware(&VersionCheck{BaseMiddleware: baseMid}),
+		CreateMiddleware(&RateLimitForAPI{BaseMiddleware: baseMid}),
+	}
+	if !spec.UseKeylessAccess {
+		constructors = append(constructors,
+			CreateMiddleware(&AuthKey{baseMid}),
+			CreateMiddleware(&KeyExpired{baseMid}),
+			CreateMiddleware(&AccessRightsCheck{baseMid}),
+			CreateMiddleware(&RateLimitAndQuotaCheck{baseMid}))
+	}
+	return alice.New(constructors...).Then(proxyHandler)
+}
+
+func TestKeylessAPIRateLimits(t *testing.T) {
+	globalConf.EnableRedisRollingLimiter = true
+	defer func() { globalConf.EnableRedisRollingLimiter = false }()
+
+	spec := createSpecTest(t, keylessRateLimitDef)
+	chain := getRateLimitChain(spec)
+
+	wantCodes := []struct {
+		path string
+		code int
+	}{
+		{"/expensive", 200},
+		{"/expensive", 429}, // endpoint limit, shared by all callers
+		{"/cheap", 200},
+		// the tighter endpoint limit is checked first, the request it
+		// rejected didn't count against the global limit
+		{"/cheap", 200},
+		{"/cheap", 429}, // global limit
+	}
+	for i, tc := range wantCodes {
+		recorder := httptest.NewRecorder()
+		chain.ServeHTTP(recorder, testReq(t, "GET", tc.path, nil))
+		if recorder.Code != tc.code {
+			t.Errorf("request %d to %s: wanted %d, got %d", i, tc.path, tc.code, recorder.Code)
+		}
+	}
+}
+
+func TestKeyedAPIRateLimits(t *testing.T) {
+	globalConf.EnableRedisRollingLimiter = true
+	defer func() { globalConf.EnableRedisRollingLimiter = false }()
+
+	spec := createSpecTest(t, keyedRateLimitDef)
+	chain := getRateLimitChain(spec)
+
+	session := createNonThrottledSession()
+	session.QuotaMax = -1
+	session.AccessRights = map[string]AccessDefinition{"keyed-rate-limit": {
+		APIID:    "keyed-rate-limit",
+		Versions: []string{"Default"},
+		Limit:    &APILimit{Rate: 3, Per: 60},
+	}}
+	keys := []string{testKey(t, "first"), testKey(t, "second")}
+	for _, key := range keys {
+		spec.SessionManager.UpdateSession(key, session, 60)
+	}
+
+	request := func(key, path string) int {
+		recorder := httptest.NewRecorder()
+		req := testReq(t, "GET", path, nil)
+		req.Header.Set("authorization", key)
+		chain.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	wantCodes := []struct {
+		key  string
+		path string
+		code int
+	}{
+		{keys[0], "/expensive", 200},
+		{keys[0], "/expensive", 429}, // endpoint limit of the key
+		{keys[1], "/expensive", 200}, // which other keys don't share
+		{keys[0], "/cheap", 200},
+		{keys[0], "/cheap", 200},
+		{keys[0], "/cheap", 429}, // API limit of the key, not its own rate
+	}
+	for i, tc := range wantCodes {
+		if code := request(tc.key, tc.path); code != tc.code {
+			t.Errorf("request %d to %s: wanted %d, got %d", i, tc.path, tc.code, code)
+		}
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	globalConf.EnableRedisRollingLimiter = true
+	globalConf.EnableIETFRateLimitHeaders = true
+	defer func() {
+		globalConf.EnableRedisRollingLimiter = false
+		globalConf.EnableIETFRateLimitHeaders = false
+	}()
+
+	t.Run("Keyless rate limit", func(t *testing.T) {
+		spec := createSpecTest(t, keylessRateLimitDef)
+		spec.APIID = testKey(t, "api") // not to share limits with other tests
+		chain := getRateLimitChain(spec)
+
+		recorder := httptest.NewRecorder()
+		chain.ServeHTTP(recorder, testReq(t, "GET", "/expensive", nil))
+		if got := recorder.Header().Get(headerXRateLimitRemaining); got != "0" {
+			t.Errorf("wanted endpoint limit reported with 0 remaining, got %q", got)
+		}
+		if got := recorder.Header().Get(headerRateLimitLimit); got != "1" {
+			t.Errorf("wanted IETF limit of 1, got %q", got)
+		}
+		if recorder.Header().Get(headerRetryAfter) != "" {
+			t.Error("wanted no Retry-After on success")
+		}
+
+		recorder = httptest.NewRecorder()
+		chain.ServeHTTP(recorder, testReq(t, "GET", "/expensive", nil))
+		if recorder.Code != 429 {
+			t.Fatal("wanted 429, got ", recorder.Code)
+		}
+		retryAfter := recorder.Header().Get(headerRetryAfter)
+		if retryAfter != "60" || recorder.Header().Get(headerRateLimitReset) != retryAfter {
+			t.Errorf("wanted retry after the 60s window, got Retry-After %q and reset %q",
+				retryAfter, recorder.Header().Get(headerRateLimitReset))
+		}
+	})
+
+	t.Run("Key quota", func(t *testing.T) {
+		spec := createSpecTest(t, keyedRateLimitDef)
+		chain := getRateLimitChain(spec)
+
+		session := createQuotaSession()
+		session.AccessRights = map[string]AccessDefinition{"keyed-rate-limit": {
+			APIID:    "keyed-rate-limit",
+			Versions: []string{"Default"},
+		}}
+		session.QuotaRenews = time.Now().Unix() + session.QuotaRenewalRate
+		key := testKey(t, "key")
+		spec.SessionManager.UpdateSession(key, session, 60)
+		defer spec.SessionManager.ResetQuota(key, session)
+
+		request := func() *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req := testReq(t, "GET", "/cheap", nil)
+			req.Header.Set("authorization", key)
+			chain.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		recorder := request()
+		if got := recorder.Header().Get(headerXRateLimitLimit); got != "2" {
+			t.Errorf("wanted quota of 2 reported, got %q", got)
+		}
+		if got := recorder.Header().Get(headerXRateLimitRemaining); got != "1" {
+			t.Errorf("wanted 1 request of quota remaining, got %q", got)
+		}
+
+		request()
+		recorder = request()
+		if recorder.Code != 403 {
+			t.Fatal("wanted 403 once the quota is used, got ", recorder.Code)
+		}
+		if got, _ := strconv.Atoi(recorder.Header().Get(headerRetryAfter)); got < 290 || got > 300 {
+			t.Errorf("wanted retry once the quota renews in 300s, got %d", got)
+		}
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	concurrencyKeyPrefix = "concurrency-"
+
+	// concurrencySlotTTL bounds how long distributed counters outlive
+	// gateways that stopped without releasing their slots, in seconds
+	concurrencySlotTTL = 300
+
+	// Waiters on distributed limits poll with a jittered backoff between
+	// these intervals
+	concurrencyPollInterval    = 10 * time.Millisecond
+	concurrencyMaxPollInterval = 200 * time.Millisecond
+)
+
+var concurrencyStore = &RedisClusterStorageManager{}
+
+// localConcurrency counts the requests in flight on this gateway
+var localConcurrency = newConcurrencyCounter()
+
+// concurrencyCounter is a set of counting semaphores. Waiters are woken
+// whenever a slot is released, whichever it is.
+type concurrencyCounter struct {
+	mu       sync.Mutex
+	inFlight map[string]int64
+	released chan struct{}
+}
+
+func newConcurrencyCounter() *concurrencyCounter {
+	return &concurrencyCounter{
+		inFlight: make(map[string]int64),
+		released: make(chan struct{}),
+	}
+}
+
+// tryAcquire takes a slot if fewer than max are taken, or else returns a
+// channel closed once one is released.
+func (c *concurrencyCounter) tryAcquire(key string, max int64) (bool, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inFlight[key] < max {
+		c.inFlight[key]++
+		return true, nil
+	}
+	return false, c.released
+}
+
+func (c *concurrencyCounter) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inFlight[key]--; c.inFlight[key] <= 0 {
+		delete(c.inFlight, key)
+	}
+	close(c.released)
+	c.released = make(chan struct{})
+}
+
+// concurrencySlot is a request's place in a concurrency limit
+type concurrencySlot struct {
+	key         string
+	distributed bool
+}
+
+// tryAcquire takes a slot if fewer than max are taken. attempt counts the
+// previous tries of the request, and spaces out polling of distributed
+// limits.
+func (s concurrencySlot) tryAcquire(max int64, attempt int) (bool, <-chan struct{}) {
+	if !s.distributed {
+		return localConcurrency.tryAcquire(s.key, max)
+	}
+	if attempt > 0 {
+		// Don't take a slot only to give it back while the limit is
+		// still reached, other gateways would see it taken meanwhile
+		value, _ := concurrencyStore.GetRawKey(s.key)
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil && n >= max {
+			return false, concurrencyRetry(attempt)
+		}
+	}
+	n, err := concurrencyStore.IncrementRawKey(s.key)
+	if err != nil {
+		// The count is unknown, other gateways' slots must be kept
+		log.WithFields(logrus.Fields{
+			"prefix": "concurrency",
+		}).Error("Could not take a concurrency slot: ", err)
+		return false, concurrencyRetry(attempt)
+	}
+	if n < 1 {
+		// The counter expired while requests were in flight and their
+		// releases took it below zero, start counting again
+		concurrencyStore.SetRawKey(s.key, "1", concurrencySlotTTL)
+		return true, nil
+	}
+	// Keep the counter alive for as long as slots are being taken, a
+	// new one gets its expiry here too
+	concurrencyStore.SetRawExp(s.key, concurrencySlotTTL)
+	if n > max {
+		concurrencyStore.Decrement(s.key)
+		return false, concurrencyRetry(attempt)
+	}
+	return true, nil
+}
+
+// concurrencyRetry returns a channel closed once a distributed limit should
+// be polled again. Other gateways' releases can't be waited on.
+func concurrencyRetry(attempt int) <-chan struct{} {
+	interval := concurrencyPollInterval << uint(attempt)
+	if interval <= 0 || interval > concurrencyMaxPollInterval {
+		interval = concurrencyMaxPollInterval
+	}
+	// Spread out gateways waiting on the same limit
+	interval = interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+
+	retry := make(chan struct{})
+	time.AfterFunc(interval, func() { close(retry) })
+	return retry
+}
+
+func (s concurrencySlot) release() {
+	if !s.distributed {
+		localConcurrency.release(s.key)
+		return
+	}
+	concurrencyStore.Decrement(s.key)
+}
+
+// ConcurrencyLimit limits the requests to an API in flight at once, and
+// those of each key. Requests over a limit wait for one to finish if the
+// API allows it, and are otherwise rejected.
+type ConcurrencyLimit struct {
+	*BaseMiddleware
+}
+
+func (k *ConcurrencyLimit) Name() string {
+	return "ConcurrencyLimit"
+}
+
+func (k *ConcurrencyLimit) IsEnabledForSpec() bool {
+	// Keys may have a limit of their own
+	return k.Spec.ConcurrencyLimit.MaxConcurrent > 0 || !k.Spec.UseKeylessAccess
+}
+
+func (k *ConcurrencyLimit) handleConcurrencyFailure(r *http.Request) (error, int) {
+	log.WithFields(logrus.Fields{
+		"path":   r.URL.Path,
+		"origin": requestIP(r),
+		"api_id": k.Spec.APIID,
+	}).Info("Concurrency limit exceeded.")
+
+	// Report in health check
+	ReportHealthCheckValue(k.Spec.Health, Throttle, "-1")
+
+	return errors.New("Too many concurrent requests"), 429
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (k *ConcurrencyLimit) ProcessRequest(w http.ResponseWriter, r *http.Request, _ interface{}) (error, int) {
+	conf := k.Spec.ConcurrencyLimit
+
+	var slots []concurrencySlot
+	var limits []int64
+	if conf.MaxConcurrent > 0 {
+		slots = append(slots, concurrencySlot{concurrencyKeyPrefix + "api-" + k.Spec.APIID, conf.Distributed})
+		limits = append(limits, conf.MaxConcurrent)
+	}
+	if session := ctxGetSession(r); session != nil && session.MaxConcurrent > 0 {
+		slots = append(slots, concurrencySlot{concurrencyKeyPrefix + publicHash(ctxGetAuthToken(r)), conf.Distributed})
+		limits = append(limits, session.MaxConcurrent)
+	}
+
+	deadline := time.NewTimer(time.Duration(conf.WaitTimeout) * time.Millisecond)
+	defer deadline.Stop()
+	for i, slot := range slots {
+		if !k.acquire(r, slot, limits[i], deadline.C) {
+			for _, taken := range slots[:i] {
+				taken.release()
+			}
+			return k.handleConcurrencyFailure(r)
+		}
+	}
+	if len(slots) > 0 {
+		ctxSetConcurrencySlots(r, slots)
+	}
+
+	return nil, 200
+}
+
+// acquire takes a slot, waiting for one to be released until the
+// deadline or the client going away.
+func (k *ConcurrencyLimit) acquire(r *http.Request, slot concurrencySlot, max int64, deadline <-chan time.Time) bool {
+	for attempt := 0; ; attempt++ {
+		ok, released := slot.tryAcquire(max, attempt)
+		if ok {
+			return true
+		}
+		select {
+		case <-released:
+		case <-deadline:
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
+
+// FinishRequest releases the slots of a request once it has been handled
+// or its client has gone away.
+func (k *ConcurrencyLimit) FinishRequest(r *http.Request) {
+	for _, slot := range ctxGetConcurrencySlots(r) {
+		slot.release()
+	}
+}
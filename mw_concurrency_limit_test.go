@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/justinas/alice"
+
+	"github.com/TykTechnologies/tyk/apidef"
+)
+
+const concurrencyLimitDef = `{
+	"api_id": "concurrency-limit",
+	"org_id": "default",
+	"use_keyless": true,
+	"concurrency_limit": {"max_concurrent": 1},
+	"version_data": {
+		"not_versioned": true,
+		"versions": {
+			"Default": {"name": "Default"}
+		}
+	},
+	"proxy": {
+		"listen_path": "/",
+		"target_url": "` + testHttpAny + `"
+	}
+}`
+
+// getConcurrencyChain limits a handler which blocks until unblock is
+// closed, telling started about each request it gets.
+func getConcurrencyChain(spec *APISpec, session *SessionState, started chan<- bool, unblock <-chan bool) http.Handler {
+	baseMid := &BaseMiddleware{spec, nil}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-unblock
+	})
+	chain := alice.New(CreateMiddleware(&ConcurrencyLimit{baseMid})).Then(upstream)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if session != nil {
+			ctxSetSession(r, session)
+			ctxSetAuthToken(r, "concurrency-key")
+		}
+		chain.ServeHTTP(w, r)
+	})
+}
+
+func serveConcurrently(t *testing.T, chain http.Handler) <-chan int {
+	code := make(chan int, 1)
+	go func() {
+		recorder := httptest.NewRecorder()
+		chain.ServeHTTP(recorder, testReq(t, "GET", "/", nil))
+		code <- recorder.Code
+	}()
+	return code
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	spec := createSpecTest(t, concurrencyLimitDef)
+	started, unblock := make(chan bool, 2), make(chan bool)
+	chain := getConcurrencyChain(spec, nil, started, unblock)
+
+	first := serveConcurrently(t, chain)
+	<-started
+	if code := <-serveConcurrently(t, chain); code != 429 {
+		t.Fatalf("wanted request over the limit to return 429, got %d", code)
+	}
+
+	close(unblock)
+	if code := <-first; code != 200 {
+		t.Fatalf("wanted first request to return 200, got %d", code)
+	}
+	// The slot of the first request was released
+	if code := <-serveConcurrently(t, chain); code != 200 {
+		t.Fatalf("wanted request after the first finished to return 200, got %d", code)
+	}
+}
+
+func TestConcurrencyLimitWait(t *testing.T) {
+	spec := createSpecTest(t, concurrencyLimitDef)
+	spec.ConcurrencyLimit.WaitTimeout = 5000
+	started, unblock := make(chan bool, 2), make(chan bool)
+	chain := getConcurrencyChain(spec, nil, started, unblock)
+
+	first := serveConcurrently(t, chain)
+	<-started
+	second := serveConcurrently(t, chain)
+	close(unblock)
+	for _, code := range []int{<-first, <-second} {
+		if code != 200 {
+			t.Fatalf("wanted waiting request to return 200, got %d", code)
+		}
+	}
+}
+
+func TestKeyConcurrencyLimitDistributed(t *testing.T) {
+	spec := createSpecTest(t, concurrencyLimitDef)
+	spec.ConcurrencyLimit = apidef.ConcurrencyLimit{Distributed: true}
+	session := createNonThrottledSession()
+	session.MaxConcurrent = 1
+	counterKey := concurrencyKeyPrefix + publicHash("concurrency-key")
+	concurrencyStore.DeleteRawKey(counterKey)
+	defer concurrencyStore.DeleteRawKey(counterKey)
+
+	started, unblock := make(chan bool, 2), make(chan bool)
+	chain := getConcurrencyChain(spec, session, started, unblock)
+
+	first := serveConcurrently(t, chain)
+	<-started
+	if code := <-serveConcurrently(t, chain); code != 429 {
+		t.Fatalf("wanted request over the key's limit to return 429, got %d", code)
+	}
+
+	close(unblock)
+	<-first
+	if count, _ := concurrencyStore.GetRawKey(counterKey); count != "0" {
+		t.Errorf("wanted the key's slots to be released, got %q in flight", count)
+	}
+}
+
+func TestKeyConcurrencyLimitDistributedRefreshesTTL(t *testing.T) {
+	spec := createSpecTest(t, concurrencyLimitDef)
+	spec.ConcurrencyLimit = apidef.ConcurrencyLimit{Distributed: true}
+	session := createNonThrottledSession()
+	session.MaxConcurrent = 2
+	counterKey := concurrencyKeyPrefix + publicHash("concurrency-key")
+	// A request already in flight, its counter about to expire
+	concurrencyStore.SetRawKey(counterKey, "1", 1)
+	defer concurrencyStore.DeleteRawKey(counterKey)
+
+	started, unblock := make(chan bool, 1), make(chan bool)
+	chain := getConcurrencyChain(spec, session, started, unblock)
+
+	first := serveConcurrently(t, chain)
+	<-started
+	if ttl, _ := concurrencyStore.GetExp(counterKey); ttl <= 1 {
+		t.Errorf("wanted taking a slot to refresh the counter's TTL, got %d", ttl)
+	}
+	close(unblock)
+	<-first
+}
+
+func TestKeyConcurrencyLimitDistributedRedisError(t *testing.T) {
+	spec := createSpecTest(t, concurrencyLimitDef)
+	spec.ConcurrencyLimit = apidef.ConcurrencyLimit{Distributed: true}
+	session := createNonThrottledSession()
+	session.MaxConcurrent = 1
+	counterKey := concurrencyKeyPrefix + publicHash("concurrency-key")
+	// INCR fails on a value that isn't a number
+	concurrencyStore.SetRawKey(counterKey, "not-a-count", concurrencySlotTTL)
+	defer concurrencyStore.DeleteRawKey(counterKey)
+
+	unblock := make(chan bool)
+	close(unblock)
+	chain := getConcurrencyChain(spec, session, make(chan bool, 1), unblock)
+	if code := <-serveConcurrently(t, chain); code != 429 {
+		t.Errorf("wanted a request whose slot couldn't be counted to return 429, got %d", code)
+	}
+	if value, _ := concurrencyStore.GetRawKey(counterKey); value != "not-a-count" {
+		t.Errorf("wanted the counter to be left alone, got %q", value)
+	}
+}
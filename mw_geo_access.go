@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/TykTechnologies/tyk/apidef"
+)
+
+var errGeoIPNotLoaded = errors.New("GeoIP database is not loaded")
+
+// GeoAccessMiddleware allows or denies requests by the country the
+// client IP is located in, using the GeoIP database loaded for analytics
+type GeoAccessMiddleware struct {
+	*BaseMiddleware
+}
+
+func (g *GeoAccessMiddleware) Name() string {
+	return "GeoAccessMiddleware"
+}
+
+// Init warns once if the rules can't be checked, without a GeoIP database
+// every location is unknown.
+func (g *GeoAccessMiddleware) Init() {
+	if !g.IsEnabledForSpec() || geoIPLoaded() {
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"prefix": "geo",
+		"api_id": g.Spec.APIID,
+	}).Warning("Country access rules are set but no GeoIP database is loaded (enable_geo_ip), requests from unknown locations are denied by allowed_countries")
+}
+
+func geoIPLoaded() bool {
+	return globalConf.AnalyticsConfig.EnableGeoIP && analytics.GeoIPDB != nil
+}
+
+func geoRulesSet(rules apidef.GeoAccessRules) bool {
+	return len(rules.AllowedCountries) > 0 || len(rules.DeniedCountries) > 0
+}
+
+func (g *GeoAccessMiddleware) IsEnabledForSpec() bool {
+	if geoRulesSet(g.Spec.GeoAccessRules) {
+		return true
+	}
+	for _, version := range g.Spec.VersionData.Versions {
+		if geoRulesSet(version.GeoAccessRules) {
+			return true
+		}
+	}
+	return false
+}
+
+// geoCountry returns the ISO code of the country an IP address is
+// located in, or an empty string if it is unknown.
+var geoCountry = func(ip string) (string, error) {
+	if !geoIPLoaded() {
+		return "", errGeoIPNotLoaded
+	}
+	record, err := geoIPLookup(ip)
+	if err != nil || record == nil {
+		return "", err
+	}
+	return record.Country.ISOCode, nil
+}
+
+func countryInList(country string, list []string) bool {
+	for _, c := range list {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (g *GeoAccessMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, _ interface{}) (error, int) {
+	// Disabled, pass through
+	if !g.IsEnabledForSpec() {
+		return nil, 200
+	}
+
+	ip := requestIP(r)
+	country, err := geoCountry(ip)
+	// A missing database was reported when the API was loaded
+	if err != nil && err != errGeoIPNotLoaded {
+		// unknown locations only pass deny rules
+		log.Error("GeoIP lookup for access rules failed: ", err)
+	}
+
+	rules := []apidef.GeoAccessRules{g.Spec.GeoAccessRules}
+	ruleNames := []string{""}
+	if version, _, _, stat := g.Spec.Version(r); stat == StatusOk {
+		rules = append(rules, version.GeoAccessRules)
+		ruleNames = append(ruleNames, "version "+version.Name+" ")
+	}
+
+	for i, rule := range rules {
+		if country != "" && countryInList(country, rule.DeniedCountries) {
+			accessRuleFailed(g.BaseMiddleware, r, ip, ruleNames[i]+"denied_countries: "+country)
+			return errors.New("Access from this location has been disallowed"), 403
+		}
+		if len(rule.AllowedCountries) > 0 && !countryInList(country, rule.AllowedCountries) {
+			accessRuleFailed(g.BaseMiddleware, r, ip, ruleNames[i]+"allowed_countries: "+strings.Join(rule.AllowedCountries, ","))
+			return errors.New("Access from this location has been disallowed"), 403
+		}
+	}
+
+	return nil, 200
+}
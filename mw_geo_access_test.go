@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+const geoAccessTestDefinition = `{
+	"api_id": "geo-access",
+	"use_keyless": true,
+	"definition": {
+		"location": "header",
+		"key": "version"
+	},
+	"version_data": {
+		"versions": {
+			"v1": {"name": "v1"},
+			"v2": {"name": "v2", "geo_access_rules": {"allowed_countries": ["gb"]}}
+		}
+	},
+	"proxy": {
+		"listen_path": "/",
+		"target_url": "` + testHttpAny + `"
+	},
+	"geo_access_rules": {"denied_countries": ["KP"]}
+}`
+
+func TestGeoAccessMiddleware(t *testing.T) {
+	defer func(old func(string) (string, error)) { geoCountry = old }(geoCountry)
+	// the test GeoIP database has no country data
+	geoCountry = func(ip string) (string, error) {
+		switch ip {
+		case "1.1.1.1":
+			return "GB", nil
+		case "2.2.2.2":
+			return "KP", nil
+		case "3.3.3.3":
+			return "US", nil
+		}
+		return "", nil
+	}
+
+	spec := createSpecTest(t, geoAccessTestDefinition)
+	events := collectEvents(spec, EventAuthFailure)
+	router := mux.NewRouter()
+	loadApps([]*APISpec{spec}, router)
+
+	for _, tc := range []struct {
+		remote, version string
+		wantCode        int
+		wantRule        string
+	}{
+		{"1.1.1.1:80", "v1", 200, ""},
+		{"2.2.2.2:80", "v1", 403, "denied_countries: KP"},
+		{"3.3.3.3:80", "v1", 200, ""},
+		{"4.4.4.4:80", "v1", 200, ""},
+		{"1.1.1.1:80", "v2", 200, ""},
+		{"2.2.2.2:80", "v2", 403, "denied_countries: KP"},
+		{"3.3.3.3:80", "v2", 403, "version v2 allowed_countries: gb"},
+		{"4.4.4.4:80", "v2", 403, "version v2 allowed_countries: gb"},
+	} {
+		rec := httptest.NewRecorder()
+		req := testReq(t, "GET", "/", nil)
+		req.RemoteAddr = tc.remote
+		req.Header.Set("version", tc.version)
+		router.ServeHTTP(rec, req)
+		if rec.Code != tc.wantCode {
+			t.Errorf("%s %s: wanted %d, got %d", tc.remote, tc.version, tc.wantCode, rec.Code)
+		}
+		if tc.wantRule == "" {
+			continue
+		}
+		select {
+		case em := <-events:
+			meta := em.Meta.(EventAuthFailureMeta)
+			if meta.Rule != tc.wantRule {
+				t.Errorf("%s %s: wanted rule %q, got %q", tc.remote, tc.version, tc.wantRule, meta.Rule)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s %s: wanted an auth failure event", tc.remote, tc.version)
+		}
+	}
+}
+
+func TestGeoAccessWarnsOnce(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(out io.Writer, level logrus.Level) {
+		log.Out, log.Level = out, level
+	}(log.Out, log.Level)
+	log.Out, log.Level = &buf, logrus.WarnLevel
+	defer func(enabled bool) { globalConf.AnalyticsConfig.EnableGeoIP = enabled }(globalConf.AnalyticsConfig.EnableGeoIP)
+	globalConf.AnalyticsConfig.EnableGeoIP = false
+
+	// Keyed APIs also get a chain for their rate limit endpoint
+	keyed := strings.Replace(geoAccessTestDefinition, `"use_keyless": true`, `"use_keyless": false`, 1)
+	loadApps([]*APISpec{createSpecTest(t, keyed), createSpecTest(t, nonExpiringDefNoWhiteList)}, mux.NewRouter())
+
+	if n := strings.Count(buf.String(), "no GeoIP database is loaded"); n != 1 {
+		t.Errorf("wanted a single warning for the API with country rules, got %d", n)
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"errors"
+	"hash"
+	"io/ioutil"
 	"math"
 	"net/http"
 	"net/url"
@@ -19,6 +24,26 @@ import (
 
 const dateHeaderSpec = "Date"
 const altHeaderSpec = "x-aux-date"
+const digestHeaderSpec = "Digest"
+
+const defaultHMACAlgorithm = "hmac-sha1"
+
+// hmacAlgorithms are the supported values of the signature's algorithm
+// field.
+var hmacAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1":   sha1.New,
+	"hmac-sha256": sha256.New,
+	"hmac-sha384": sha512.New384,
+	"hmac-sha512": sha512.New,
+}
+
+// digestAlgorithms are the supported algorithms of the Digest header,
+// as named in the IANA HTTP Digest Algorithm Values registry.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-384": sha512.New384,
+	"sha-512": sha512.New,
+}
 
 // HMACMiddleware will check if the request has a signature, and if the request is allowed through
 type HMACMiddleware struct {
@@ -56,6 +81,15 @@ func (hm *HMACMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request,
 		return hm.authorizationError(r)
 	}
 
+	if err := hm.checkAlgorithm(fieldValues.Algorthm); err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix":    "hmac",
+			"algorithm": fieldValues.Algorthm,
+		}).Error(err)
+		AuthFailed(hm.BaseMiddleware, r, fieldValues.KeyID)
+		return err, 400
+	}
+
 	// Generate a signature string
 	signatureString, err := generateHMACSignatureStringFromRequest(r, fieldValues)
 	if err != nil {
@@ -68,44 +102,25 @@ func (hm *HMACMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request,
 	}
 
 	// Get a session for the Key ID
-	secret, session, err := hm.getSecretAndSessionForKeyID(fieldValues.KeyID)
+	key, session, err := hm.getSecretAndSessionForKeyID(fieldValues.KeyID, fieldValues.Algorthm)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"prefix": "hmac",
 			"error":  err,
 			"keyID":  fieldValues.KeyID,
-		}).Error("No HMAC secret for this key")
+		}).Error("No signing key for this key ID")
 		return hm.authorizationError(r)
 	}
 
-	// Create a signed string with the secret
-	encodedSignature := generateEncodedSignature(signatureString, secret)
-
-	// Compare
-	matchPass := false
-	if encodedSignature == fieldValues.Signature {
-		matchPass = true
-	}
-
-	// Check for lower case encoding (.Net issues, again)
-	if !matchPass {
-		isLower, lowerList := hm.hasLowerCaseEscaped(fieldValues.Signature)
-		if isLower {
-			log.Debug("--- Detected lower case encoding! ---")
-			upperedSignature := hm.replaceWithUpperCase(fieldValues.Signature, lowerList)
-			if encodedSignature == upperedSignature {
-				matchPass = true
-				encodedSignature = upperedSignature
-			}
+	if isPublicKeyAlgorithm(fieldValues.Algorthm) {
+		if err := verifyPublicKeySignature(signatureString, fieldValues.Signature, fieldValues.Algorthm, key); err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": "hmac",
+				"error":  err,
+			}).Error("Signature verification failed!")
+			return hm.authorizationError(r)
 		}
-	}
-
-	if !matchPass {
-		log.WithFields(logrus.Fields{
-			"prefix":   "hmac",
-			"expected": encodedSignature,
-			"got":      fieldValues.Signature,
-		}).Error("Signature string does not match!")
+	} else if !hm.hmacSignatureMatches(signatureString, fieldValues, key.(string)) {
 		return hm.authorizationError(r)
 	}
 
@@ -118,6 +133,18 @@ func (hm *HMACMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request,
 		return hm.authorizationError(r)
 	}
 
+	// The signature only protects the body through the Digest header
+	if hm.Spec.HmacValidateDigest {
+		if err := validateDigest(r, fieldValues); err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": "hmac",
+				"error":  err,
+			}).Error("Digest validation failed")
+			AuthFailed(hm.BaseMiddleware, r, fieldValues.KeyID)
+			return err, 400
+		}
+	}
+
 	// Set session state on context, we will need it later
 	switch hm.Spec.BaseIdentityProvidedBy {
 	case apidef.HMACKey, apidef.UnsetAuth:
@@ -131,12 +158,112 @@ func (hm *HMACMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request,
 
 }
 
+func (hm *HMACMiddleware) hmacSignatureMatches(signatureString string, fieldValues *HMACFieldValues, secret string) bool {
+	// Create a signed string with the secret
+	encodedSignature := generateEncodedSignature(signatureString, secret, fieldValues.Algorthm)
+
+	// Compare
+	if encodedSignature == fieldValues.Signature {
+		return true
+	}
+
+	// Check for lower case encoding (.Net issues, again)
+	isLower, lowerList := hm.hasLowerCaseEscaped(fieldValues.Signature)
+	if isLower {
+		log.Debug("--- Detected lower case encoding! ---")
+		upperedSignature := hm.replaceWithUpperCase(fieldValues.Signature, lowerList)
+		if encodedSignature == upperedSignature {
+			return true
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"prefix":   "hmac",
+		"expected": encodedSignature,
+		"got":      fieldValues.Signature,
+	}).Error("Signature string does not match!")
+	return false
+}
+
 func stripSignature(token string) string {
 	token = strings.TrimPrefix(token, "Signature")
 	token = strings.TrimPrefix(token, "signature")
 	return strings.TrimSpace(token)
 }
 
+// checkAlgorithm makes sure the signature's algorithm is supported and
+// allowed for the API, an empty algorithm means hmac-sha1.
+func (hm *HMACMiddleware) checkAlgorithm(algorithm string) error {
+	if algorithm == "" {
+		algorithm = defaultHMACAlgorithm
+	}
+	if _, ok := hmacAlgorithms[strings.ToLower(algorithm)]; !ok && !isPublicKeyAlgorithm(algorithm) {
+		return errors.New("Signature algorithm is not supported")
+	}
+	if len(hm.Spec.HmacAllowedAlgorithms) == 0 {
+		return nil
+	}
+	for _, allowed := range hm.Spec.HmacAllowedAlgorithms {
+		if strings.EqualFold(strings.TrimSpace(allowed), algorithm) {
+			return nil
+		}
+	}
+	return errors.New("Signature algorithm is not allowed")
+}
+
+// validateDigest checks the request body against the Digest header,
+// which must be part of the signed headers. Every entry with a
+// supported algorithm must match.
+func validateDigest(r *http.Request, fieldValues *HMACFieldValues) error {
+	signed := false
+	for _, header := range fieldValues.Headers {
+		if strings.EqualFold(strings.TrimSpace(header), digestHeaderSpec) {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return errors.New("Digest header must be signed")
+	}
+	digest := r.Header.Get(digestHeaderSpec)
+	if digest == "" {
+		return errors.New("Digest header missing")
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	checked := false
+	for _, element := range strings.Split(digest, ",") {
+		// base64 values may end in =, only split on the first one
+		kv := strings.SplitN(strings.TrimSpace(element), "=", 2)
+		if len(kv) != 2 {
+			return errors.New("Digest header malformed")
+		}
+		newHash, ok := digestAlgorithms[strings.ToLower(kv[0])]
+		if !ok {
+			continue
+		}
+		h := newHash()
+		h.Write(body)
+		if base64.StdEncoding.EncodeToString(h.Sum(nil)) != kv[1] {
+			return errors.New("Digest does not match the request body")
+		}
+		checked = true
+	}
+	if !checked {
+		return errors.New("Digest algorithm is not supported")
+	}
+	return nil
+}
+
 func (hm *HMACMiddleware) hasLowerCaseEscaped(signature string) (bool, []string) {
 	foundList := hm.lowercasePattern.FindAllString(signature, -1)
 	return len(foundList) > 0, foundList
@@ -217,18 +344,37 @@ type HMACFieldValues struct {
 	Signature string
 }
 
-func (hm *HMACMiddleware) getSecretAndSessionForKeyID(keyId string) (string, SessionState, error) {
+// getSecretAndSessionForKeyID returns the session for a key ID and what
+// its signatures are checked with: the HMAC secret, or the public key
+// for rsa and ecdsa signatures.
+func (hm *HMACMiddleware) getSecretAndSessionForKeyID(keyId, algorithm string) (interface{}, SessionState, error) {
 	session, keyExists := hm.CheckSessionAndIdentityForValidKey(keyId)
 	if !keyExists {
-		return "", session, errors.New("Key ID does not exist")
+		return nil, session, errors.New("Key ID does not exist")
 	}
 
-	if session.HmacSecret == "" || !session.HMACEnabled {
+	if !session.HMACEnabled {
 		log.WithFields(logrus.Fields{
 			"prefix": "hmac",
-		}).Info("API Requires HMAC signature, session missing HMACSecret or HMAC not enabled for key")
+		}).Info("API Requires HMAC signature, HMAC not enabled for key")
 
-		return "", session, errors.New("This key ID is invalid")
+		return nil, session, errors.New("This key ID is invalid")
+	}
+
+	if isPublicKeyAlgorithm(algorithm) {
+		publicKey, err := sessionPublicKey(&session, keyId, algorithm)
+		if err != nil {
+			return nil, session, err
+		}
+		return publicKey, session, nil
+	}
+
+	if session.HmacSecret == "" {
+		log.WithFields(logrus.Fields{
+			"prefix": "hmac",
+		}).Info("API Requires HMAC signature, session missing HMACSecret")
+
+		return nil, session, errors.New("This key ID is invalid")
 	}
 
 	return session.HmacSecret, session, nil
@@ -323,9 +469,13 @@ func generateHMACSignatureStringFromRequest(r *http.Request, fieldValues *HMACFi
 	return signatureString, nil
 }
 
-func generateEncodedSignature(signatureString, secret string) string {
+func generateEncodedSignature(signatureString, secret, algorithm string) string {
+	newHash, ok := hmacAlgorithms[strings.ToLower(algorithm)]
+	if !ok {
+		newHash = hmacAlgorithms[defaultHMACAlgorithm]
+	}
 	key := []byte(secret)
-	h := hmac.New(sha1.New, key)
+	h := hmac.New(newHash, key)
 	h.Write([]byte(signatureString))
 
 	encodedString := base64.StdEncoding.EncodeToString(h.Sum(nil))
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/url"
+	"strings"
+)
+
+// publicKeyAlgorithms are the signature algorithms verified with a
+// public key instead of the session's HMAC secret, mapped to the JWK
+// key type they need.
+var publicKeyAlgorithms = map[string]string{
+	"rsa-sha256":   "RSA",
+	"ecdsa-sha256": "EC",
+}
+
+func isPublicKeyAlgorithm(algorithm string) bool {
+	_, ok := publicKeyAlgorithms[strings.ToLower(algorithm)]
+	return ok
+}
+
+// sessionPublicKey returns the key a session's signatures are verified
+// with, from its PEM key or else from its JWKS URL. JWKS keys are
+// matched on the keyId, a set with a single key of the right type is
+// used as is.
+func sessionPublicKey(session *SessionState, keyID, algorithm string) (crypto.PublicKey, error) {
+	if session.SignaturePublicKey != "" {
+		return parsePublicKeyPEM([]byte(session.SignaturePublicKey))
+	}
+	if session.SignatureJWKSURL == "" {
+		return nil, errors.New("Session has no public key")
+	}
+
+	keyType := publicKeyAlgorithms[strings.ToLower(algorithm)]
+	if key, err := jwksKeys.key(session.SignatureJWKSURL, keyID, keyType); err == nil {
+		return key, nil
+	}
+	return jwksKeys.key(session.SignatureJWKSURL, "", keyType)
+}
+
+// parsePublicKeyPEM accepts a PEM encoded public key or certificate.
+func parsePublicKeyPEM(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("Public key is not PEM encoded")
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+}
+
+// verifyPublicKeySignature checks a base64 signature of signatureString,
+// which may be URL encoded like HMAC signatures. ECDSA signatures may be
+// either ASN.1 encoded or the plain concatenation of r and s.
+func verifyPublicKeySignature(signatureString, signature, algorithm string, key crypto.PublicKey) error {
+	if strings.Contains(signature, "%") {
+		unescaped, err := url.QueryUnescape(signature)
+		if err != nil {
+			return err
+		}
+		signature = unescaped
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256([]byte(signatureString))
+
+	switch strings.ToLower(algorithm) {
+	case "rsa-sha256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("Public key is not an RSA key")
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], sig)
+	case "ecdsa-sha256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("Public key is not an ECDSA key")
+		}
+		r, s, err := ecdsaSignatureValues(sig, pub)
+		if err != nil {
+			return err
+		}
+		if !ecdsa.Verify(pub, hashed[:], r, s) {
+			return errors.New("ECDSA verification failed")
+		}
+		return nil
+	}
+	return errors.New("Signature algorithm is not supported")
+}
+
+func ecdsaSignatureValues(sig []byte, pub *ecdsa.PublicKey) (*big.Int, *big.Int, error) {
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	if len(sig) == 2*size {
+		return new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:]), nil
+	}
+	var values struct{ R, S *big.Int }
+	rest, err := asn1.Unmarshal(sig, &values)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rest) > 0 {
+		return nil, nil, errors.New("Trailing data after ECDSA signature")
+	}
+	return values.R, values.S, nil
+}
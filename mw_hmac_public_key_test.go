@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func signPublicKeyTestRequest(t *testing.T, req *http.Request, keyID, algorithm string, key crypto.Signer) {
+	tim := time.Now().Format("Mon, 02 Jan 2006 15:04:05 MST")
+	req.Header.Set("Date", tim)
+	hashed := sha256.Sum256([]byte("date: " + tim))
+	sig, err := key.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedString := url.QueryEscape(base64.StdEncoding.EncodeToString(sig))
+	req.Header.Set("Authorization", fmt.Sprintf("Signature keyId=\"%s\",algorithm=\"%s\",signature=\"%s\"", keyID, algorithm, encodedString))
+}
+
+func publicKeyPEM(t *testing.T, key crypto.Signer) string {
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestHMACAuthPublicKeySignatures(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	spec := createSpecTest(t, hmacAuthDef)
+	chain := getHMACAuthChain(spec)
+
+	for _, tc := range []struct {
+		name      string
+		algorithm string
+		sessionPK crypto.Signer
+		signer    crypto.Signer
+		wantCode  int
+	}{
+		{"rsa", "rsa-sha256", rsaKey, rsaKey, 200},
+		{"ecdsa", "ecdsa-sha256", ecKey, ecKey, 200},
+		{"wrong key", "rsa-sha256", rsaKey, otherKey, 400},
+		{"wrong key type", "ecdsa-sha256", rsaKey, ecKey, 400},
+	} {
+		session := createHMACAuthSession()
+		session.SignaturePublicKey = publicKeyPEM(t, tc.sessionPK)
+		// sessions are cached by key ID
+		keyID := keyGen.GenerateAuthKey("")
+		spec.SessionManager.UpdateSession(keyID, session, 60)
+
+		recorder := httptest.NewRecorder()
+		req := testReq(t, "GET", "/", nil)
+		signPublicKeyTestRequest(t, req, keyID, tc.algorithm, tc.signer)
+		chain.ServeHTTP(recorder, req)
+		if recorder.Code != tc.wantCode {
+			t.Errorf("%s: wanted %d, got %d", tc.name, tc.wantCode, recorder.Code)
+		}
+	}
+}
+
+func TestHMACAuthPublicKeyFromJWKS(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "partner"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JWKs{Keys: []JWK{{
+			Kty: "RSA",
+			KID: "partner-key",
+			X5c: []string{base64.StdEncoding.EncodeToString(cert)},
+		}}})
+	}))
+	defer jwks.Close()
+
+	spec := createSpecTest(t, hmacAuthDef)
+	session := createHMACAuthSession()
+	session.SignatureJWKSURL = jwks.URL
+	keyID := keyGen.GenerateAuthKey("")
+	spec.SessionManager.UpdateSession(keyID, session, 60)
+
+	recorder := httptest.NewRecorder()
+	req := testReq(t, "GET", "/", nil)
+	signPublicKeyTestRequest(t, req, keyID, "rsa-sha256", key)
+	getHMACAuthChain(spec).ServeHTTP(recorder, req)
+	if recorder.Code != 200 {
+		t.Errorf("wanted 200, got %d", recorder.Code)
+	}
+}
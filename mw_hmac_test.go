@@ -3,8 +3,11 @@ package main
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"fmt"
+	"hash"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -356,3 +359,101 @@ func TestHMACAuthSessionPassWithHeaderFieldLowerCase(t *testing.T) {
 		t.Error("Initial request failed with non-200 code, should have gone through!: \n", recorder.Code)
 	}
 }
+
+func signHMACTestRequest(req *http.Request, secret, algorithm string, newHash func() hash.Hash, headers ...string) {
+	tim := time.Now().Format("Mon, 02 Jan 2006 15:04:05 MST")
+	req.Header.Set("Date", tim)
+	var lines []string
+	for _, header := range append([]string{"date"}, headers...) {
+		lines = append(lines, header+": "+req.Header.Get(header))
+	}
+	h := hmac.New(newHash, []byte(secret))
+	h.Write([]byte(strings.Join(lines, "\n")))
+	encodedString := url.QueryEscape(base64.StdEncoding.EncodeToString(h.Sum(nil)))
+
+	req.Header.Set("Authorization", fmt.Sprintf("Signature keyId=\"9876\",algorithm=\"%s\",headers=\"%s\",signature=\"%s\"",
+		algorithm, strings.Join(append([]string{"date"}, headers...), " "), encodedString))
+}
+
+func TestHMACAuthAlgorithms(t *testing.T) {
+	spec := createSpecTest(t, hmacAuthDef)
+	spec.HmacAllowedAlgorithms = []string{"hmac-sha256", "hmac-sha512"}
+	events := collectEvents(spec, EventAuthFailure)
+	session := createHMACAuthSession()
+	spec.SessionManager.UpdateSession("9876", session, 60)
+	chain := getHMACAuthChain(spec)
+
+	for _, tc := range []struct {
+		algorithm string
+		newHash   func() hash.Hash
+		wantCode  int
+	}{
+		{"hmac-sha256", sha256.New, 200},
+		{"hmac-sha512", sha512.New, 200},
+		// signed with the wrong algorithm
+		{"hmac-sha512", sha256.New, 400},
+		{"hmac-sha1", sha1.New, 400},
+		{"hmac-md5", sha1.New, 400},
+	} {
+		recorder := httptest.NewRecorder()
+		req := testReq(t, "GET", "/", nil)
+		signHMACTestRequest(req, session.HmacSecret, tc.algorithm, tc.newHash)
+		chain.ServeHTTP(recorder, req)
+		if recorder.Code != tc.wantCode {
+			t.Errorf("%s: wanted %d, got %d", tc.algorithm, tc.wantCode, recorder.Code)
+		}
+	}
+
+	// only the disallowed and unsupported algorithms fire an event
+	for i := 0; i < 2; i++ {
+		select {
+		case <-events:
+		case <-time.After(time.Second):
+			t.Fatal("wanted an auth failure event")
+		}
+	}
+}
+
+func TestHMACAuthDigest(t *testing.T) {
+	spec := createSpecTest(t, hmacAuthDef)
+	spec.HmacValidateDigest = true
+	events := collectEvents(spec, EventAuthFailure)
+	session := createHMACAuthSession()
+	spec.SessionManager.UpdateSession("9876", session, 60)
+	chain := getHMACAuthChain(spec)
+
+	body := `{"amount": 10}`
+	sum := sha256.Sum256([]byte(body))
+	digest := "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+
+	for _, tc := range []struct {
+		name, body, digest string
+		signed             []string
+		wantCode           int
+	}{
+		{"valid", body, digest, []string{"digest"}, 200},
+		{"tampered body", `{"amount": 1000}`, digest, []string{"digest"}, 400},
+		{"unsigned digest", body, digest, nil, 400},
+		{"missing digest", body, "", []string{"digest"}, 400},
+		{"unsupported digest", body, "MD5=abc", []string{"digest"}, 400},
+	} {
+		recorder := httptest.NewRecorder()
+		req := testReq(t, "POST", "/", tc.body)
+		if tc.digest != "" {
+			req.Header.Set("Digest", tc.digest)
+		}
+		signHMACTestRequest(req, session.HmacSecret, "hmac-sha1", sha1.New, tc.signed...)
+		chain.ServeHTTP(recorder, req)
+		if recorder.Code != tc.wantCode {
+			t.Errorf("%s: wanted %d, got %d", tc.name, tc.wantCode, recorder.Code)
+		}
+		if tc.wantCode == 200 {
+			continue
+		}
+		select {
+		case <-events:
+		case <-time.After(time.Second):
+			t.Errorf("%s: wanted an auth failure event", tc.name)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pmylund/go-cache"
+
+	"github.com/TykTechnologies/tyk/apidef"
+)
+
+const (
+	introspectionPrefix = "introspection"
+
+	defaultIntrospectionCacheTTL         = 60 // seconds, for tokens without exp
+	defaultIntrospectionNegativeCacheTTL = 10 // seconds
+)
+
+var introspectionClient = &http.Client{Timeout: 10 * time.Second}
+
+// introspectionResult holds the fields of an introspection response
+// (RFC 7662) that sessions are built from.
+type introspectionResult struct {
+	Active   bool   `json:"active"`
+	Scope    string `json:"scope"`
+	ClientID string `json:"client_id"`
+	Exp      int64  `json:"exp"`
+	Sub      string `json:"sub"`
+}
+
+// IntrospectionMW validates bearer tokens against the API's introspection
+// endpoint. Active tokens are cached until they expire and inactive ones
+// for a short while, so the endpoint isn't called on every request.
+type IntrospectionMW struct {
+	*BaseMiddleware
+	cache *cache.Cache
+}
+
+func (k *IntrospectionMW) Name() string {
+	return "IntrospectionMW"
+}
+
+func (k *IntrospectionMW) Init() {
+	k.cache = cache.New(defaultIntrospectionCacheTTL*time.Second, time.Minute)
+}
+
+func (k *IntrospectionMW) ProcessRequest(w http.ResponseWriter, r *http.Request, _ interface{}) (error, int) {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) < 2 {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": requestIP(r),
+		}).Info("Attempted access with malformed header, no auth header found.")
+
+		return errors.New("Authorization field missing"), 400
+	}
+	if strings.ToLower(parts[0]) != "bearer" {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": requestIP(r),
+		}).Info("Bearer token malformed")
+
+		return errors.New("Bearer token malformed"), 400
+	}
+	accessToken := parts[1]
+
+	result, err := k.introspect(accessToken)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": introspectionPrefix,
+			"url":    k.Spec.IntrospectionOptions.URL,
+		}).Error("Token introspection failed: ", err)
+		return errors.New("Token could not be validated"), 503
+	}
+	if !result.Active || (result.Exp > 0 && result.Exp <= time.Now().Unix()) {
+		k.reportLoginFailure(accessToken, r)
+		return errors.New("Key not authorised"), 403
+	}
+
+	// The session isn't stored under the token itself, so that it can't
+	// be used as a plain key once the token has been revoked
+	sessionID := introspectionSessionID(k.Spec.OrgID, accessToken)
+	session, exists := k.CheckSessionAndIdentityForValidKey(sessionID)
+	if !exists {
+		session, err = k.sessionFromResult(result)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": introspectionPrefix,
+			}).Error("Could not create a session for the token: ", err)
+			k.reportLoginFailure(accessToken, r)
+			return errors.New("Key not authorized: no matching policy"), 403
+		}
+
+		// Update the session in the session manager in case it gets called again
+		k.Spec.SessionManager.UpdateSession(sessionID, &session, getLifetime(k.Spec, &session))
+	}
+
+	switch k.Spec.BaseIdentityProvidedBy {
+	case apidef.IntrospectedToken, apidef.UnsetAuth:
+		ctxSetSession(r, &session)
+		ctxSetAuthToken(r, sessionID)
+	}
+
+	return nil, 200
+}
+
+// introspectionSessionID is the ID the session of an introspected token
+// is stored under, only IntrospectionMW looks it up.
+func introspectionSessionID(orgID, accessToken string) string {
+	return orgID + introspectionPrefix + "-" + sessionCacheKey(accessToken)
+}
+
+// introspect returns the cached result for a token, or asks the
+// introspection endpoint.
+func (k *IntrospectionMW) introspect(accessToken string) (*introspectionResult, error) {
+	cacheKey := sessionCacheKey(accessToken)
+	if cached, found := k.cache.Get(cacheKey); found {
+		return cached.(*introspectionResult), nil
+	}
+
+	result, err := k.fetchIntrospection(accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := k.Spec.IntrospectionOptions
+	var ttl time.Duration
+	if result.Active {
+		ttl = defaultIntrospectionCacheTTL * time.Second
+		if result.Exp > 0 {
+			ttl = time.Until(time.Unix(result.Exp, 0))
+		}
+		if opts.CacheTTL > 0 && time.Duration(opts.CacheTTL)*time.Second < ttl {
+			ttl = time.Duration(opts.CacheTTL) * time.Second
+		}
+	} else {
+		ttl = defaultIntrospectionNegativeCacheTTL * time.Second
+		if opts.NegativeCacheTTL > 0 {
+			ttl = time.Duration(opts.NegativeCacheTTL) * time.Second
+		}
+	}
+	if ttl > 0 {
+		k.cache.Set(cacheKey, result, ttl)
+	}
+	return result, nil
+}
+
+func (k *IntrospectionMW) fetchIntrospection(accessToken string) (*introspectionResult, error) {
+	opts := k.Spec.IntrospectionOptions
+	form := url.Values{
+		"token":           {accessToken},
+		"token_type_hint": {"access_token"},
+	}
+	req, err := http.NewRequest("POST", opts.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(opts.ClientID), url.QueryEscape(opts.ClientSecret))
+
+	resp, err := introspectionClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection request returned %d", resp.StatusCode)
+	}
+
+	result := &introspectionResult{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// sessionFromResult creates a session from the policies the token's
+// scopes map to, or else from the API's introspection policy.
+func (k *IntrospectionMW) sessionFromResult(result *introspectionResult) (SessionState, error) {
+	opts := k.Spec.IntrospectionOptions
+	var session SessionState
+	var err error
+	if policyIDs := mapScopes(opts.ScopeToPolicyMapping, []string{result.Scope}); len(policyIDs) > 0 {
+		session, err = generateSessionFromPolicies(policyIDs, k.Spec.OrgID, true)
+	} else if opts.PolicyID != "" {
+		session, err = generateSessionFromPolicy(opts.PolicyID, k.Spec.OrgID, true)
+	} else {
+		err = errors.New("no policy matches the token")
+	}
+	if err != nil {
+		return session, err
+	}
+
+	if result.Exp > 0 {
+		session.Expires = result.Exp
+	}
+	session.MetaData = map[string]string{
+		"client_id": result.ClientID,
+		"sub":       result.Sub,
+		"scope":     result.Scope,
+	}
+	session.Alias = result.Sub
+	if session.Alias == "" {
+		session.Alias = result.ClientID
+	}
+	return session, nil
+}
+
+func (k *IntrospectionMW) reportLoginFailure(tykId string, r *http.Request) {
+	log.WithFields(logrus.Fields{
+		"prefix": introspectionPrefix,
+		"path":   r.URL.Path,
+		"origin": requestIP(r),
+	}).Info("Attempted access with inactive token.")
+
+	// Fire Authfailed Event
+	AuthFailed(k.BaseMiddleware, r, tykId)
+
+	// Report in health check
+	ReportHealthCheckValue(k.Spec.Health, KeyFailure, "1")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/justinas/alice"
+)
+
+const introspectionDef = `{
+	"api_id": "introspection",
+	"org_id": "default",
+	"use_introspection": true,
+	"version_data": {
+		"not_versioned": true,
+		"versions": {
+			"Default": {
+				"name": "Default"
+			}
+		}
+	},
+	"proxy": {
+		"listen_path": "/introspection_test",
+		"target_url": "` + testHttpAny + `"
+	}
+}`
+
+func getIntrospectionChain(spec *APISpec) http.Handler {
+	remote, _ := url.Parse(testHttpAny)
+	proxy := TykNewSingleHostReverseProxy(remote, spec)
+	proxyHandler := ProxyHandler(proxy, spec)
+	baseMid := &BaseMiddleware{spec, proxy}
+	chain := alice.New(
+		CreateMiddleware(&IntrospectionMW{BaseMiddleware: baseMid}),
+		CreateMiddleware(&KeyExpired{baseMid}),
+		CreateMiddleware(&AccessRightsCheck{baseMid}),
+		CreateMiddleware(&RateLimitAndQuotaCheck{baseMid})).Then(proxyHandler)
+
+	return chain
+}
+
+func TestIntrospection(t *testing.T) {
+	activeToken := testKey(t, "active")
+	inactiveToken := testKey(t, "inactive")
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if user, pass, _ := r.BasicAuth(); user != "gateway" || pass != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+		resp := introspectionResult{}
+		if r.FormValue("token") == activeToken {
+			resp = introspectionResult{
+				Active:   true,
+				Scope:    "read",
+				ClientID: "client",
+				Sub:      "user",
+				Exp:      time.Now().Add(time.Hour).Unix(),
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	spec := createSpecTest(t, introspectionDef)
+	spec.IntrospectionOptions.URL = server.URL
+	spec.IntrospectionOptions.ClientID = "gateway"
+	spec.IntrospectionOptions.ClientSecret = "secret"
+	spec.IntrospectionOptions.ScopeToPolicyMapping = map[string]string{"read": "introspection-read"}
+
+	policiesMu.Lock()
+	policiesByID["introspection-read"] = Policy{
+		ID:               "introspection-read",
+		OrgID:            "default",
+		Rate:             1000,
+		Per:              1,
+		QuotaMax:         -1,
+		QuotaRenewalRate: -1,
+		AccessRights: map[string]AccessDefinition{
+			"introspection": {APIID: "introspection", Versions: []string{"Default"}},
+		},
+		Active: true,
+	}
+	policiesMu.Unlock()
+
+	chain := getIntrospectionChain(spec)
+	request := func(token string) int {
+		recorder := httptest.NewRecorder()
+		req := testReq(t, "GET", "/introspection_test/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		chain.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := request(activeToken); code != 200 {
+			t.Fatal("Request with active token failed: ", code)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("wanted active token introspected once, got %d calls", n)
+	}
+	session, _ := spec.SessionManager.SessionDetail(introspectionSessionID(spec.OrgID, activeToken))
+	if session.MetaData["client_id"] != "client" || session.Alias != "user" {
+		t.Errorf("wanted session for client and user, got %v %q", session.MetaData, session.Alias)
+	}
+	// The token can't be used as a plain key
+	if _, found := spec.SessionManager.SessionDetail(activeToken); found {
+		t.Error("wanted no session stored under the token itself")
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := request(inactiveToken); code != 403 {
+			t.Fatal("wanted 403 for inactive token, got ", code)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("wanted inactive token introspected once, got %d calls", n)
+	}
+
+	// Endpoint errors aren't cached
+	spec.IntrospectionOptions.ClientSecret = "wrong"
+	for i := 0; i < 2; i++ {
+		if code := request(testKey(t, "other")); code != 503 {
+			t.Fatal("wanted 503 when introspection fails, got ", code)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Errorf("wanted failed introspections to be retried, got %d calls", n)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+)
+
+// IPBlackListMiddleware lets you define a list of IPs to deny access
+// to the API, for all versions or for a single one. Both lists are only
+// checked with EnableIpBlacklisting set.
+type IPBlackListMiddleware struct {
+	*BaseMiddleware
+}
+
+func (i *IPBlackListMiddleware) Name() string {
+	return "IPBlackListMiddleware"
+}
+
+func (i *IPBlackListMiddleware) IsEnabledForSpec() bool {
+	if !i.Spec.EnableIpBlacklisting {
+		return false
+	}
+	if len(i.Spec.BlacklistedIPs) > 0 {
+		return true
+	}
+	for _, version := range i.Spec.VersionData.Versions {
+		if len(version.BlacklistedIPs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (i *IPBlackListMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, _ interface{}) (error, int) {
+	// Disabled, pass through
+	if !i.IsEnabledForSpec() {
+		return nil, 200
+	}
+
+	remoteIP := net.ParseIP(requestIP(r))
+
+	if ip, found := matchIPList(remoteIP, i.Spec.BlacklistedIPs); found {
+		accessRuleFailed(i.BaseMiddleware, r, remoteIP.String(), "blacklisted_ips: "+ip)
+		return errors.New("Access from this IP has been disallowed"), 403
+	}
+
+	// Version rules apply on top of the API's, if the version is
+	// unknown the version check will reject the request anyway
+	if version, _, _, stat := i.Spec.Version(r); stat == StatusOk {
+		if ip, found := matchIPList(remoteIP, version.BlacklistedIPs); found {
+			accessRuleFailed(i.BaseMiddleware, r, remoteIP.String(), "version "+version.Name+" blacklisted_ips: "+ip)
+			return errors.New("Access from this IP has been disallowed"), 403
+		}
+	}
+
+	return nil, 200
+}
+
+// accessRuleFailed fires an auth failure event naming the access rule
+// that rejected a request.
+func accessRuleFailed(m *BaseMiddleware, r *http.Request, origin, rule string) {
+	m.FireEvent(EventAuthFailure, EventAuthFailureMeta{
+		EventMetaDefault: EventMetaDefault{Message: "Access rule matched", OriginatingRequest: EncodeRequestToEvent(r)},
+		Path:             r.URL.Path,
+		Origin:           origin,
+		Key:              origin,
+		Rule:             rule,
+	})
+	// Report in health check
+	ReportHealthCheckValue(m.Spec.Health, KeyFailure, "-1")
+}
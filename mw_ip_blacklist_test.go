@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/TykTechnologies/tyk/apidef"
+	"github.com/TykTechnologies/tyk/config"
+)
+
+const ipBlacklistTestDefinition = `{
+	"api_id": "ip-blacklist",
+	"use_keyless": true,
+	"definition": {
+		"location": "header",
+		"key": "version"
+	},
+	"version_data": {
+		"versions": {
+			"v1": {"name": "v1"},
+			"v2": {"name": "v2", "blacklisted_ips": ["192.168.0.0/16"]}
+		}
+	},
+	"proxy": {
+		"listen_path": "/",
+		"target_url": "` + testHttpAny + `"
+	},
+	"enable_ip_blacklisting": true,
+	"blacklisted_ips": ["10.0.0.1", "172.16.0.0/12"]
+}`
+
+// eventCollector is an event handler that hands events to a channel
+type eventCollector chan config.EventMessage
+
+func (c eventCollector) Init(interface{}) error { return nil }
+
+func (c eventCollector) HandleEvent(em config.EventMessage) { c <- em }
+
+func collectEvents(spec *APISpec, event apidef.TykEvent) eventCollector {
+	events := make(eventCollector, 10)
+	spec.EventPaths = map[apidef.TykEvent][]config.TykEventHandler{
+		event: {events},
+	}
+	return events
+}
+
+func TestIPBlackListMiddleware(t *testing.T) {
+	spec := createSpecTest(t, ipBlacklistTestDefinition)
+	events := collectEvents(spec, EventAuthFailure)
+	router := mux.NewRouter()
+	loadApps([]*APISpec{spec}, router)
+
+	for _, tc := range []struct {
+		remote, version string
+		wantCode        int
+		wantRule        string
+	}{
+		{"10.0.0.1:80", "v1", 403, "blacklisted_ips: 10.0.0.1"},
+		{"10.0.0.2:80", "v1", 200, ""},
+		{"172.17.0.1:80", "v1", 403, "blacklisted_ips: 172.16.0.0/12"},
+		{"192.168.1.1:80", "v1", 200, ""},
+		{"192.168.1.1:80", "v2", 403, "version v2 blacklisted_ips: 192.168.0.0/16"},
+	} {
+		rec := httptest.NewRecorder()
+		req := testReq(t, "GET", "/", nil)
+		req.RemoteAddr = tc.remote
+		req.Header.Set("version", tc.version)
+		router.ServeHTTP(rec, req)
+		if rec.Code != tc.wantCode {
+			t.Errorf("%s %s: wanted %d, got %d", tc.remote, tc.version, tc.wantCode, rec.Code)
+		}
+		if tc.wantRule == "" {
+			continue
+		}
+		select {
+		case em := <-events:
+			meta := em.Meta.(EventAuthFailureMeta)
+			if meta.Rule != tc.wantRule {
+				t.Errorf("%s %s: wanted rule %q, got %q", tc.remote, tc.version, tc.wantRule, meta.Rule)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s %s: wanted an auth failure event", tc.remote, tc.version)
+		}
+	}
+}
+
+func TestIPBlackListNeedsFlag(t *testing.T) {
+	spec := createSpecTest(t, ipBlacklistTestDefinition)
+	spec.EnableIpBlacklisting = false
+	mw := &IPBlackListMiddleware{BaseMiddleware: &BaseMiddleware{spec, nil}}
+	// Version lists are set too, but the API hasn't enabled blacklisting
+	if mw.IsEnabledForSpec() {
+		t.Fatal("wanted blacklists to be ignored without enable_ip_blacklisting")
+	}
+}
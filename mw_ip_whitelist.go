@@ -29,7 +29,24 @@ func (i *IPWhiteListMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Re
 	remoteIP := net.ParseIP(requestIP(r))
 
 	// Enabled, check incoming IP address
-	for _, ip := range i.Spec.AllowedIPs {
+	if _, found := matchIPList(remoteIP, i.Spec.AllowedIPs); found {
+		// matched, pass through
+		return nil, 200
+	}
+
+	// Fire Authfailed Event
+	AuthFailed(i.BaseMiddleware, r, remoteIP.String())
+	// Report in health check
+	ReportHealthCheckValue(i.Spec.Health, KeyFailure, "-1")
+
+	// Not matched, fail
+	return errors.New("Access from this IP has been disallowed"), 403
+}
+
+// matchIPList returns the first entry of a list of IPs and CIDR ranges
+// that matches an address.
+func matchIPList(remoteIP net.IP, list []string) (string, bool) {
+	for _, ip := range list {
 		// Might be CIDR, try this one first then fallback to IP parsing later
 		allowedIP, allowedNet, err := net.ParseCIDR(ip)
 		if err != nil {
@@ -38,22 +55,13 @@ func (i *IPWhiteListMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Re
 
 		// Check CIDR if possible
 		if allowedNet != nil && allowedNet.Contains(remoteIP) {
-			// matched, pass through
-			return nil, 200
+			return ip, true
 		}
 
 		// We parse the IP to manage IPv4 and IPv6 easily
 		if allowedIP.Equal(remoteIP) {
-			// matched, pass through
-			return nil, 200
+			return ip, true
 		}
 	}
-
-	// Fire Authfailed Event
-	AuthFailed(i.BaseMiddleware, r, remoteIP.String())
-	// Report in health check
-	ReportHealthCheckValue(i.Spec.Health, KeyFailure, "-1")
-
-	// Not matched, fail
-	return errors.New("Access from this IP has been disallowed"), 403
+	return "", false
 }
@@ -3,31 +3,28 @@ package main
 import (
 	"crypto/md5"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"strings"
+	"regexp"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/dgrijalva/jwt-go"
-	"github.com/pmylund/go-cache"
 
 	"github.com/TykTechnologies/tyk/apidef"
 )
 
 type JWTMiddleware struct {
 	*BaseMiddleware
+	// claimPatterns holds the compiled regex claim matchers by index
+	claimPatterns []*regexp.Regexp
 }
 
 func (k *JWTMiddleware) Name() string {
 	return "JWTMiddleware"
 }
 
-var JWKCache *cache.Cache
-
 type JWK struct {
 	Alg string   `json:"alg"`
 	Kty string   `json:"kty"`
@@ -35,6 +32,9 @@ type JWK struct {
 	X5c []string `json:"x5c"`
 	N   string   `json:"n"`
 	E   string   `json:"e"`
+	Crv string   `json:"crv"`
+	X   string   `json:"x"`
+	Y   string   `json:"y"`
 	KID string   `json:"kid"`
 	X5t string   `json:"x5t"`
 }
@@ -43,63 +43,20 @@ type JWKs struct {
 	Keys []JWK `json:"keys"`
 }
 
-func (k *JWTMiddleware) getSecretFromURL(url, kid, keyType string) ([]byte, error) {
-	// Implement a cache
-	if JWKCache == nil {
-		log.Debug("Creating JWK Cache")
-		JWKCache = cache.New(240*time.Second, 30*time.Second)
-	}
-
-	var jwkSet JWKs
-	cachedJWK, found := JWKCache.Get(k.Spec.APIID)
-	if !found {
-		// Get the JWK
-		log.Debug("Pulling JWK")
-		response, err := http.Get(url)
-		if err != nil {
-			log.Error("Failed to get resource URL: ", err)
-			return nil, err
-		}
-
-		// Decode it
-		defer response.Body.Close()
-		contents, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			log.Error("Failed to read body data: ", err)
-			return nil, err
-		}
-
-		if err := json.Unmarshal(contents, &jwkSet); err != nil {
-			log.Error("Failed to decode body JWK: ", err)
-			return nil, err
-		}
-
-		// Cache it
-		log.Debug("Caching JWK")
-		JWKCache.Set(k.Spec.APIID, jwkSet, cache.DefaultExpiration)
-	} else {
-		jwkSet = cachedJWK.(JWKs)
-	}
-
-	log.Debug("Checking JWKs...")
-	for _, val := range jwkSet.Keys {
-		if val.KID != kid || strings.ToLower(val.Kty) != strings.ToLower(keyType) {
-			continue
-		}
-		if len(val.X5c) > 0 {
-			// Use the first cert only
-			decodedCert, err := base64.StdEncoding.DecodeString(val.X5c[0])
-			if err != nil {
-				return nil, err
-			}
-			log.Debug("Found cert! Replying...")
-			log.Debug("Cert was: ", string(decodedCert))
-			return decodedCert, nil
-		}
-		return nil, errors.New("no certificates in JWK")
+// getKeyFromURL returns the public key a token was signed with from the
+// API's JWKS.
+func (k *JWTMiddleware) getKeyFromURL(token *jwt.Token) (interface{}, error) {
+	var keyType string
+	switch k.Spec.JWTSigningMethod {
+	case "rsa":
+		keyType = "RSA"
+	case "ecdsa":
+		keyType = "EC"
+	default:
+		return nil, errors.New("JWKS sources need the rsa or ecdsa signing method")
 	}
-
-	return nil, errors.New("No matching KID could be found")
+	kid, _ := token.Header["kid"].(string)
+	return jwksKeys.key(k.Spec.JWTSource, kid, keyType)
 }
 
 func (k *JWTMiddleware) getIdentityFomToken(token *jwt.Token) (string, bool) {
@@ -127,17 +84,7 @@ func (k *JWTMiddleware) getSecret(token *jwt.Token) ([]byte, error) {
 	// Check for central JWT source
 	if config.JWTSource != "" {
 
-		// Is it a URL?
-		if httpScheme.MatchString(config.JWTSource) {
-			secret, err := k.getSecretFromURL(config.JWTSource, token.Header["kid"].(string), k.Spec.JWTSigningMethod)
-			if err != nil {
-				return nil, err
-			}
-
-			return secret, nil
-		}
-
-		// If not, return the actual value
+		// If not a URL, return the actual value
 		decodedCert, err := base64.StdEncoding.DecodeString(config.JWTSource)
 		if err != nil {
 			return nil, err
@@ -219,21 +166,30 @@ func (k *JWTMiddleware) processCentralisedJWT(r *http.Request, token *jwt.Token)
 
 	log.Debug("JWT Temporary session ID is: ", sessionID)
 
+	// Policies mapped from the token's scopes take precedence
+	scopePolicies := scopePolicyIDs(k.Spec, token.Claims.(jwt.MapClaims))
+
 	session, exists := k.CheckSessionAndIdentityForValidKey(sessionID)
 	if !exists {
 		// Create it
 		log.Debug("Key does not exist, creating")
 		session = SessionState{}
 
-		// We need a base policy as a template, either get it from the token itself OR a proxy client ID within Tyk
-		basePolicyID, foundPolicy := k.getBasePolicyID(token)
-		if !foundPolicy {
-			return errors.New("Key not authorized: no matching policy found"), 403
-		}
+		var newSession SessionState
+		var err error
+		if len(scopePolicies) > 0 {
+			newSession, err = generateSessionFromPolicies(scopePolicies, k.Spec.OrgID, true)
+		} else {
+			// We need a base policy as a template, either get it from the token itself OR a proxy client ID within Tyk
+			basePolicyID, foundPolicy := k.getBasePolicyID(token)
+			if !foundPolicy {
+				return errors.New("Key not authorized: no matching policy found"), 403
+			}
 
-		newSession, err := generateSessionFromPolicy(basePolicyID,
-			k.Spec.OrgID,
-			true)
+			newSession, err = generateSessionFromPolicy(basePolicyID,
+				k.Spec.OrgID,
+				true)
+		}
 
 		if err == nil {
 			session = newSession
@@ -259,6 +215,15 @@ func (k *JWTMiddleware) processCentralisedJWT(r *http.Request, token *jwt.Token)
 	}
 
 	log.Debug("Key found")
+	var basePolicyID string
+	if len(scopePolicies) == 0 && len(session.ApplyPolicies) > 0 {
+		basePolicyID, _ = k.getBasePolicyID(token)
+	}
+	if err := k.applyScopePolicies(sessionID, &session, scopePolicies, basePolicyID); err != nil {
+		k.reportLoginFailure(baseFieldData, r)
+		log.Error("Could not apply the policies of this token: ", err)
+		return errors.New("Key not authorized: no matching policy"), 403
+	}
 	switch k.Spec.BaseIdentityProvidedBy {
 	case apidef.JWTClaim, apidef.UnsetAuth:
 		ctxSetSession(r, &session)
@@ -337,7 +302,9 @@ func (k *JWTMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, _
 	rawJWT = stripBearer(rawJWT)
 
 	// Verify the token
-	token, err := jwt.Parse(rawJWT, func(token *jwt.Token) (interface{}, error) {
+	// Time based claims are checked with the API's leeway below
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(rawJWT, func(token *jwt.Token) (interface{}, error) {
 		// Don't forget to validate the alg is what you expect:
 		switch k.Spec.JWTSigningMethod {
 		case "hmac":
@@ -359,6 +326,11 @@ func (k *JWTMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, _
 			}
 		}
 
+		// Keys from a JWKS URL are already parsed
+		if k.Spec.JWTSource != "" && httpScheme.MatchString(k.Spec.JWTSource) {
+			return k.getKeyFromURL(token)
+		}
+
 		val, err := k.getSecret(token)
 		if err != nil {
 			log.Error("Couldn't get token: ", err)
@@ -378,6 +350,16 @@ func (k *JWTMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, _
 	})
 
 	if err == nil && token.Valid {
+		if claimErr := k.validateClaims(token.Claims.(jwt.MapClaims)); claimErr != nil {
+			log.WithFields(logrus.Fields{
+				"path":   r.URL.Path,
+				"origin": requestIP(r),
+				"rule":   claimErr.rule,
+			}).Info("JWT claim validation failed: ", claimErr)
+			k.reportClaimFailure(r, token, claimErr.rule)
+			return claimErr, 403
+		}
+
 		// Token is valid - let's move on
 
 		// Are we mapping to a central JWT Secret?
@@ -450,8 +432,11 @@ func generateSessionFromPolicy(policyID, orgID string, enforceOrg bool) (Session
 	session.Allowance = policy.Rate // This is a legacy thing, merely to make sure output is consistent. Needs to be purged
 	session.Rate = policy.Rate
 	session.Per = policy.Per
+	session.MaxConcurrent = policy.MaxConcurrent
 	session.QuotaMax = policy.QuotaMax
 	session.QuotaRenewalRate = policy.QuotaRenewalRate
+	session.QuotaSchedule = policy.QuotaSchedule
+	setQuotaWindows(&session, policy.QuotaWindows)
 	session.AccessRights = policy.AccessRights
 	session.HMACEnabled = policy.HMACEnabled
 	session.IsInactive = policy.IsInactive
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	jwtMatchExact    = "exact"
+	jwtMatchRegex    = "regex"
+	jwtMatchOneOf    = "one_of"
+	jwtMatchContains = "contains"
+)
+
+// jwtClaimError is a failed claim check, rule names the check for the
+// auth failure event.
+type jwtClaimError struct {
+	rule string
+	msg  string
+}
+
+func (e *jwtClaimError) Error() string {
+	return e.msg
+}
+
+func (k *JWTMiddleware) Init() {
+	k.claimPatterns = make([]*regexp.Regexp, len(k.Spec.JWTClaimMatchers))
+	for i, matcher := range k.Spec.JWTClaimMatchers {
+		switch matcher.Match {
+		case jwtMatchExact, jwtMatchOneOf, jwtMatchContains:
+		case jwtMatchRegex:
+			pattern, err := regexp.Compile(matcher.Value)
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					"prefix": "jwt",
+					"claim":  matcher.Claim,
+				}).Error("Invalid claim matcher regex, the claim will never match: ", err)
+				continue
+			}
+			k.claimPatterns[i] = pattern
+		default:
+			log.WithFields(logrus.Fields{
+				"prefix": "jwt",
+				"claim":  matcher.Claim,
+			}).Error("Unknown claim matcher ", matcher.Match, ", the claim will never match")
+		}
+	}
+}
+
+// validateClaims applies the time based checks with the API's leeway,
+// then the API's issuer, audience and claim rules.
+func (k *JWTMiddleware) validateClaims(claims jwt.MapClaims) *jwtClaimError {
+	now := time.Now().Unix()
+	leeway := k.Spec.JWTLeeway
+	if exp, ok := claimInt(claims["exp"]); ok && now > exp+leeway {
+		return &jwtClaimError{"exp", "Token has expired"}
+	}
+	if nbf, ok := claimInt(claims["nbf"]); ok && now+leeway < nbf {
+		return &jwtClaimError{"nbf", "Token is not valid yet"}
+	}
+	if iat, ok := claimInt(claims["iat"]); ok && now+leeway < iat {
+		return &jwtClaimError{"iat", "Token used before issued"}
+	}
+
+	if len(k.Spec.JWTAllowedIssuers) > 0 {
+		iss, _ := claims["iss"].(string)
+		if !stringInSlice(iss, k.Spec.JWTAllowedIssuers) {
+			return &jwtClaimError{"jwt_allowed_issuers", "Token issuer is not allowed"}
+		}
+	}
+
+	if len(k.Spec.JWTAllowedAudiences) > 0 {
+		allowed := false
+		for _, aud := range claimStrings(claims["aud"]) {
+			if stringInSlice(aud, k.Spec.JWTAllowedAudiences) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &jwtClaimError{"jwt_allowed_audiences", "Token audience is not allowed"}
+		}
+	}
+
+	for _, name := range k.Spec.JWTRequiredClaims {
+		if claims[name] == nil {
+			return &jwtClaimError{"jwt_required_claims: " + name, "Token is missing required claim " + name}
+		}
+	}
+
+	for i, matcher := range k.Spec.JWTClaimMatchers {
+		if !k.claimMatches(i, claims[matcher.Claim]) {
+			return &jwtClaimError{
+				"jwt_claim_matchers: " + matcher.Claim + " " + matcher.Match,
+				"Token claim " + matcher.Claim + " does not match",
+			}
+		}
+	}
+	return nil
+}
+
+func (k *JWTMiddleware) claimMatches(i int, value interface{}) bool {
+	matcher := k.Spec.JWTClaimMatchers[i]
+	if matcher.Match == jwtMatchContains {
+		values, ok := value.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, v := range values {
+			if s, ok := claimString(v); ok && s == matcher.Value {
+				return true
+			}
+		}
+		return false
+	}
+
+	s, ok := claimString(value)
+	if !ok {
+		return false
+	}
+	switch matcher.Match {
+	case jwtMatchExact:
+		return s == matcher.Value
+	case jwtMatchRegex:
+		return i < len(k.claimPatterns) && k.claimPatterns[i] != nil && k.claimPatterns[i].MatchString(s)
+	case jwtMatchOneOf:
+		return stringInSlice(s, matcher.Values)
+	}
+	return false
+}
+
+func (k *JWTMiddleware) reportClaimFailure(r *http.Request, token *jwt.Token, rule string) {
+	tykId, _ := k.getIdentityFomToken(token)
+	k.FireEvent(EventAuthFailure, EventAuthFailureMeta{
+		EventMetaDefault: EventMetaDefault{Message: "JWT claim validation failed", OriginatingRequest: EncodeRequestToEvent(r)},
+		Path:             r.URL.Path,
+		Origin:           requestIP(r),
+		Key:              tykId,
+		Rule:             rule,
+	})
+
+	// Report in health check
+	ReportHealthCheckValue(k.Spec.Health, KeyFailure, "1")
+}
+
+// claimString returns a scalar claim as a string.
+func claimString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// claimStrings returns a claim holding a string or an array of them,
+// like aud.
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func claimInt(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return int64(v), true
+	case json.Number:
+		i, err := v.Int64()
+		if err != nil {
+			f, err := v.Float64()
+			return int64(f), err == nil
+		}
+		return i, true
+	}
+	return 0, false
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"crypto/md5"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/justinas/alice"
+
+	"github.com/TykTechnologies/tyk/apidef"
 )
 
 const jwtDef = `{
@@ -186,7 +191,7 @@ func getJWTChain(spec *APISpec) http.Handler {
 	baseMid := &BaseMiddleware{spec, proxy}
 	chain := alice.New(
 		CreateMiddleware(&IPWhiteListMiddleware{baseMid}),
-		CreateMiddleware(&JWTMiddleware{baseMid}),
+		CreateMiddleware(&JWTMiddleware{BaseMiddleware: baseMid}),
 		CreateMiddleware(&VersionCheck{BaseMiddleware: baseMid}),
 		CreateMiddleware(&KeyExpired{baseMid}),
 		CreateMiddleware(&AccessRightsCheck{baseMid}),
@@ -704,3 +709,293 @@ func TestJWTSessionRSAWithJWK(t *testing.T) {
 		t.Error("Initial request failed with non-200 code, should have passed!: ", recorder.Code)
 	}
 }
+
+func TestJWTClaimValidation(t *testing.T) {
+	tokenKID := testKey(t, "token")
+	spec := createSpecTest(t, jwtDef)
+	spec.JWTSigningMethod = "hmac"
+	spec.JWTAllowedIssuers = []string{"https://idp.example.com"}
+	spec.JWTAllowedAudiences = []string{"gateway", "billing"}
+	spec.JWTLeeway = 30
+	spec.JWTRequiredClaims = []string{"sub"}
+	spec.JWTClaimMatchers = []apidef.JWTClaimMatcher{
+		{Claim: "tenant", Match: "exact", Value: "acme"},
+		{Claim: "email", Match: "regex", Value: `@example\.com$`},
+		{Claim: "tier", Match: "one_of", Values: []string{"gold", "silver"}},
+		{Claim: "groups", Match: "contains", Value: "admins"},
+	}
+	events := collectEvents(spec, EventAuthFailure)
+	session := createJWTSession()
+	spec.SessionManager.UpdateSession(tokenKID, session, 60)
+	chain := getJWTChain(spec)
+
+	now := time.Now()
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":    "https://idp.example.com",
+			"aud":    []interface{}{"other", "billing"},
+			"sub":    "user",
+			"exp":    now.Add(time.Hour).Unix(),
+			"tenant": "acme",
+			"email":  "user@example.com",
+			"tier":   "gold",
+			"groups": []interface{}{"users", "admins"},
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		modify   func(jwt.MapClaims)
+		wantRule string
+		wantErr  string
+	}{
+		{"valid", func(jwt.MapClaims) {}, "", ""},
+		{"nbf within leeway", func(c jwt.MapClaims) { c["nbf"] = now.Add(20 * time.Second).Unix() }, "", ""},
+		{"expired within leeway", func(c jwt.MapClaims) { c["exp"] = now.Add(-20 * time.Second).Unix() }, "", ""},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = now.Add(-time.Minute).Unix() },
+			"exp", "Token has expired"},
+		{"not yet valid", func(c jwt.MapClaims) { c["nbf"] = now.Add(time.Minute).Unix() },
+			"nbf", "Token is not valid yet"},
+		{"issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" },
+			"jwt_allowed_issuers", "Token issuer is not allowed"},
+		{"audience", func(c jwt.MapClaims) { c["aud"] = "other" },
+			"jwt_allowed_audiences", "Token audience is not allowed"},
+		{"required", func(c jwt.MapClaims) { delete(c, "sub") },
+			"jwt_required_claims: sub", "Token is missing required claim sub"},
+		{"exact", func(c jwt.MapClaims) { c["tenant"] = "umbrella" },
+			"jwt_claim_matchers: tenant exact", "Token claim tenant does not match"},
+		{"regex", func(c jwt.MapClaims) { c["email"] = "user@example.com.evil" },
+			"jwt_claim_matchers: email regex", "Token claim email does not match"},
+		{"one of", func(c jwt.MapClaims) { c["tier"] = "bronze" },
+			"jwt_claim_matchers: tier one_of", "Token claim tier does not match"},
+		{"contains", func(c jwt.MapClaims) { c["groups"] = []interface{}{"users"} },
+			"jwt_claim_matchers: groups contains", "Token claim groups does not match"},
+	} {
+		claims := validClaims()
+		tc.modify(claims)
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		token.Header["kid"] = tokenKID
+		tokenString, err := token.SignedString([]byte(jwtSecret))
+		if err != nil {
+			t.Fatal("Couldn't create JWT token: ", err)
+		}
+
+		recorder := httptest.NewRecorder()
+		req := testReq(t, "GET", "/jwt_test/", nil)
+		req.Header.Set("authorization", tokenString)
+		chain.ServeHTTP(recorder, req)
+
+		if tc.wantRule == "" {
+			if recorder.Code != 200 {
+				t.Errorf("%s: wanted 200, got %d", tc.name, recorder.Code)
+			}
+			continue
+		}
+		if recorder.Code != 403 || !strings.Contains(recorder.Body.String(), tc.wantErr) {
+			t.Errorf("%s: wanted 403 %q, got %d %q", tc.name, tc.wantErr, recorder.Code, recorder.Body.String())
+		}
+		select {
+		case em := <-events:
+			if rule := em.Meta.(EventAuthFailureMeta).Rule; rule != tc.wantRule {
+				t.Errorf("%s: wanted rule %q, got %q", tc.name, tc.wantRule, rule)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: wanted an auth failure event", tc.name)
+		}
+	}
+}
+
+func TestJWTScopeToPolicyMapping(t *testing.T) {
+	spec := createSpecTest(t, jwtWithCentralDef)
+	spec.JWTSigningMethod = "rsa"
+	spec.JWTScopeClaimName = "scp"
+	spec.JWTScopeToPolicyMapping = map[string]string{
+		"read":  "scope-read",
+		"write": "scope-write",
+	}
+
+	readPolicy := Policy{
+		ID:    "scope-read",
+		OrgID: "default",
+		Rate:  1,
+		Per:   60,
+		AccessRights: map[string]AccessDefinition{
+			"76": {APIID: "76", Versions: []string{"Default"}},
+		},
+		Active: true,
+	}
+	readPolicy.Partitions.Acl = true
+	writePolicy := Policy{
+		ID:               "scope-write",
+		OrgID:            "default",
+		Rate:             100,
+		Per:              1,
+		QuotaMax:         1000,
+		QuotaRenewalRate: 3600,
+		AccessRights: map[string]AccessDefinition{
+			"other": {APIID: "other", Versions: []string{"v1"}},
+		},
+		Active:       true,
+		KeyExpiresIn: 60,
+	}
+	policiesMu.Lock()
+	policiesByID["scope-read"] = readPolicy
+	policiesByID["scope-write"] = writePolicy
+	policiesMu.Unlock()
+
+	userID := testKey(t, "user")
+	sessionID := "default" + fmt.Sprintf("%x", md5.Sum([]byte(userID)))
+	signKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(jwtRSAPrivKey))
+	if err != nil {
+		t.Fatal("Couldn't extract private key: ", err)
+	}
+	chain := getJWTChain(spec)
+
+	request := func(scopes interface{}) int {
+		token := jwt.New(jwt.GetSigningMethod("RS512"))
+		token.Claims.(jwt.MapClaims)["user_id"] = userID
+		token.Claims.(jwt.MapClaims)["scp"] = scopes
+		token.Claims.(jwt.MapClaims)["exp"] = time.Now().Add(time.Hour).Unix()
+		tokenString, err := token.SignedString(signKey)
+		if err != nil {
+			t.Fatal("Couldn't create JWT token: ", err)
+		}
+		recorder := httptest.NewRecorder()
+		req := testReq(t, "GET", "/jwt_test/", nil)
+		req.Header.Set("authorization", "Bearer "+tokenString)
+		chain.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	if code := request("read write unmapped"); code != 200 {
+		t.Fatal("Request with mapped scopes failed: ", code)
+	}
+	session, _ := spec.SessionManager.SessionDetail(sessionID)
+	if want := []string{"scope-read", "scope-write"}; !samePolicies(session.ApplyPolicies, want) {
+		t.Errorf("wanted policies %v, got %v", want, session.ApplyPolicies)
+	}
+	if len(session.AccessRights) != 2 {
+		t.Errorf("wanted access to both APIs, got %v", session.AccessRights)
+	}
+	if session.Rate != 100 || session.Per != 1 || session.QuotaMax != 1000 {
+		t.Errorf("wanted the write policy's limits, got rate %v per %v quota %v",
+			session.Rate, session.Per, session.QuotaMax)
+	}
+
+	// A token with other scopes switches the session to their policies
+	if code := request([]interface{}{"read"}); code != 200 {
+		t.Fatal("Request with changed scopes failed: ", code)
+	}
+	session, _ = spec.SessionManager.SessionDetail(sessionID)
+	if want := []string{"scope-read"}; !samePolicies(session.ApplyPolicies, want) {
+		t.Errorf("wanted policies %v, got %v", want, session.ApplyPolicies)
+	}
+	if _, ok := session.AccessRights["other"]; ok || len(session.AccessRights) != 1 {
+		t.Errorf("wanted access to the read API only, got %v", session.AccessRights)
+	}
+}
+
+func TestMergePoliciesAllowedURLs(t *testing.T) {
+	a := Policy{AccessRights: map[string]AccessDefinition{"api": {
+		APIID:       "api",
+		Versions:    []string{"v1"},
+		AllowedURLs: []AccessSpec{{URL: "/users", Methods: []string{"GET"}}},
+	}}}
+	b := Policy{AccessRights: map[string]AccessDefinition{"api": {
+		APIID:       "api",
+		Versions:    []string{"v2"},
+		AllowedURLs: []AccessSpec{{URL: "/users", Methods: []string{"POST"}}, {URL: "/orders", Methods: []string{"GET"}}},
+	}}}
+	b.Partitions.Acl = true
+
+	session := SessionState{}
+	mergePolicies(&session, []Policy{a, b})
+	access := session.AccessRights["api"]
+	if len(access.Versions) != 2 || len(access.AllowedURLs) != 2 {
+		t.Fatalf("wanted merged versions and URLs, got %+v", access)
+	}
+	if methods := access.AllowedURLs[0].Methods; len(methods) != 2 {
+		t.Errorf("wanted GET and POST on /users, got %v", methods)
+	}
+
+	c := Policy{AccessRights: map[string]AccessDefinition{"api": {APIID: "api", Versions: []string{"v1"}}}}
+	mergePolicies(&session, []Policy{a, c})
+	if urls := session.AccessRights["api"].AllowedURLs; len(urls) != 0 {
+		t.Errorf("wanted no URL restrictions, got %v", urls)
+	}
+}
+
+func TestJWTScopesFallBackToBasePolicy(t *testing.T) {
+	spec := createSpecTest(t, jwtWithCentralDef)
+	spec.JWTSigningMethod = "rsa"
+	spec.JWTScopeToPolicyMapping = map[string]string{"admin": "scope-admin"}
+
+	policiesMu.Lock()
+	policiesByID["scope-admin"] = Policy{
+		ID:    "scope-admin",
+		OrgID: "default",
+		AccessRights: map[string]AccessDefinition{
+			"76":    {APIID: "76", Versions: []string{"Default"}},
+			"admin": {APIID: "admin", Versions: []string{"v1"}},
+		},
+		Active: true,
+	}
+	policiesByID["scope-base"] = Policy{
+		ID:    "scope-base",
+		OrgID: "default",
+		AccessRights: map[string]AccessDefinition{
+			"76": {APIID: "76", Versions: []string{"Default"}},
+		},
+		Active: true,
+	}
+	policiesMu.Unlock()
+
+	userID := testKey(t, "user")
+	sessionID := "default" + fmt.Sprintf("%x", md5.Sum([]byte(userID)))
+	signKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(jwtRSAPrivKey))
+	if err != nil {
+		t.Fatal("Couldn't extract private key: ", err)
+	}
+	chain := getJWTChain(spec)
+
+	request := func(claims jwt.MapClaims) int {
+		token := jwt.New(jwt.GetSigningMethod("RS512"))
+		for name, value := range claims {
+			token.Claims.(jwt.MapClaims)[name] = value
+		}
+		token.Claims.(jwt.MapClaims)["user_id"] = userID
+		token.Claims.(jwt.MapClaims)["exp"] = time.Now().Add(time.Hour).Unix()
+		tokenString, err := token.SignedString(signKey)
+		if err != nil {
+			t.Fatal("Couldn't create JWT token: ", err)
+		}
+		recorder := httptest.NewRecorder()
+		req := testReq(t, "GET", "/jwt_test/", nil)
+		req.Header.Set("authorization", "Bearer "+tokenString)
+		chain.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	if code := request(jwt.MapClaims{"scope": "admin"}); code != 200 {
+		t.Fatal("Request with the admin scope failed: ", code)
+	}
+
+	// A later token for the same subject without the admin scope must
+	// not keep the admin policy
+	if code := request(jwt.MapClaims{"scope": "unmapped", "policy_id": "scope-base"}); code != 200 {
+		t.Fatal("Request without mapped scopes failed: ", code)
+	}
+	session, _ := spec.SessionManager.SessionDetail(sessionID)
+	if len(session.ApplyPolicies) != 0 || session.ApplyPolicyID != "scope-base" {
+		t.Errorf("wanted the base policy, got %v and %q", session.ApplyPolicies, session.ApplyPolicyID)
+	}
+	if _, ok := session.AccessRights["admin"]; ok {
+		t.Errorf("wanted no admin access, got %v", session.AccessRights)
+	}
+
+	// Without a base policy to fall back to, the token is refused
+	request(jwt.MapClaims{"scope": "admin"})
+	if code := request(jwt.MapClaims{"scope": "unmapped"}); code != 403 {
+		t.Errorf("wanted a token without mapped scopes or base policy to be refused, got %d", code)
+	}
+}
@@ -146,7 +146,11 @@ func (k *OpenIDMW) ProcessRequest(w http.ResponseWriter, r *http.Request, _ inte
 		}
 	}
 
-	if policyID == "" {
+	// Policies mapped from the token's scopes take precedence over the
+	// client's policy
+	scopePolicies := scopePolicyIDs(k.Spec, token.Claims.(jwt.MapClaims))
+
+	if policyID == "" && len(scopePolicies) == 0 {
 		log.WithFields(logrus.Fields{
 			"prefix": OIDPREFIX,
 		}).Error("No matching policy found!")
@@ -172,9 +176,15 @@ func (k *OpenIDMW) ProcessRequest(w http.ResponseWriter, r *http.Request, _ inte
 		session = SessionState{}
 
 		// We need a base policy as a template, either get it from the token itself OR a proxy client ID within Tyk
-		newSession, err := generateSessionFromPolicy(policyID,
-			k.Spec.OrgID,
-			true)
+		var newSession SessionState
+		var err error
+		if len(scopePolicies) > 0 {
+			newSession, err = generateSessionFromPolicies(scopePolicies, k.Spec.OrgID, true)
+		} else {
+			newSession, err = generateSessionFromPolicy(policyID,
+				k.Spec.OrgID,
+				true)
+		}
 
 		if err != nil {
 			k.reportLoginFailure(sessionID, r)
@@ -192,6 +202,12 @@ func (k *OpenIDMW) ProcessRequest(w http.ResponseWriter, r *http.Request, _ inte
 		k.Spec.SessionManager.UpdateSession(sessionID, &session, getLifetime(k.Spec, &session))
 		log.Debug("Policy applied to key")
 
+	} else if err := k.applyScopePolicies(sessionID, &session, scopePolicies, policyID); err != nil {
+		k.reportLoginFailure(sessionID, r)
+		log.WithFields(logrus.Fields{
+			"prefix": OIDPREFIX,
+		}).Error("Could not apply the policies of this token: ", err)
+		return errors.New("Key not authorized: no matching policy"), 403
 	}
 
 	// 4. Set session state on context, we will need it later
@@ -72,8 +72,9 @@ func (k *OrganizationMonitor) ProcessRequestLive(w http.ResponseWriter, r *http.
 	}
 
 	// We found a session, apply the quota limiter
-	reason := k.sessionlimiter.ForwardMessage(&session,
+	reason, _ := k.sessionlimiter.ForwardMessage(&session,
 		k.Spec.OrgID,
+		"",
 		k.Spec.OrgSessionManager.GetStore(), false, false)
 
 	k.Spec.OrgSessionManager.UpdateSession(k.Spec.OrgID, &session, getLifetime(k.Spec, &session))
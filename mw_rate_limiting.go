@@ -41,15 +41,17 @@ func (k *RateLimitAndQuotaCheck) handleRateLimitFailure(r *http.Request, token s
 
 	// Report in health check
 	ReportHealthCheckValue(k.Spec.Health, Throttle, "-1")
+	reportRateLimitRejection(k.Spec, r)
 
 	return errors.New("Rate limit exceeded"), 429
 }
 
-func (k *RateLimitAndQuotaCheck) handleQuotaFailure(r *http.Request, token string) (error, int) {
+func (k *RateLimitAndQuotaCheck) handleQuotaFailure(r *http.Request, token, window string) (error, int) {
 	log.WithFields(logrus.Fields{
 		"path":   r.URL.Path,
 		"origin": requestIP(r),
 		"key":    token,
+		"window": window,
 	}).Info("Key quota limit exceeded.")
 
 	// Fire a quota exceeded event
@@ -58,10 +60,12 @@ func (k *RateLimitAndQuotaCheck) handleQuotaFailure(r *http.Request, token strin
 		Path:             r.URL.Path,
 		Origin:           requestIP(r),
 		Key:              token,
+		Window:           window,
 	})
 
 	// Report in health check
 	ReportHealthCheckValue(k.Spec.Health, QuotaViolation, "-1")
+	reportQuotaRejection(k.Spec, r)
 
 	return errors.New("Quota exceeded"), 403
 }
@@ -72,8 +76,25 @@ func (k *RateLimitAndQuotaCheck) ProcessRequest(w http.ResponseWriter, r *http.R
 	token := ctxGetAuthToken(r)
 
 	storeRef := k.Spec.SessionManager.GetStore()
-	reason := sessionLimiter.ForwardMessage(session,
+
+	// Endpoint rate limits are counted separately for each key. They are
+	// checked before the key's own rate limit and quota, so that those
+	// aren't used up by requests the endpoint limit rejects. Requests the
+	// key's limits reject still count against the endpoint limit.
+	if !k.Spec.DisableRateLimit {
+		if limit := k.pathRateLimit(r); limit != nil {
+			limitKey := token + ":" + k.Spec.APIID + ":" + limit.Method + ":" + limit.Path
+			state := sessionLimiter.limitRate(limitKey, limitKey+":"+session.LastUpdated, limit.Rate, limit.Per, storeRef)
+			if state.Exceeded {
+				ctxSetRateLimitState(r, &state)
+				return k.handleRateLimitFailure(r, token)
+			}
+		}
+	}
+
+	reason, state := sessionLimiter.ForwardMessage(session,
 		token,
+		k.Spec.APIID,
 		storeRef,
 		!k.Spec.DisableRateLimit,
 		!k.Spec.DisableQuota)
@@ -87,12 +108,24 @@ func (k *RateLimitAndQuotaCheck) ProcessRequest(w http.ResponseWriter, r *http.R
 
 	log.Debug("SessionState: ", session)
 
+	// Report the limit that was exceeded, or else the tightest quota if
+	// the key has one, or else the rate limit
+	quota := quotaState(session)
+	switch {
+	case reason != sessionFailNone:
+		ctxSetRateLimitState(r, &state)
+	case !k.Spec.DisableQuota && quota != nil:
+		ctxSetRateLimitState(r, quota)
+	case state.Limit > 0:
+		ctxSetRateLimitState(r, &state)
+	}
+
 	switch reason {
 	case sessionFailNone:
 	case sessionFailRateLimit:
 		return k.handleRateLimitFailure(r, token)
 	case sessionFailQuota:
-		return k.handleQuotaFailure(r, token)
+		return k.handleQuotaFailure(r, token, state.Window)
 	default:
 		// Other reason? Still not allowed
 		return errors.New("Access denied"), 403
@@ -3,20 +3,35 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/Jeffail/gabs"
+
+	"github.com/TykTechnologies/tyk/apidef"
 )
 
 const (
 	upstreamCacheHeader    = "x-tyk-cache-action-set"
 	upstreamCacheTTLHeader = "x-tyk-cache-action-set-ttl"
+
+	cacheStatusHeader      = "X-Tyk-Cache-Status"
+	cacheStatusHit         = "HIT"
+	cacheStatusMiss        = "MISS"
+	cacheStatusStale       = "STALE"
+	cacheStatusRevalidated = "REVALIDATED"
 )
 
 // RedisCacheMiddleware is a caching middleware that will pull data from Redis instead of the upstream proxy
@@ -36,46 +51,144 @@ func (m *RedisCacheMiddleware) Init() {
 
 func (m *RedisCacheMiddleware) IsEnabledForSpec() bool {
 	for _, version := range m.Spec.VersionData.Versions {
-		if len(version.ExtendedPaths.Cached) > 0 {
+		if len(version.ExtendedPaths.Cached) > 0 || len(version.ExtendedPaths.CacheConfig) > 0 {
 			return true
 		}
 	}
 	return false
 }
 
-func (m *RedisCacheMiddleware) CreateCheckSum(req *http.Request, keyName string) string {
+// CreateCheckSum builds the cache key for a request. The headers listed
+// in the path's cache configuration and in varyHeaders are part of the
+// key, the ignored query parameters are not.
+func (m *RedisCacheMiddleware) CreateCheckSum(req *http.Request, keyName string, meta *apidef.CacheMeta, varyHeaders []string) string {
+	var keyHeaders []string
+	u := req.URL
+	if meta != nil {
+		keyHeaders = meta.CacheKeyHeaders
+		if len(meta.IgnoreQueryParams) > 0 {
+			stripped := *u
+			q := stripped.Query()
+			for _, param := range meta.IgnoreQueryParams {
+				q.Del(param)
+			}
+			stripped.RawQuery = q.Encode()
+			u = &stripped
+		}
+	}
+
 	h := md5.New()
 	io.WriteString(h, req.Method)
 	io.WriteString(h, "-")
-	io.WriteString(h, req.URL.String())
+	io.WriteString(h, u.String())
+	for _, name := range cacheKeyHeaderNames(keyHeaders, varyHeaders) {
+		io.WriteString(h, "-")
+		io.WriteString(h, name)
+		io.WriteString(h, ":")
+		io.WriteString(h, strings.Join(req.Header[name], ","))
+	}
+	if meta != nil && meta.CacheRequestBody {
+		io.WriteString(h, "-body:")
+		io.WriteString(h, cacheBodyKey(req, meta.BodyKeyPaths))
+	}
 	reqChecksum := hex.EncodeToString(h.Sum(nil))
 	return m.Spec.APIID + keyName + reqChecksum
 }
 
-func (m *RedisCacheMiddleware) getTimeTTL(cacheTTL int64) string {
-	timeNow := time.Now().Unix()
-	newTTL := timeNow + cacheTTL
-	asStr := strconv.Itoa(int(newTTL))
-	return asStr
+// cacheKeyHeaderNames merges header lists into a sorted list of unique
+// canonical header names, so the key doesn't depend on their order.
+func cacheKeyHeaderNames(lists ...[]string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		for _, name := range list {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
 }
 
-func (m *RedisCacheMiddleware) isTimeStampExpired(timestamp string) bool {
-	now := time.Now()
+func cacheKeyRequest(r *http.Request) *http.Request {
+	u := *r.URL
+	h := make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		h[k] = v
+	}
+	keyReq := &http.Request{Method: r.Method, URL: &u, Header: h}
+	if r.Body != nil {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		keyReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return keyReq
+}
 
-	i, err := strconv.ParseInt(timestamp, 10, 64)
+// cacheBodyKey returns the request body normalised for use in a cache
+// key, the body can still be read afterwards. JSON bodies are re-encoded
+// so whitespace and key order don't matter, if paths are given only the
+// values found at those are used. Other bodies are used as they are.
+func cacheBodyKey(r *http.Request, paths []string) string {
+	if r.Body == nil {
+		return ""
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
 	if err != nil {
-		log.Error(err)
+		log.Error("Failed to read request body for cache key: ", err)
+		return string(body)
 	}
-	tm := time.Unix(i, 0)
 
-	log.Debug("Time Now: ", now)
-	log.Debug("Expires: ", tm)
-	if tm.Before(now) {
-		log.Debug("Expriy caught in TS!")
-		return true
+	dec := json.NewDecoder(bytes.NewReader(body))
+	// keep large numbers intact
+	dec.UseNumber()
+	parsed, err := gabs.ParseJSONDecoder(dec)
+	if err != nil {
+		return string(body)
+	}
+	var normalised []byte
+	if len(paths) == 0 {
+		normalised, err = json.Marshal(parsed.Data())
+	} else {
+		subset := make(map[string]interface{}, len(paths))
+		for _, path := range paths {
+			path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+			subset[path] = parsed.Path(path).Data()
+		}
+		normalised, err = json.Marshal(subset)
 	}
+	if err != nil {
+		return string(body)
+	}
+	return string(normalised)
+}
 
-	return false
+// varyHeaderNames returns the header names listed in the Vary headers of
+// an upstream response.
+func varyHeaderNames(h http.Header) []string {
+	var names []string
+	for _, v := range h["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func (m *RedisCacheMiddleware) getTimeTTL(cacheTTL int64) string {
+	timeNow := time.Now().Unix()
+	newTTL := timeNow + cacheTTL
+	asStr := strconv.Itoa(int(newTTL))
+	return asStr
 }
 
 func (m *RedisCacheMiddleware) encodePayload(payload, timestamp string) string {
@@ -106,22 +219,34 @@ func (m *RedisCacheMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Req
 	if !m.Spec.CacheOptions.EnableCache {
 		return nil, 200
 	}
-	// Only allow idempotent (safe) methods
-	if r.Method != "GET" && r.Method != "HEAD" {
-		return nil, 200
-	}
 
 	var stat RequestStatus
 	var isVirtual bool
+	var cacheMeta *apidef.CacheMeta
+	_, versionPaths, _, _ := m.Spec.Version(r)
+	if found, meta := m.Spec.CheckSpecMatchesStatus(r, versionPaths, CacheConfigured); found {
+		cacheMeta = meta.(*apidef.CacheMeta)
+	}
+
+	// Only allow idempotent (safe) methods, unless the path opted in to
+	// keying the cache on the request body
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST", "PUT":
+		if cacheMeta == nil || !cacheMeta.CacheRequestBody {
+			return nil, 200
+		}
+	default:
+		return nil, 200
+	}
 	// Lets see if we can throw a sledgehammer at this
 	if m.Spec.CacheOptions.CacheAllSafeRequests {
 		stat = StatusCached
 	} else {
 		// New request checker, more targeted, less likely to fail
-		_, versionPaths, _, _ := m.Spec.Version(r)
 		found, _ := m.Spec.CheckSpecMatchesStatus(r, versionPaths, Cached)
 		isVirtual, _ = m.Spec.CheckSpecMatchesStatus(r, versionPaths, VirtualPath)
-		if found {
+		if found || cacheMeta != nil {
 			stat = StatusCached
 		}
 	}
@@ -142,99 +267,251 @@ func (m *RedisCacheMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Req
 		copiedRequest = CopyHttpRequest(r)
 	}
 
-	key := m.CreateCheckSum(r, token)
-	retBlob, found := m.CacheStore.GetKey(key)
-	if found != nil {
-		log.Debug("Cache enabled, but record not found")
-		// Pass through to proxy AND CACHE RESULT
+	key := m.CreateCheckSum(r, token, cacheMeta, nil)
+	// the upstream's Vary header is stored next to the entry keyed
+	// without it, once known it becomes part of the key
+	varyKey := key + "-vary"
+	var keyReq *http.Request
+	if m.Spec.CacheOptions.EnableUpstreamCacheControl {
+		// the proxy rewrites the request URL, keep what the key was
+		// built from in case the response adds a Vary header
+		keyReq = cacheKeyRequest(r)
+		if vary, err := m.CacheStore.GetKey(varyKey); err == nil && vary != "" {
+			key = m.CreateCheckSum(r, token, cacheMeta, strings.Split(vary, ","))
+		}
+	}
+	entry := &cacheEntryKey{
+		key:     key,
+		varyKey: varyKey,
+		token:   token,
+		meta:    cacheMeta,
+		keyReq:  keyReq,
+	}
 
-		var reqVal *http.Response
-		if isVirtual {
-			log.Debug("This is a virtual function")
-			vp := VirtualEndpoint{BaseMiddleware: m.BaseMiddleware}
-			vp.Init()
-			reqVal = vp.ServeHTTPForCache(w, r)
+	status := cacheStatusMiss
+	var cachedData string
+	var expiredFor time.Duration
+	if retBlob, err := m.CacheStore.GetKey(key); err == nil {
+		data, timestamp, err := m.decodePayload(retBlob)
+		if err != nil || len(data) == 0 {
+			// Tere was an issue with this cache entry - lets remove it:
+			m.CacheStore.DeleteKey(key)
 		} else {
-			// This passes through and will write the value to the writer, but spit out a copy for the cache
-			log.Debug("Not virtual, passing")
-			reqVal = m.sh.ServeHTTPWithCache(w, r)
+			cachedData = data
+			expiredFor = m.expiredFor(timestamp)
 		}
+	}
 
-		cacheThisRequest := true
-		cacheTTL := m.Spec.CacheOptions.CacheTimeout
+	opts := m.Spec.CacheOptions
+	if cachedData != "" {
+		staleWhileRevalidate := time.Duration(opts.StaleWhileRevalidate) * time.Second
+		staleIfError := time.Duration(opts.StaleIfError) * time.Second
+		switch {
+		case expiredFor <= 0:
+			m.serveCached(w, r, cachedData, cacheStatusHit, copiedRequest, true)
+			return nil, mwStatusRespond
+		case expiredFor <= staleWhileRevalidate:
+			m.revalidate(r, entry, isVirtual)
+			m.serveCached(w, r, cachedData, cacheStatusStale, copiedRequest, true)
+			return nil, mwStatusRespond
+		case expiredFor > staleIfError:
+			// too old to fall back to, a plain miss
+			cachedData = ""
+		default:
+			status = cacheStatusRevalidated
+		}
+	}
 
-		if reqVal == nil {
-			log.Warning("Upstream request must have failed, response is empty")
-			return nil, 200
+	log.Debug("Cache enabled, but no fresh record found")
+	// Pass through to proxy AND CACHE RESULT
+	var reqVal *http.Response
+	if cachedData == "" {
+		w.Header().Set(cacheStatusHeader, status)
+		reqVal = m.fetch(w, r, isVirtual)
+	} else {
+		// hold the response back in case the stale copy has to be used
+		bw := newCacheBufferWriter()
+		bw.Header().Set(cacheStatusHeader, status)
+		reqVal = m.fetch(bw, r, isVirtual)
+		if reqVal == nil || reqVal.StatusCode >= 500 {
+			log.Warning("Upstream request failed, serving stale cached response")
+			// The failed request was recorded when it was fetched, by
+			// the error handler if the upstream couldn't be reached
+			m.serveCached(w, r, cachedData, cacheStatusStale, copiedRequest, false)
+			return nil, mwStatusRespond
 		}
+		bw.sendTo(w)
+	}
 
-		// make sure the status codes match if specified
-		if len(m.Spec.CacheOptions.CacheOnlyResponseCodes) > 0 {
-			foundCode := false
-			for _, code := range m.Spec.CacheOptions.CacheOnlyResponseCodes {
-				if code == reqVal.StatusCode {
-					foundCode = true
-					break
-				}
-			}
-			if !foundCode {
-				cacheThisRequest = false
+	if reqVal == nil {
+		log.Warning("Upstream request must have failed, response is empty")
+		return nil, 200
+	}
+	m.store(reqVal, entry)
+	return nil, mwStatusRespond
+}
+
+// cacheEntryKey holds what is needed to store a response once it has
+// been fetched, the key changes if the upstream adds a Vary header.
+type cacheEntryKey struct {
+	key, varyKey, token string
+	meta                *apidef.CacheMeta
+	keyReq              *http.Request
+}
+
+func (m *RedisCacheMiddleware) fetch(w http.ResponseWriter, r *http.Request, isVirtual bool) *http.Response {
+	if isVirtual {
+		log.Debug("This is a virtual function")
+		vp := VirtualEndpoint{BaseMiddleware: m.BaseMiddleware}
+		vp.Init()
+		return vp.ServeHTTPForCache(w, r)
+	}
+	// This passes through and will write the value to the writer, but spit out a copy for the cache
+	log.Debug("Not virtual, passing")
+	return m.sh.ServeHTTPWithCache(w, r)
+}
+
+// store caches an upstream response unless the status code or the
+// upstream cache control headers rule it out.
+func (m *RedisCacheMiddleware) store(reqVal *http.Response, entry *cacheEntryKey) {
+	cacheThisRequest := true
+	cacheTTL := m.Spec.CacheOptions.CacheTimeout
+	key := entry.key
+
+	// make sure the status codes match if specified
+	if len(m.Spec.CacheOptions.CacheOnlyResponseCodes) > 0 {
+		foundCode := false
+		for _, code := range m.Spec.CacheOptions.CacheOnlyResponseCodes {
+			if code == reqVal.StatusCode {
+				foundCode = true
+				break
 			}
 		}
+		if !foundCode {
+			cacheThisRequest = false
+		}
+	}
 
-		// Are we using upstream cache control?
-		if m.Spec.CacheOptions.EnableUpstreamCacheControl {
-			log.Debug("Upstream control enabled")
-			// Do we cache?
-			if reqVal.Header.Get(upstreamCacheHeader) == "" {
-				log.Warning("Upstream cache action not found, not caching")
-				cacheThisRequest = false
+	// Are we using upstream cache control?
+	if m.Spec.CacheOptions.EnableUpstreamCacheControl {
+		log.Debug("Upstream control enabled")
+		// Do we cache?
+		if reqVal.Header.Get(upstreamCacheHeader) == "" {
+			log.Warning("Upstream cache action not found, not caching")
+			cacheThisRequest = false
+		}
+		// Do we override TTL?
+		ttl := reqVal.Header.Get(upstreamCacheTTLHeader)
+		if ttl != "" {
+			log.Debug("TTL Set upstream")
+			cacheAsInt, err := strconv.Atoi(ttl)
+			if err != nil {
+				log.Error("Failed to decode TTL cache value: ", err)
+				cacheTTL = m.Spec.CacheOptions.CacheTimeout
+			} else {
+				cacheTTL = int64(cacheAsInt)
 			}
-			// Do we override TTL?
-			ttl := reqVal.Header.Get(upstreamCacheTTLHeader)
-			if ttl != "" {
-				log.Debug("TTL Set upstream")
-				cacheAsInt, err := strconv.Atoi(ttl)
-				if err != nil {
-					log.Error("Failed to decode TTL cache value: ", err)
-					cacheTTL = m.Spec.CacheOptions.CacheTimeout
-				} else {
-					cacheTTL = int64(cacheAsInt)
-				}
+		}
+		// Does the response vary on request headers? "*" sorts first
+		vary := cacheKeyHeaderNames(varyHeaderNames(reqVal.Header))
+		if cacheThisRequest && len(vary) > 0 {
+			if vary[0] == "*" {
+				log.Debug("Upstream response varies on everything, not caching")
+				cacheThisRequest = false
+			} else {
+				go m.CacheStore.SetKey(entry.varyKey, strings.Join(vary, ","), cacheTTL+m.staleWindow())
+				key = m.CreateCheckSum(entry.keyReq, entry.token, entry.meta, vary)
 			}
 		}
+	}
 
-		if cacheThisRequest {
-			log.Debug("Caching request to redis")
-			var wireFormatReq bytes.Buffer
-			reqVal.Write(&wireFormatReq)
-			log.Debug("Cache TTL is:", cacheTTL)
-			ts := m.getTimeTTL(cacheTTL)
-			toStore := m.encodePayload(wireFormatReq.String(), ts)
-			go m.CacheStore.SetKey(key, toStore, cacheTTL)
-
-		}
-		return nil, mwStatusRespond
+	if cacheThisRequest {
+		log.Debug("Caching request to redis")
+		var wireFormatReq bytes.Buffer
+		reqVal.Header.Del(cacheStatusHeader)
+		reqVal.Write(&wireFormatReq)
+		log.Debug("Cache TTL is:", cacheTTL)
+		ts := m.getTimeTTL(cacheTTL)
+		toStore := m.encodePayload(wireFormatReq.String(), ts)
+		// keep expired entries around for as long as they may be served stale
+		go m.CacheStore.SetKey(key, toStore, cacheTTL+m.staleWindow())
+	}
+}
 
+// staleWindow is how long, in seconds, an expired entry may still be
+// served.
+func (m *RedisCacheMiddleware) staleWindow() int64 {
+	if opts := m.Spec.CacheOptions; opts.StaleWhileRevalidate > opts.StaleIfError {
+		return opts.StaleWhileRevalidate
 	}
+	return m.Spec.CacheOptions.StaleIfError
+}
 
-	cachedData, timestamp, err := m.decodePayload(retBlob)
+// expiredFor returns how long ago an entry expired, negative if it is
+// still fresh.
+func (m *RedisCacheMiddleware) expiredFor(timestamp string) time.Duration {
+	i, err := strconv.ParseInt(timestamp, 10, 64)
 	if err != nil {
-		// Tere was an issue with this cache entry - lets remove it:
-		m.CacheStore.DeleteKey(key)
-		return nil, 200
+		log.Error(err)
 	}
+	return time.Since(time.Unix(i, 0))
+}
 
-	if m.isTimeStampExpired(timestamp) || len(cachedData) == 0 {
-		m.CacheStore.DeleteKey(key)
-		return nil, 200
+// cacheRevalidations holds the keys being refreshed in the background,
+// so that only one refresh runs per key.
+var cacheRevalidations = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: make(map[string]bool)}
+
+// revalidate refreshes an entry in the background, it does nothing if a
+// refresh for the same key is already running.
+func (m *RedisCacheMiddleware) revalidate(r *http.Request, entry *cacheEntryKey, isVirtual bool) {
+	cacheRevalidations.Lock()
+	if cacheRevalidations.keys[entry.key] {
+		cacheRevalidations.Unlock()
+		return
 	}
+	cacheRevalidations.keys[entry.key] = true
+	cacheRevalidations.Unlock()
+
+	// the client request is done with by the time the refresh runs
+	bgReq := detachedRequest(r)
+	go func() {
+		defer func() {
+			cacheRevalidations.Lock()
+			delete(cacheRevalidations.keys, entry.key)
+			cacheRevalidations.Unlock()
+		}()
 
+		var reqVal *http.Response
+		bw := newCacheBufferWriter()
+		if isVirtual {
+			reqVal = m.fetch(bw, bgReq, true)
+		} else {
+			// skip the success handler, this isn't a client request
+			if m.Spec.Proxy.StripListenPath {
+				bgReq.URL.Path = strings.Replace(bgReq.URL.Path, m.Spec.Proxy.ListenPath, "", 1)
+			}
+			reqVal = m.Proxy.ServeHTTPForCache(bw, bgReq)
+		}
+		if reqVal == nil || reqVal.StatusCode >= 500 {
+			log.Warning("Background cache refresh failed, keeping stale entry")
+			return
+		}
+		m.store(reqVal, entry)
+	}()
+}
+
+// serveCached writes a cached response, recording the hit unless told
+// otherwise.
+func (m *RedisCacheMiddleware) serveCached(w http.ResponseWriter, r *http.Request, cachedData, status string, copiedRequest *http.Request, recordHit bool) {
 	log.Debug("Cache got: ", cachedData)
 	bufData := bufio.NewReader(strings.NewReader(cachedData))
 	newRes, err := http.ReadResponse(bufData, r)
 	if err != nil {
 		log.Error("Could not create response object: ", err)
+		return
 	}
 
 	defer newRes.Body.Close()
@@ -243,23 +520,71 @@ func (m *RedisCacheMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Req
 	}
 
 	copyHeader(w.Header(), newRes.Header)
-	session := ctxGetSession(r)
-
-	// Only add ratelimit data to keyed sessions
-	if session != nil {
-		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(session.QuotaMax)))
-		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(session.QuotaRemaining)))
-		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(session.QuotaRenews)))
-	}
+	setRateLimitHeaders(w.Header(), r)
 	w.Header().Add("x-tyk-cached-response", "1")
+	w.Header().Set(cacheStatusHeader, status)
 	w.WriteHeader(newRes.StatusCode)
 	m.Proxy.CopyResponse(w, newRes.Body)
 
 	// Record analytics
-	if !m.Spec.DoNotTrack {
+	if recordHit && !m.Spec.DoNotTrack {
 		go m.sh.RecordHit(r, 0, newRes.StatusCode, copiedRequest, nil)
 	}
+}
 
-	// Stop any further execution
-	return nil, mwStatusRespond
+// cacheBufferWriter holds a response back, so that the middleware can
+// decide whether to send it or fall back to a stale cached copy.
+type cacheBufferWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newCacheBufferWriter() *cacheBufferWriter {
+	return &cacheBufferWriter{header: make(http.Header)}
+}
+
+func (w *cacheBufferWriter) Header() http.Header { return w.header }
+
+func (w *cacheBufferWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *cacheBufferWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *cacheBufferWriter) sendTo(rw http.ResponseWriter) {
+	copyHeader(rw.Header(), w.header)
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	rw.WriteHeader(w.code)
+	rw.Write(w.body.Bytes())
+}
+
+// detachedContext keeps the values of its parent but is never cancelled.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// detachedRequest copies a request so that it can be sent after the
+// client request has completed.
+func detachedRequest(r *http.Request) *http.Request {
+	keyReq := cacheKeyRequest(r)
+	bgReq := r.WithContext(detachedContext{r.Context()})
+	bgReq.URL = keyReq.URL
+	bgReq.Header = keyReq.Header
+	bgReq.Body = keyReq.Body
+	return bgReq
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const cacheTestAPI = `{
+	"api_id": "{{.APIID}}",
+	"use_keyless": true,
+	"version_data": {
+		"not_versioned": true,
+		"versions": {
+			"Default": {
+				"name": "Default",
+				"use_extended_paths": true,
+				"extended_paths": {
+					"cache_config": [{
+						"path": "/keyed",
+						"method": "GET",
+						"cache_key_headers": ["accept-language"],
+						"ignore_query_params": ["utm_source"]
+					}, {
+						"path": "/search",
+						"method": "POST",
+						"cache_request_body": true
+					}, {
+						"path": "/term-search",
+						"method": "POST",
+						"cache_request_body": true,
+						"body_key_paths": ["$.query.term"]
+					}],
+					"cache": ["/vary"]
+				}
+			}
+		}
+	},
+	"cache_options": {
+		"enable_cache": true,
+		"cache_response_codes": [200],
+		"enable_upstream_cache_control": {{.UpstreamControl}},
+		{{.Options}}
+	},
+	"proxy": {
+		"listen_path": "/",
+		"target_url": "{{.Target}}"
+	}
+}`
+
+func createCacheTestRouter(t *testing.T, apiID, target string, upstreamControl bool, options string) http.Handler {
+	def := strings.NewReplacer(
+		"{{.APIID}}", apiID,
+		"{{.Target}}", target,
+		"{{.UpstreamControl}}", fmt.Sprint(upstreamControl),
+		"{{.Options}}", options,
+	).Replace(cacheTestAPI)
+	spec := createSpecTest(t, def)
+	if err := handleInvalidateAPICache(apiID); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	loadApps([]*APISpec{spec}, router)
+	return router
+}
+
+// cacheTestRequest is a GET unless it has a body, then it is a POST.
+type cacheTestRequest struct {
+	path    string
+	header  string
+	value   string
+	body    string
+	wantHit bool
+}
+
+func runCacheTestRequests(t *testing.T, router http.Handler, header string, reqs []cacheTestRequest) {
+	for i, tc := range reqs {
+		rec := httptest.NewRecorder()
+		req := testReq(t, "GET", tc.path, nil)
+		if tc.body != "" {
+			req = testReq(t, "POST", tc.path, tc.body)
+		}
+		if tc.value != "" {
+			req.Header.Set(tc.header, tc.value)
+		}
+		router.ServeHTTP(rec, req)
+		if hit := rec.Header().Get("x-tyk-cached-response") != ""; hit != tc.wantHit {
+			t.Errorf("request %d (%s %s=%q): wanted cache hit %v, got %v",
+				i, tc.path, tc.header, tc.value, tc.wantHit, hit)
+		}
+		// entries are written to the cache in the background
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRedisCacheKeyHeaders(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, atomic.AddInt32(&hits, 1))
+	}))
+	defer upstream.Close()
+
+	router := createCacheTestRouter(t, "cache-key-headers", upstream.URL, false, `"cache_timeout": 60`)
+	runCacheTestRequests(t, router, "Accept-Language", []cacheTestRequest{
+		{"/keyed?utm_source=a&id=1", "Accept-Language", "en", "", false},
+		{"/keyed?id=1&utm_source=b", "Accept-Language", "en", "", true},
+		{"/keyed?id=1", "Accept-Language", "fr", "", false},
+		{"/keyed?id=1", "Accept-Language", "fr", "", true},
+		{"/keyed?id=2", "Accept-Language", "fr", "", false},
+	})
+	if got := atomic.LoadInt32(&hits); got != 3 {
+		t.Errorf("wanted 3 upstream requests, got %d", got)
+	}
+}
+
+func TestRedisCacheUpstreamVary(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(upstreamCacheHeader, "1")
+		w.Header().Set("Vary", "X-Tenant")
+		fmt.Fprint(w, atomic.AddInt32(&hits, 1))
+	}))
+	defer upstream.Close()
+
+	router := createCacheTestRouter(t, "cache-upstream-vary", upstream.URL, true, `"cache_timeout": 60`)
+	runCacheTestRequests(t, router, "X-Tenant", []cacheTestRequest{
+		{"/vary", "X-Tenant", "a", "", false},
+		{"/vary", "X-Tenant", "a", "", true},
+		{"/vary", "X-Tenant", "b", "", false},
+		{"/vary", "X-Tenant", "b", "", true},
+	})
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("wanted 2 upstream requests, got %d", got)
+	}
+}
+
+func TestRedisCacheRequestBody(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), "fail") {
+			w.WriteHeader(500)
+		}
+		fmt.Fprint(w, atomic.AddInt32(&hits, 1))
+	}))
+	defer upstream.Close()
+
+	router := createCacheTestRouter(t, "cache-request-body", upstream.URL, false, `"cache_timeout": 60`)
+	runCacheTestRequests(t, router, "", []cacheTestRequest{
+		{"/search", "", "", `{"a": 1, "b": [1, 2]}`, false},
+		{"/search", "", "", `{ "b":[1,2], "a":1 }`, true},
+		{"/search", "", "", `{"a": 1}`, false},
+		{"/search", "", "", `not json`, false},
+		{"/search", "", "", `not json`, true},
+		{"/term-search", "", "", `{"query": {"term": "x"}, "page": 1}`, false},
+		{"/term-search", "", "", `{"page": 2, "query": {"term": "x"}}`, true},
+		{"/term-search", "", "", `{"query": {"term": "y"}, "page": 1}`, false},
+		// only 200s are cached
+		{"/search", "", "", `{"fail": true}`, false},
+		{"/search", "", "", `{"fail": true}`, false},
+	})
+	if got := atomic.LoadInt32(&hits); got != 7 {
+		t.Errorf("wanted 7 upstream requests, got %d", got)
+	}
+
+	if err := handleInvalidateAPICache("cache-request-body"); err != nil {
+		t.Fatal(err)
+	}
+	runCacheTestRequests(t, router, "", []cacheTestRequest{
+		{"/search", "", "", `{"a": 1}`, false},
+	})
+}
+
+func serveCacheTest(t *testing.T, router http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, testReq(t, "GET", path, nil))
+	return rec
+}
+
+func TestRedisCacheStaleWhileRevalidate(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// slow enough for the stale requests to overlap with the refresh
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprint(w, atomic.AddInt32(&hits, 1))
+	}))
+	defer upstream.Close()
+
+	router := createCacheTestRouter(t, "cache-swr", upstream.URL, false,
+		`"cache_timeout": 1, "stale_while_revalidate": 30`)
+
+	if rec := serveCacheTest(t, router, "/keyed"); rec.Header().Get(cacheStatusHeader) != cacheStatusMiss {
+		t.Fatalf("wanted a miss, got %q", rec.Header().Get(cacheStatusHeader))
+	}
+	time.Sleep(2100 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		rec := serveCacheTest(t, router, "/keyed")
+		if got := rec.Header().Get(cacheStatusHeader); got != cacheStatusStale {
+			t.Errorf("request %d: wanted stale, got %q", i, got)
+		}
+		if rec.Body.String() != "1" {
+			t.Errorf("request %d: wanted the stale body, got %q", i, rec.Body.String())
+		}
+	}
+	// let the single refresh finish
+	time.Sleep(300 * time.Millisecond)
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("wanted a single refresh, got %d upstream requests", got)
+	}
+
+	// the refreshed entry may be stale again already, it only lives for
+	// a second
+	if rec := serveCacheTest(t, router, "/keyed"); rec.Body.String() != "2" {
+		t.Errorf("wanted the refreshed body, got %q", rec.Body.String())
+	}
+}
+
+func TestRedisCacheStaleIfError(t *testing.T) {
+	var hits, failing int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(503)
+			return
+		}
+		fmt.Fprint(w, atomic.AddInt32(&hits, 1))
+	}))
+	defer upstream.Close()
+
+	router := createCacheTestRouter(t, "cache-sie", upstream.URL, false,
+		`"cache_timeout": 1, "stale_if_error": 30`)
+
+	serveCacheTest(t, router, "/keyed")
+	time.Sleep(2100 * time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	analytics.Flush()
+	analytics.Store.GetAndDeleteSet(analyticsKeyName)
+
+	atomic.StoreInt32(&failing, 1)
+	rec := serveCacheTest(t, router, "/keyed")
+	if got := rec.Header().Get(cacheStatusHeader); got != cacheStatusStale || rec.Code != 200 || rec.Body.String() != "1" {
+		t.Errorf("wanted the stale copy, got %q %d %q", got, rec.Code, rec.Body.String())
+	}
+	// The failed upstream request is the only hit recorded
+	time.Sleep(50 * time.Millisecond)
+	analytics.Flush()
+	if got := len(analytics.Store.GetAndDeleteSet(analyticsKeyName)); got != 1 {
+		t.Errorf("wanted the stale response recorded once, got %d records", got)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	rec = serveCacheTest(t, router, "/keyed")
+	if got := rec.Header().Get(cacheStatusHeader); got != cacheStatusRevalidated || rec.Body.String() != "2" {
+		t.Errorf("wanted a revalidated response, got %q %q", got, rec.Body.String())
+	}
+
+	// An unreachable upstream is recorded by the error handler only
+	time.Sleep(2100 * time.Millisecond)
+	analytics.Flush()
+	analytics.Store.GetAndDeleteSet(analyticsKeyName)
+	upstream.Close()
+	rec = serveCacheTest(t, router, "/keyed")
+	if got := rec.Header().Get(cacheStatusHeader); got != cacheStatusStale || rec.Code != 200 || rec.Body.String() != "2" {
+		t.Errorf("wanted the stale copy, got %q %d %q", got, rec.Code, rec.Body.String())
+	}
+	time.Sleep(50 * time.Millisecond)
+	analytics.Flush()
+	if got := len(analytics.Store.GetAndDeleteSet(analyticsKeyName)); got != 1 {
+		t.Errorf("wanted the unreachable upstream recorded once, got %d records", got)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/TykTechnologies/tyk/apidef"
@@ -223,7 +222,7 @@ func (d *VirtualEndpoint) ServeHTTPForCache(w http.ResponseWriter, r *http.Reque
 	newResponse.Body = ioutil.NopCloser(&bodyBuffer)
 	copiedRes.Body = ioutil.NopCloser(bodyBuffer2)
 
-	d.HandleResponse(w, newResponse, session)
+	d.HandleResponse(w, newResponse, r)
 
 	// Record analytics
 	go d.sh.RecordHit(r, 0, newResponse.StatusCode, copiedRequest, copiedResponse)
@@ -244,7 +243,7 @@ func (d *VirtualEndpoint) ProcessRequest(w http.ResponseWriter, r *http.Request,
 	return nil, mwStatusRespond
 }
 
-func (d *VirtualEndpoint) HandleResponse(rw http.ResponseWriter, res *http.Response, ses *SessionState) error {
+func (d *VirtualEndpoint) HandleResponse(rw http.ResponseWriter, res *http.Response, req *http.Request) error {
 
 	defer res.Body.Close()
 
@@ -254,12 +253,7 @@ func (d *VirtualEndpoint) HandleResponse(rw http.ResponseWriter, res *http.Respo
 	}
 
 	// Add resource headers
-	if ses != nil {
-		// We have found a session, lets report back
-		res.Header.Set("X-RateLimit-Limit", strconv.Itoa(int(ses.QuotaMax)))
-		res.Header.Set("X-RateLimit-Remaining", strconv.Itoa(int(ses.QuotaRemaining)))
-		res.Header.Set("X-RateLimit-Reset", strconv.Itoa(int(ses.QuotaRenews)))
-	}
+	setRateLimitHeaders(res.Header, req)
 
 	copyHeader(rw.Header(), res.Header)
 
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"net/url"
 	"time"
 
 	osin "github.com/lonelycode/osin"
@@ -37,11 +38,12 @@ Effort required by Resource Owner:
 
 // OAuthClient is a representation within an APISpec of a client
 type OAuthClient struct {
-	ClientID          string `json:"id"`
-	ClientSecret      string `json:"secret"`
-	ClientRedirectURI string `json:"redirecturi"`
-	UserData          string `json:",omitempty"`
-	PolicyID          string `json:"policyid"`
+	ClientID          string   `json:"id"`
+	ClientSecret      string   `json:"secret"`
+	ClientRedirectURI string   `json:"redirecturi"`
+	UserData          string   `json:",omitempty"`
+	PolicyID          string   `json:"policyid"`
+	AllowedGrantTypes []string `json:"allowed_grant_types,omitempty"`
 }
 
 func (oc *OAuthClient) GetId() string {
@@ -156,6 +158,12 @@ func (o *OAuthHandlers) HandleAuthorizePassthrough(w http.ResponseWriter, r *htt
 		buffer.WriteString(r.FormValue("redirect_uri"))
 		buffer.WriteString("&response_type=")
 		buffer.WriteString(r.FormValue("response_type"))
+		if challenge := r.FormValue("code_challenge"); challenge != "" {
+			buffer.WriteString("&code_challenge=")
+			buffer.WriteString(url.QueryEscape(challenge))
+			buffer.WriteString("&code_challenge_method=")
+			buffer.WriteString(url.QueryEscape(r.FormValue("code_challenge_method")))
+		}
 		w.Header().Add("Location", buffer.String())
 	} else {
 		w.Header().Add("Location", o.Manager.API.Oauth2Meta.AuthorizeLoginRedirect)
@@ -224,12 +232,28 @@ func (o *OAuthManager) HandleAuthorisation(r *http.Request, complete bool, sessi
 	resp := o.OsinServer.NewResponse()
 
 	if ar := o.OsinServer.HandleAuthorizeRequest(resp, r); ar != nil {
+		challenge, err := o.authorizePKCE(r, ar)
+		if err != nil {
+			resp.SetErrorState(osin.E_INVALID_REQUEST, err.Error(), ar.State)
+			return resp
+		}
+
 		// Since this is called by the Reource provider (proxied API), we assume it has been approved
 		ar.Authorized = true
 
 		if complete {
 			ar.UserData = sessionState
 			o.OsinServer.FinishAuthorizeRequest(resp, r, ar)
+
+			if code, ok := resp.Output["code"].(string); ok && challenge != nil && !resp.IsError {
+				// Without its challenge the code could be exchanged
+				// without a verifier
+				if err := o.OsinServer.Storage.SavePKCEChallenge(code, challenge, ar.Expiration); err != nil {
+					o.OsinServer.Storage.RemoveAuthorize(code)
+					resp.SetErrorState(osin.E_SERVER_ERROR, "", ar.State)
+					resp.InternalError = err
+				}
+			}
 		}
 	}
 	if resp.IsError && resp.InternalError != nil {
@@ -242,8 +266,32 @@ func (o *OAuthManager) HandleAuthorisation(r *http.Request, complete bool, sessi
 // HandleAccess wraps an access request with osin's primitives
 func (o *OAuthManager) HandleAccess(r *http.Request) *osin.Response {
 	resp := o.OsinServer.NewResponse()
+
+	o.authenticatePublicClient(r)
+	detectReuse := o.API.Oauth2Meta.RefreshTokenReuseDetection
+
 	var username string
 	if ar := o.OsinServer.HandleAccessRequest(resp, r); ar != nil {
+		if !clientAllowsGrant(ar.Client, ar.Type) {
+			resp.SetError(osin.E_UNAUTHORIZED_CLIENT, "")
+			log.Warning("[OAuth] Client ", ar.Client.GetId(), " is not allowed to use grant type ", ar.Type)
+			return resp
+		}
+
+		// A refresh token that was already exchanged has probably leaked.
+		// It is only marked once the client and the token were checked.
+		if detectReuse && ar.Type == osin.REFRESH_TOKEN && o.refreshTokenReused(ar.Code) {
+			resp.SetError(osin.E_INVALID_GRANT, "")
+			return resp
+		}
+
+		if ar.Type == osin.AUTHORIZATION_CODE {
+			if err := o.verifyPKCE(r, ar); err != nil {
+				resp.SetError(osin.E_INVALID_GRANT, "")
+				log.Warning("[OAuth] PKCE verification failed: ", err)
+				return resp
+			}
+		}
 
 		var session *SessionState
 		if ar.Type == osin.PASSWORD {
@@ -312,6 +360,13 @@ func (o *OAuthManager) HandleAccess(r *http.Request) *osin.Response {
 		log.Debug("[OAuth] Finishing access request ")
 		o.OsinServer.FinishAccessRequest(resp, r, ar)
 
+		if detectReuse && !resp.IsError {
+			o.trackRefreshFamily(ar, resp)
+		} else if detectReuse && ar.Type == osin.REFRESH_TOKEN {
+			// The token wasn't exchanged, it may be retried
+			o.OsinServer.Storage.UnmarkRefreshUsed(ar.Code)
+		}
+
 		new_token, foundNewToken := resp.Output["access_token"]
 		if username != "" && foundNewToken {
 			log.Debug("Updating token data in key")
@@ -331,6 +386,10 @@ func (o *OAuthManager) HandleAccess(r *http.Request) *osin.Response {
 			}
 		}
 
+	} else if detectReuse && r.FormValue("grant_type") == osin.REFRESH_TOKEN && resp.Output["error"] == osin.E_INVALID_GRANT {
+		// The client was authenticated but osin doesn't know the token
+		// anymore, it may have been exchanged already
+		o.refreshTokenWasUsed(r.FormValue("refresh_token"))
 	}
 	if resp.IsError && resp.InternalError != nil {
 		log.Error("ERROR: ", resp.InternalError)
@@ -347,6 +406,10 @@ const (
 	prefixAccess    = "oauth-access."
 	prefixRefresh   = "oauth-refresh."
 	prefixClientset = "oauth-clientset."
+	prefixGrant     = "oauth-refresh-grant."
+	prefixFamily    = "oauth-refresh-family."
+	prefixUsed      = "oauth-refresh-used."
+	prefixPKCE      = "oauth-pkce."
 )
 
 type ExtendedOsinStorageInterface interface {
@@ -408,6 +471,41 @@ type ExtendedOsinStorageInterface interface {
 
 	// SetUser updates a Basic Access user token type in the key store
 	SetUser(string, *SessionState, int64) error
+
+	// SaveRefreshGrant records the family a refresh token belongs to
+	SaveRefreshGrant(token string, grant *refreshGrant) error
+
+	// LoadRefreshGrant looks up the family of a refresh token, including
+	// ones that were already exchanged
+	LoadRefreshGrant(token string) (*refreshGrant, error)
+
+	// SaveRefreshFamily stores the latest tokens issued to a family
+	SaveRefreshFamily(id string, family *refreshFamily) error
+
+	// LoadRefreshFamily retrieves the latest tokens issued to a family
+	LoadRefreshFamily(id string) (*refreshFamily, error)
+
+	// MarkRefreshUsed marks a refresh token as exchanged, reporting
+	// whether it already was. Only one of several concurrent calls for a
+	// token may report false.
+	MarkRefreshUsed(token string) bool
+
+	// RefreshUsed reports whether a refresh token was marked as exchanged,
+	// without marking it
+	RefreshUsed(token string) bool
+
+	// UnmarkRefreshUsed clears the mark of a refresh token whose exchange
+	// failed
+	UnmarkRefreshUsed(token string)
+
+	// RemoveRefreshFamily deletes a family
+	RemoveRefreshFamily(id string) error
+
+	// SavePKCEChallenge stores the PKCE challenge of an authorization code
+	SavePKCEChallenge(code string, challenge *pkceChallenge, expiresIn int32) error
+
+	// LoadPKCEChallenge retrieves the PKCE challenge of an authorization code
+	LoadPKCEChallenge(code string) (*pkceChallenge, error)
 }
 
 // TykOsinServer subclasses osin.Server so we can add the SetClient method without wrecking the lbrary
@@ -606,6 +704,7 @@ func (r *RedisOsinStorageInterface) LoadAuthorize(code string) (*osin.AuthorizeD
 func (r *RedisOsinStorageInterface) RemoveAuthorize(code string) error {
 	key := prefixAuth + code
 	r.store.DeleteKey(key)
+	r.store.DeleteKey(prefixPKCE + code)
 	return nil
 }
 
@@ -669,11 +768,7 @@ func (r *RedisOsinStorageInterface) SaveAccess(accessData *osin.AccessData) erro
 		}
 		key := prefixRefresh + accessData.RefreshToken
 		log.Debug("Saving REFRESH key: ", key)
-		refreshExpire := int64(1209600) // 14 days
-		if globalConf.OauthRefreshExpire != 0 {
-			refreshExpire = globalConf.OauthRefreshExpire
-		}
-		r.store.SetKey(key, string(accessDataJSON), refreshExpire)
+		r.store.SetKey(key, string(accessDataJSON), oauthRefreshExpire())
 		log.Debug("STORING ACCESS DATA: ", string(accessDataJSON))
 		return nil
 	}
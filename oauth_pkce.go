@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+
+	osin "github.com/lonelycode/osin"
+)
+
+// Proof Key for Code Exchange (RFC 7636) methods
+const (
+	pkceMethodPlain = "plain"
+	pkceMethodS256  = "S256"
+)
+
+// pkceValuePattern matches valid code challenges and verifiers
+var pkceValuePattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// pkceChallenge is stored next to an authorization code, osin's
+// AuthorizeData having no room for it.
+type pkceChallenge struct {
+	Challenge string `json:"code_challenge"`
+	Method    string `json:"code_challenge_method"`
+}
+
+// pkceChallengeFromRequest reads the PKCE parameters of an authorize
+// request, which may have none.
+func pkceChallengeFromRequest(r *http.Request) (*pkceChallenge, error) {
+	challenge := r.FormValue("code_challenge")
+	method := r.FormValue("code_challenge_method")
+	if challenge == "" {
+		if method != "" {
+			return nil, errors.New("code_challenge_method requires a code_challenge")
+		}
+		return nil, nil
+	}
+	if method == "" {
+		method = pkceMethodPlain
+	}
+	if method != pkceMethodPlain && method != pkceMethodS256 {
+		return nil, errors.New("code_challenge_method must be plain or S256")
+	}
+	if !pkceValuePattern.MatchString(challenge) {
+		return nil, errors.New("code_challenge is malformed")
+	}
+	return &pkceChallenge{Challenge: challenge, Method: method}, nil
+}
+
+func (c *pkceChallenge) verify(verifier string) bool {
+	if !pkceValuePattern.MatchString(verifier) {
+		return false
+	}
+	expected := verifier
+	if c.Method == pkceMethodS256 {
+		sum := sha256.Sum256([]byte(verifier))
+		expected = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(c.Challenge)) == 1
+}
+
+// isPublicClient reports whether a client was registered without a
+// secret, like mobile apps and SPAs that can't keep one.
+func isPublicClient(client osin.Client) bool {
+	return client.GetSecret() == ""
+}
+
+// authorizePKCE validates the PKCE parameters of an authorize request,
+// requiring them from public clients if the API says so.
+func (o *OAuthManager) authorizePKCE(r *http.Request, ar *osin.AuthorizeRequest) (*pkceChallenge, error) {
+	challenge, err := pkceChallengeFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if challenge == nil && ar.Type == osin.CODE &&
+		o.API.Oauth2Meta.RequirePKCEForPublicClients && isPublicClient(ar.Client) {
+		return nil, errors.New("code_challenge is required for public clients")
+	}
+	return challenge, nil
+}
+
+// verifyPKCE checks the code_verifier of an authorization code grant
+// against the challenge stored with the code.
+func (o *OAuthManager) verifyPKCE(r *http.Request, ar *osin.AccessRequest) error {
+	challenge, err := o.OsinServer.Storage.LoadPKCEChallenge(ar.Code)
+	if err != nil {
+		if o.API.Oauth2Meta.RequirePKCEForPublicClients && isPublicClient(ar.Client) {
+			return errors.New("authorization code has no code_challenge")
+		}
+		return nil
+	}
+	if !challenge.verify(r.FormValue("code_verifier")) {
+		return errors.New("code_verifier does not match the code_challenge")
+	}
+	return nil
+}
+
+// authenticatePublicClient lets public clients identify themselves with
+// their client_id alone on the token endpoint, which osin only accepts
+// as basic auth.
+func (o *OAuthManager) authenticatePublicClient(r *http.Request) {
+	if r.Header.Get("Authorization") != "" || r.FormValue("client_secret") != "" {
+		return
+	}
+	switch r.FormValue("grant_type") {
+	case string(osin.AUTHORIZATION_CODE), osin.REFRESH_TOKEN:
+	default:
+		return
+	}
+	clientID := r.FormValue("client_id")
+	if clientID == "" {
+		return
+	}
+	if client, err := o.OsinServer.Storage.GetClient(clientID); err == nil && isPublicClient(client) {
+		r.SetBasicAuth(clientID, "")
+	}
+}
+
+// SavePKCEChallenge stores the challenge of an authorization code
+func (r *RedisOsinStorageInterface) SavePKCEChallenge(code string, challenge *pkceChallenge, expiresIn int32) error {
+	challengeJSON, err := json.Marshal(challenge)
+	if err != nil {
+		return err
+	}
+	return r.store.SetKey(prefixPKCE+code, string(challengeJSON), int64(expiresIn))
+}
+
+// LoadPKCEChallenge loads the challenge of an authorization code
+func (r *RedisOsinStorageInterface) LoadPKCEChallenge(code string) (*pkceChallenge, error) {
+	challengeJSON, err := r.store.GetKey(prefixPKCE + code)
+	if err != nil {
+		return nil, err
+	}
+	challenge := &pkceChallenge{}
+	if err := json.Unmarshal([]byte(challengeJSON), challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	osin "github.com/lonelycode/osin"
+	"github.com/satori/go.uuid"
+)
+
+// refreshGrant ties a refresh token to the family of tokens issued from
+// the same authorization. Grants outlive the exchange of their token, and
+// exchanged tokens are marked as used, so that presenting one again
+// revokes the whole family.
+type refreshGrant struct {
+	FamilyID string `json:"family_id"`
+}
+
+// refreshFamily holds the latest tokens issued to a family, the older
+// ones having been removed when they were exchanged.
+type refreshFamily struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+var errTokenNotOwned = errors.New("token was not issued to this client")
+
+func oauthRefreshExpire() int64 {
+	if globalConf.OauthRefreshExpire != 0 {
+		return globalConf.OauthRefreshExpire
+	}
+	return 1209600 // 14 days
+}
+
+// clientAllowsGrant checks the client's own list of grant types, an
+// empty list allowing all of the API's. Public clients can't use client
+// credentials, having none.
+func clientAllowsGrant(client osin.Client, grantType osin.AccessRequestType) bool {
+	if grantType == osin.CLIENT_CREDENTIALS && isPublicClient(client) {
+		return false
+	}
+	oauthClient, ok := client.(*OAuthClient)
+	if !ok || len(oauthClient.AllowedGrantTypes) == 0 {
+		return true
+	}
+	return stringInSlice(string(grantType), oauthClient.AllowedGrantTypes)
+}
+
+// HandleRevokeRequest revokes an access or refresh token (RFC 7009). The
+// client authenticates like it does on the token endpoint.
+func (o *OAuthHandlers) HandleRevokeRequest(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.FormValue("client_id")
+		secret = r.FormValue("client_secret")
+	}
+	client, err := o.Manager.OsinServer.Storage.GetClient(clientID)
+	if clientID == "" || err != nil ||
+		subtle.ConstantTimeCompare([]byte(client.GetSecret()), []byte(secret)) != 1 {
+		doJSONWrite(w, 401, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	token := r.FormValue("token")
+	if token == "" {
+		doJSONWrite(w, 400, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	if err := o.Manager.RevokeToken(clientID, token, r.FormValue("token_type_hint")); err != nil {
+		log.Warning("[OAuth] Refusing to revoke token: ", err)
+		doJSONWrite(w, 400, map[string]string{"error": "unauthorized_client"})
+		return
+	}
+
+	// Unknown tokens are reported as revoked too
+	w.WriteHeader(200)
+}
+
+// RevokeToken revokes an access or refresh token issued to a client. The
+// hint only decides which kind is looked up first. Revoking a refresh
+// token revokes the access token issued with it.
+func (o *OAuthManager) RevokeToken(clientID, token, tokenTypeHint string) error {
+	revokers := []func(string, string) (bool, error){o.revokeAccessToken, o.revokeRefreshToken}
+	if tokenTypeHint == "refresh_token" {
+		revokers[0], revokers[1] = revokers[1], revokers[0]
+	}
+	for _, revoke := range revokers {
+		if found, err := revoke(clientID, token); found || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *OAuthManager) revokeAccessToken(clientID, token string) (bool, error) {
+	accessData, err := o.OsinServer.Storage.LoadAccess(token)
+	if err != nil {
+		return false, nil
+	}
+	if accessData.Client == nil || accessData.Client.GetId() != clientID {
+		return true, errTokenNotOwned
+	}
+	o.removeAccess(token)
+	return true, nil
+}
+
+func (o *OAuthManager) revokeRefreshToken(clientID, token string) (bool, error) {
+	accessData, err := o.OsinServer.Storage.LoadRefresh(token)
+	if err != nil {
+		return false, nil
+	}
+	if accessData.Client == nil || accessData.Client.GetId() != clientID {
+		return true, errTokenNotOwned
+	}
+	if grant, err := o.OsinServer.Storage.LoadRefreshGrant(token); err == nil {
+		o.revokeRefreshFamily(grant.FamilyID)
+		return true, nil
+	}
+	o.OsinServer.Storage.RemoveRefresh(token)
+	o.removeAccess(accessData.AccessToken)
+	return true, nil
+}
+
+// removeAccess removes an access token and its session, and tells the
+// other gateways to drop their cached copy of the session. They are only
+// told the token's cache key, not the token itself.
+func (o *OAuthManager) removeAccess(token string) {
+	o.OsinServer.Storage.RemoveAccess(token)
+	cacheKey := sessionCacheKey(token)
+	onTokenRevoked(cacheKey)
+	notice := Notification{
+		Command: NoticeTokenRevoked,
+		Payload: cacheKey,
+	}
+	notice.Signature = gatewayNoticeSignature(notice)
+	MainNotifier.Notify(notice)
+}
+
+// onTokenRevoked drops a revoked token's session from the local cache,
+// given its cache key.
+func onTokenRevoked(cacheKey string) {
+	SessionCache.Delete(cacheKey)
+}
+
+// refreshTokenReused marks a refresh token osin has loaded for its client
+// as exchanged before it is, and reports whether it already was, revoking
+// its family if so. Marking it first means concurrent uses of a token
+// can't all pass.
+func (o *OAuthManager) refreshTokenReused(token string) bool {
+	if !o.OsinServer.Storage.MarkRefreshUsed(token) {
+		return false
+	}
+	o.revokeReusedRefresh(token)
+	return true
+}
+
+// refreshTokenWasUsed revokes the family of a refresh token that was
+// already exchanged, without marking unknown tokens.
+func (o *OAuthManager) refreshTokenWasUsed(token string) bool {
+	if token == "" || !o.OsinServer.Storage.RefreshUsed(token) {
+		return false
+	}
+	o.revokeReusedRefresh(token)
+	return true
+}
+
+func (o *OAuthManager) revokeReusedRefresh(token string) {
+	log.Warning("[OAuth] Refresh token reused, revoking its token family")
+	if grant, err := o.OsinServer.Storage.LoadRefreshGrant(token); err == nil {
+		o.revokeRefreshFamily(grant.FamilyID)
+	}
+}
+
+func (o *OAuthManager) revokeRefreshFamily(familyID string) {
+	family, err := o.OsinServer.Storage.LoadRefreshFamily(familyID)
+	if err != nil {
+		return
+	}
+	o.OsinServer.Storage.RemoveRefresh(family.RefreshToken)
+	o.removeAccess(family.AccessToken)
+	o.OsinServer.Storage.RemoveRefreshFamily(familyID)
+}
+
+// trackRefreshFamily records the tokens of a successful access request.
+func (o *OAuthManager) trackRefreshFamily(ar *osin.AccessRequest, resp *osin.Response) {
+	accessToken, _ := resp.Output["access_token"].(string)
+	refreshToken, _ := resp.Output["refresh_token"].(string)
+	if refreshToken == "" {
+		return
+	}
+
+	storage := o.OsinServer.Storage
+	familyID := ""
+	if ar.Type == osin.REFRESH_TOKEN {
+		if grant, err := storage.LoadRefreshGrant(ar.Code); err == nil {
+			familyID = grant.FamilyID
+		}
+	}
+	if familyID == "" {
+		familyID = uuid.NewV4().String()
+	}
+	if ar.Type == osin.REFRESH_TOKEN {
+		storage.SaveRefreshGrant(ar.Code, &refreshGrant{FamilyID: familyID})
+	}
+	storage.SaveRefreshGrant(refreshToken, &refreshGrant{FamilyID: familyID})
+	storage.SaveRefreshFamily(familyID, &refreshFamily{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	})
+}
+
+// SaveRefreshGrant stores the family of a refresh token
+func (r *RedisOsinStorageInterface) SaveRefreshGrant(token string, grant *refreshGrant) error {
+	grantJSON, err := json.Marshal(grant)
+	if err != nil {
+		return err
+	}
+	return r.store.SetKey(prefixGrant+token, string(grantJSON), oauthRefreshExpire())
+}
+
+// MarkRefreshUsed marks a refresh token as exchanged. The counter is
+// incremented atomically, so only the first use of a token sees 1.
+func (r *RedisOsinStorageInterface) MarkRefreshUsed(token string) bool {
+	return r.store.IncrememntWithExpire(prefixUsed+token, oauthRefreshExpire()) > 1
+}
+
+// RefreshUsed reports whether a refresh token was marked as exchanged
+func (r *RedisOsinStorageInterface) RefreshUsed(token string) bool {
+	// The mark is set on a raw key, see MarkRefreshUsed
+	_, err := r.store.GetRawKey(prefixUsed + token)
+	return err == nil
+}
+
+// UnmarkRefreshUsed clears the exchange mark of a refresh token
+func (r *RedisOsinStorageInterface) UnmarkRefreshUsed(token string) {
+	r.store.DeleteRawKey(prefixUsed + token)
+}
+
+// LoadRefreshGrant loads the family of a refresh token
+func (r *RedisOsinStorageInterface) LoadRefreshGrant(token string) (*refreshGrant, error) {
+	grantJSON, err := r.store.GetKey(prefixGrant + token)
+	if err != nil {
+		return nil, err
+	}
+	grant := &refreshGrant{}
+	if err := json.Unmarshal([]byte(grantJSON), grant); err != nil {
+		return nil, err
+	}
+	return grant, nil
+}
+
+// SaveRefreshFamily stores the latest tokens of a family
+func (r *RedisOsinStorageInterface) SaveRefreshFamily(id string, family *refreshFamily) error {
+	familyJSON, err := json.Marshal(family)
+	if err != nil {
+		return err
+	}
+	return r.store.SetKey(prefixFamily+id, string(familyJSON), oauthRefreshExpire())
+}
+
+// LoadRefreshFamily loads the latest tokens of a family
+func (r *RedisOsinStorageInterface) LoadRefreshFamily(id string) (*refreshFamily, error) {
+	familyJSON, err := r.store.GetKey(prefixFamily + id)
+	if err != nil {
+		return nil, err
+	}
+	family := &refreshFamily{}
+	if err := json.Unmarshal([]byte(familyJSON), family); err != nil {
+		return nil, err
+	}
+	return family, nil
+}
+
+// RemoveRefreshFamily removes a family
+func (r *RedisOsinStorageInterface) RemoveRefreshFamily(id string) error {
+	r.store.DeleteKey(prefixFamily + id)
+	return nil
+}
@@ -18,8 +18,11 @@ type Policy struct {
 	OrgID            string                      `bson:"org_id" json:"org_id"`
 	Rate             float64                     `bson:"rate" json:"rate"`
 	Per              float64                     `bson:"per" json:"per"`
+	MaxConcurrent    int64                       `bson:"max_concurrent" json:"max_concurrent"`
 	QuotaMax         int64                       `bson:"quota_max" json:"quota_max"`
 	QuotaRenewalRate int64                       `bson:"quota_renewal_rate" json:"quota_renewal_rate"`
+	QuotaSchedule    QuotaSchedule               `bson:"quota_schedule" json:"quota_schedule"`
+	QuotaWindows     []QuotaWindow               `bson:"quota_windows" json:"quota_windows"`
 	AccessRights     map[string]AccessDefinition `bson:"access_rights" json:"access_rights"`
 	HMACEnabled      bool                        `bson:"hmac_enabled" json:"hmac_enabled"`
 	Active           bool                        `bson:"active" json:"active"`
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+)
+
+const defaultScopeClaimName = "scope"
+
+// scopePolicyIDs returns the sorted IDs of the policies the scopes of a
+// token map to. Scopes may be space separated or an array.
+func scopePolicyIDs(spec *APISpec, claims jwt.MapClaims) []string {
+	if len(spec.JWTScopeToPolicyMapping) == 0 {
+		return nil
+	}
+	claimName := spec.JWTScopeClaimName
+	if claimName == "" {
+		claimName = defaultScopeClaimName
+	}
+	return mapScopes(spec.JWTScopeToPolicyMapping, claimStrings(claims[claimName]))
+}
+
+// mapScopes returns the sorted IDs of the policies that space separated
+// scopes map to.
+func mapScopes(mapping map[string]string, values []string) []string {
+	var policyIDs []string
+	for _, value := range values {
+		for _, scope := range strings.Fields(value) {
+			policyID, ok := mapping[scope]
+			if ok && !stringInSlice(policyID, policyIDs) {
+				policyIDs = append(policyIDs, policyID)
+			}
+		}
+	}
+	sort.Strings(policyIDs)
+	return policyIDs
+}
+
+func samePolicies(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// loadPolicies looks up policies by ID, with the same org checks as a
+// single policy.
+func loadPolicies(policyIDs []string, orgID string, enforceOrg bool) ([]Policy, error) {
+	policies := make([]Policy, 0, len(policyIDs))
+	policiesMu.RLock()
+	defer policiesMu.RUnlock()
+	for _, policyID := range policyIDs {
+		policy, ok := policiesByID[policyID]
+		if !ok {
+			return nil, errors.New("Policy not found: " + policyID)
+		}
+		if enforceOrg && policy.OrgID != orgID {
+			log.Error("Attempting to apply policy from different organisation to key, skipping")
+			return nil, errors.New("Key not authorized: no matching policy")
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// generateSessionFromPolicies creates a session from several policies,
+// see mergePolicies.
+func generateSessionFromPolicies(policyIDs []string, orgID string, enforceOrg bool) (SessionState, error) {
+	session := SessionState{}
+	policies, err := loadPolicies(policyIDs, orgID, enforceOrg)
+	if err != nil {
+		return session, err
+	}
+	if !enforceOrg && len(policies) > 0 {
+		orgID = policies[0].OrgID
+	}
+
+	session.ApplyPolicies = policyIDs
+	session.OrgID = orgID
+	mergePolicies(&session, policies)
+
+	var expiresIn int64
+	for _, policy := range policies {
+		if policy.KeyExpiresIn > expiresIn {
+			expiresIn = policy.KeyExpiresIn
+		}
+	}
+	if expiresIn > 0 {
+		session.Expires = time.Now().Unix() + expiresIn
+	}
+	return session, nil
+}
+
+// mergePolicies applies several policies to a session. A partitioned
+// policy only contributes its partitions, others contribute everything.
+// The access rights of all policies are merged, and the most generous
+// rate limit and quota win.
+func mergePolicies(session *SessionState, policies []Policy) {
+	var rights map[string]AccessDefinition
+	hmacEnabled, isInactive := false, false
+	var tags []string
+	rateSet, quotaSet := false, false
+	var quotaWindows []QuotaWindow
+
+	for _, policy := range policies {
+		all := !policy.Partitions.Quota && !policy.Partitions.RateLimit && !policy.Partitions.Acl
+
+		if all || policy.Partitions.Quota {
+			if !quotaSet || quotaMoreGenerous(policy.QuotaMax, session.QuotaMax) {
+				session.QuotaMax = policy.QuotaMax
+				session.QuotaRenewalRate = policy.QuotaRenewalRate
+				session.QuotaSchedule = policy.QuotaSchedule
+			}
+			quotaWindows = mergeQuotaWindows(quotaWindows, policy.QuotaWindows)
+			quotaSet = true
+		}
+
+		if all || policy.Partitions.RateLimit {
+			if !rateSet || ratePerSecond(policy.Rate, policy.Per) > ratePerSecond(session.Rate, session.Per) {
+				session.Allowance = policy.Rate // This is a legacy thing, merely to make sure output is consistent. Needs to be purged
+				session.Rate = policy.Rate
+				session.Per = policy.Per
+				if policy.LastUpdated != "" {
+					session.LastUpdated = policy.LastUpdated
+				}
+			}
+			if !rateSet || concurrencyMoreGenerous(policy.MaxConcurrent, session.MaxConcurrent) {
+				session.MaxConcurrent = policy.MaxConcurrent
+			}
+			rateSet = true
+		}
+
+		if all || policy.Partitions.Acl {
+			if rights == nil {
+				rights = make(map[string]AccessDefinition)
+			}
+			for apiID, access := range policy.AccessRights {
+				if existing, ok := rights[apiID]; ok {
+					access = mergeAccessDefinitions(existing, access)
+				}
+				rights[apiID] = access
+			}
+			hmacEnabled = hmacEnabled || policy.HMACEnabled
+		}
+
+		isInactive = isInactive || policy.IsInactive
+		for _, tag := range policy.Tags {
+			if !stringInSlice(tag, tags) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	if quotaSet {
+		setQuotaWindows(session, quotaWindows)
+	}
+	if rights != nil {
+		session.AccessRights = rights
+		session.HMACEnabled = hmacEnabled
+	}
+	session.IsInactive = isInactive
+	session.Tags = tags
+}
+
+// mergeAccessDefinitions returns the union of two sets of access rights
+// to an API. No URL restrictions on either side means none at all.
+func mergeAccessDefinitions(a, b AccessDefinition) AccessDefinition {
+	merged := AccessDefinition{
+		APIName: a.APIName,
+		APIID:   a.APIID,
+		Limit:   moreGenerousLimit(a.Limit, b.Limit),
+	}
+	for _, versions := range [][]string{a.Versions, b.Versions} {
+		for _, version := range versions {
+			if !stringInSlice(version, merged.Versions) {
+				merged.Versions = append(merged.Versions, version)
+			}
+		}
+	}
+	if len(a.AllowedURLs) == 0 || len(b.AllowedURLs) == 0 {
+		return merged
+	}
+
+	byURL := make(map[string]int)
+	for _, specs := range [][]AccessSpec{a.AllowedURLs, b.AllowedURLs} {
+		for _, spec := range specs {
+			i, ok := byURL[spec.URL]
+			if !ok {
+				byURL[spec.URL] = len(merged.AllowedURLs)
+				merged.AllowedURLs = append(merged.AllowedURLs, AccessSpec{
+					URL:     spec.URL,
+					Methods: append([]string(nil), spec.Methods...),
+				})
+				continue
+			}
+			for _, method := range spec.Methods {
+				if !stringInSlice(method, merged.AllowedURLs[i].Methods) {
+					merged.AllowedURLs[i].Methods = append(merged.AllowedURLs[i].Methods, method)
+				}
+			}
+		}
+	}
+	return merged
+}
+
+// moreGenerousLimit returns the higher of two per-API rate limits. No
+// limit on either side leaves the key's own rate limit to apply.
+func moreGenerousLimit(a, b *APILimit) *APILimit {
+	if a == nil || b == nil {
+		return nil
+	}
+	if ratePerSecond(b.Rate, b.Per) > ratePerSecond(a.Rate, a.Per) {
+		return b
+	}
+	return a
+}
+
+// quotaMoreGenerous reports whether quota a allows more than b, -1
+// being unlimited.
+func quotaMoreGenerous(a, b int64) bool {
+	if b == -1 {
+		return false
+	}
+	return a == -1 || a > b
+}
+
+// concurrencyMoreGenerous reports whether concurrency limit a allows
+// more than b, 0 being unlimited.
+func concurrencyMoreGenerous(a, b int64) bool {
+	if b == 0 {
+		return false
+	}
+	return a == 0 || a > b
+}
+
+func ratePerSecond(rate, per float64) float64 {
+	if per <= 0 {
+		return rate
+	}
+	return rate / per
+}
+
+// applyPolicies re-applies the policies a session was created from, so
+// policy changes take effect like they do for ApplyPolicyID.
+func (t *BaseMiddleware) applyPolicies(key string, session *SessionState) {
+	policies, err := loadPolicies(session.ApplyPolicies, t.Spec.OrgID, true)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": "policy",
+		}).Error("Could not apply policies to key: ", err)
+		return
+	}
+	mergePolicies(session, policies)
+
+	// Update the session in the session manager in case it gets called again
+	t.Spec.SessionManager.UpdateSession(key, session, getLifetime(t.Spec, session))
+}
+
+// applyScopePolicies switches a session to the policies of a token's
+// scopes, if they changed since the session was created. Tokens whose
+// scopes map to no policies fall back to the base policy, so they don't
+// keep the policies of an earlier token with more scopes.
+func (t *BaseMiddleware) applyScopePolicies(key string, session *SessionState, policyIDs []string, basePolicyID string) error {
+	if len(policyIDs) == 0 {
+		if len(session.ApplyPolicies) == 0 {
+			return nil
+		}
+		if basePolicyID == "" {
+			return errors.New("no matching policy found")
+		}
+		log.Debug("Token has no mapped scopes, applying base policy: ", basePolicyID)
+		newSession, err := generateSessionFromPolicy(basePolicyID, t.Spec.OrgID, true)
+		if err != nil {
+			return err
+		}
+		newSession.MetaData = session.MetaData
+		newSession.Alias = session.Alias
+		*session = newSession
+		return t.Spec.SessionManager.UpdateSession(key, session, getLifetime(t.Spec, session))
+	}
+	if samePolicies(session.ApplyPolicies, policyIDs) {
+		return nil
+	}
+	log.Debug("Token scopes changed, applying policies: ", policyIDs)
+	session.ApplyPolicyID = ""
+	session.ApplyPolicies = policyIDs
+	t.applyPolicies(key, session)
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Quota schedule periods, rolling being the default
+const (
+	QuotaRolling = "rolling"
+	QuotaDaily   = "daily"
+	QuotaWeekly  = "weekly"
+	QuotaMonthly = "monthly"
+)
+
+// QuotaSchedule renews a quota at the start of calendar periods in a
+// timezone, rather than QuotaRenewalRate seconds after its first use.
+// AnchorDay is the day of the week periods start on for weekly quotas,
+// Sunday being 0, and the day of the month for monthly ones, falling back
+// to the last day of shorter months, 0 meaning the 1st.
+type QuotaSchedule struct {
+	Period    string `bson:"period" json:"period" msg:"period"`
+	Timezone  string `bson:"timezone" json:"timezone" msg:"timezone"`
+	AnchorDay int    `bson:"anchor_day" json:"anchor_day" msg:"anchor_day"`
+}
+
+func (s QuotaSchedule) validate() error {
+	switch s.Period {
+	case "", QuotaRolling, QuotaDaily:
+	case QuotaWeekly:
+		if s.AnchorDay < 0 || s.AnchorDay > 6 {
+			return errors.New("weekly anchor_day must be from 0 (Sunday) to 6")
+		}
+	case QuotaMonthly:
+		if s.AnchorDay < 0 || s.AnchorDay > 31 {
+			return errors.New("monthly anchor_day must be from 1 to 31, or 0 for the 1st")
+		}
+	default:
+		return errors.New("period must be rolling, daily, weekly or monthly")
+	}
+	if _, err := quotaLocation(s.Timezone); err != nil {
+		return err
+	}
+	return nil
+}
+
+// quotaLocations caches the timezones of quota schedules, which are
+// needed on every quota check
+var quotaLocations = struct {
+	sync.RWMutex
+	m map[string]cachedLocation
+}{m: make(map[string]cachedLocation)}
+
+type cachedLocation struct {
+	loc *time.Location
+	err error
+}
+
+// quotaLocation resolves a timezone once, returning UTC along with the
+// error for unknown ones.
+func quotaLocation(name string) (*time.Location, error) {
+	quotaLocations.RLock()
+	cached, ok := quotaLocations.m[name]
+	quotaLocations.RUnlock()
+	if ok {
+		return cached.loc, cached.err
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix":   "quota",
+			"timezone": name,
+		}).Warning("Unknown quota schedule timezone, using UTC")
+		loc = time.UTC
+	}
+	quotaLocations.Lock()
+	quotaLocations.m[name] = cachedLocation{loc, err}
+	quotaLocations.Unlock()
+	return loc, err
+}
+
+// nextReset returns the start of the period after the one now is in, or
+// false if the quota isn't renewed on a calendar.
+func (s QuotaSchedule) nextReset(now time.Time) (time.Time, bool) {
+	switch s.Period {
+	case QuotaDaily, QuotaWeekly, QuotaMonthly:
+	default:
+		return time.Time{}, false
+	}
+
+	loc, _ := quotaLocation(s.Timezone)
+	now = now.In(loc)
+	year, month, day := now.Date()
+
+	switch s.Period {
+	case QuotaDaily:
+		return time.Date(year, month, day+1, 0, 0, 0, 0, loc), true
+	case QuotaWeekly:
+		days := (s.AnchorDay - int(now.Weekday()) + 7) % 7
+		if days == 0 {
+			days = 7
+		}
+		return time.Date(year, month, day+days, 0, 0, 0, 0, loc), true
+	default:
+		reset := monthlyAnchor(year, month, s.AnchorDay, loc)
+		if !reset.After(now) {
+			reset = monthlyAnchor(year, month+1, s.AnchorDay, loc)
+		}
+		return reset, true
+	}
+}
+
+// monthlyAnchor returns the start of the anchor day in a month, or of its
+// last day if it's shorter.
+func monthlyAnchor(year int, month time.Month, anchorDay int, loc *time.Location) time.Time {
+	if anchorDay < 1 {
+		anchorDay = 1
+	}
+	// Day 0 of the next month is the last of this one
+	if lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day(); anchorDay > lastDay {
+		anchorDay = lastDay
+	}
+	return time.Date(year, month, anchorDay, 0, 0, 0, 0, loc)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotaScheduleNextReset(t *testing.T) {
+	// A Wednesday, 23:30 in UTC but already Thursday in Tokyo
+	now := time.Date(2017, time.January, 4, 23, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		schedule QuotaSchedule
+		want     string
+	}{
+		{"daily", QuotaSchedule{Period: QuotaDaily}, "2017-01-05T00:00:00Z"},
+		{"daily in timezone", QuotaSchedule{Period: QuotaDaily, Timezone: "Asia/Tokyo"}, "2017-01-06T00:00:00+09:00"},
+		{"weekly on sundays", QuotaSchedule{Period: QuotaWeekly}, "2017-01-08T00:00:00Z"},
+		{"weekly on today", QuotaSchedule{Period: QuotaWeekly, AnchorDay: 3}, "2017-01-11T00:00:00Z"},
+		{"monthly", QuotaSchedule{Period: QuotaMonthly}, "2017-02-01T00:00:00Z"},
+		{"monthly later this month", QuotaSchedule{Period: QuotaMonthly, AnchorDay: 15}, "2017-01-15T00:00:00Z"},
+		{"monthly on the 31st", QuotaSchedule{Period: QuotaMonthly, AnchorDay: 31}, "2017-01-31T00:00:00Z"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reset, ok := tc.schedule.nextReset(now)
+			if !ok {
+				t.Fatal("wanted a calendar reset")
+			}
+			if got := reset.Format(time.RFC3339); got != tc.want {
+				t.Errorf("wanted reset at %s, got %s", tc.want, got)
+			}
+		})
+	}
+
+	// Short months renew on their last day, and December rolls over
+	monthly := QuotaSchedule{Period: QuotaMonthly, AnchorDay: 31}
+	for now, want := range map[time.Time]string{
+		time.Date(2017, time.January, 31, 12, 0, 0, 0, time.UTC):  "2017-02-28T00:00:00Z",
+		time.Date(2017, time.December, 31, 12, 0, 0, 0, time.UTC): "2018-01-31T00:00:00Z",
+	} {
+		if reset, _ := monthly.nextReset(now); reset.Format(time.RFC3339) != want {
+			t.Errorf("wanted reset at %s after %s, got %s", want, now, reset.Format(time.RFC3339))
+		}
+	}
+
+	if _, ok := (QuotaSchedule{}).nextReset(now); ok {
+		t.Error("wanted rolling quotas not to have a calendar reset")
+	}
+}
+
+func TestQuotaScheduleValidate(t *testing.T) {
+	invalid := []QuotaSchedule{
+		{Period: "hourly"},
+		{Period: QuotaWeekly, AnchorDay: 7},
+		{Period: QuotaMonthly, AnchorDay: 32},
+		{Period: QuotaDaily, Timezone: "Mars/Olympus_Mons"},
+	}
+	for _, schedule := range invalid {
+		if schedule.validate() == nil {
+			t.Errorf("wanted %+v to be invalid", schedule)
+		}
+	}
+	// Timezones are cached, unknown ones included
+	if (QuotaSchedule{Timezone: "Mars/Olympus_Mons"}).validate() == nil {
+		t.Error("wanted a cached unknown timezone to be invalid")
+	}
+	if (QuotaSchedule{Period: QuotaMonthly}).validate() != nil {
+		t.Error("wanted monthly anchor_day 0 to be valid")
+	}
+	if err := (QuotaSchedule{Period: QuotaMonthly, Timezone: "Europe/London", AnchorDay: 1}).validate(); err != nil {
+		t.Error("wanted a valid schedule, got ", err)
+	}
+}
+
+func TestQuotaScheduleRenewal(t *testing.T) {
+	spec := createSpecTest(t, nonExpiringDefNoWhiteList)
+	session := createQuotaSession()
+	session.QuotaSchedule = QuotaSchedule{Period: QuotaDaily}
+	key := testKey(t, "key")
+	spec.SessionManager.ResetQuota(key, session)
+	defer spec.SessionManager.ResetQuota(key, session)
+
+	store := spec.SessionManager.GetStore()
+	if sessionLimiter.IsRedisQuotaExceeded(session, key, store) {
+		t.Fatal("wanted quota not to be exceeded on first use")
+	}
+	want, _ := session.QuotaSchedule.nextReset(time.Now())
+	if session.QuotaRenews != want.Unix() {
+		t.Errorf("wanted quota to renew at midnight %d, got %d", want.Unix(), session.QuotaRenews)
+	}
+}
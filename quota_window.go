@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// defaultQuotaWindow names a session's own quota, checked before its
+// other quota windows
+const defaultQuotaWindow = "default"
+
+// QuotaWindow is a quota counted apart from a session's own one, so that
+// e.g. an hourly and a monthly quota can both apply. QuotaRenews and
+// QuotaRemaining are kept up to date like those of the session.
+type QuotaWindow struct {
+	Name             string        `bson:"name" json:"name" msg:"name"`
+	QuotaMax         int64         `bson:"quota_max" json:"quota_max" msg:"quota_max"`
+	QuotaRenewalRate int64         `bson:"quota_renewal_rate" json:"quota_renewal_rate" msg:"quota_renewal_rate"`
+	QuotaSchedule    QuotaSchedule `bson:"quota_schedule" json:"quota_schedule" msg:"quota_schedule"`
+	QuotaRenews      int64         `bson:"quota_renews" json:"quota_renews" msg:"quota_renews"`
+	QuotaRemaining   int64         `bson:"quota_remaining" json:"quota_remaining" msg:"quota_remaining"`
+}
+
+// nextRenewal returns when the window counted from now renews, as a
+// unix time.
+func (w *QuotaWindow) nextRenewal(now time.Time) int64 {
+	if reset, ok := w.QuotaSchedule.nextReset(now); ok {
+		return reset.Unix()
+	}
+	return now.Unix() + w.QuotaRenewalRate
+}
+
+// resetsAt returns when the window renews next, as a unix time. If the
+// last period has ended, that's the end of the current one for calendar
+// schedules, rolling quotas only starting again on use.
+func (w *QuotaWindow) resetsAt(now time.Time) int64 {
+	if w.QuotaRenews > now.Unix() {
+		return w.QuotaRenews
+	}
+	if reset, ok := w.QuotaSchedule.nextReset(now); ok {
+		return reset.Unix()
+	}
+	return w.QuotaRenews
+}
+
+// ownQuotaWindow returns the session's own quota as a window
+func (s *SessionState) ownQuotaWindow() QuotaWindow {
+	return QuotaWindow{
+		Name:             defaultQuotaWindow,
+		QuotaMax:         s.QuotaMax,
+		QuotaRenewalRate: s.QuotaRenewalRate,
+		QuotaSchedule:    s.QuotaSchedule,
+		QuotaRenews:      s.QuotaRenews,
+		QuotaRemaining:   s.QuotaRemaining,
+	}
+}
+
+// nextQuotaRenewal returns when the session's quota counted from now
+// renews, as a unix time.
+func (s *SessionState) nextQuotaRenewal(now time.Time) int64 {
+	window := s.ownQuotaWindow()
+	return window.nextRenewal(now)
+}
+
+// quotaResetsAt returns when the session's quota renews next, as a unix
+// time.
+func (s *SessionState) quotaResetsAt(now time.Time) int64 {
+	window := s.ownQuotaWindow()
+	return window.resetsAt(now)
+}
+
+// quotaWindowKey returns the Redis counter of a session's quota window
+func quotaWindowKey(key, windowName string) string {
+	return QuotaKeyPrefix + publicHash(key) + "-" + windowName
+}
+
+// quotaWindowName names the window at index i, which may not have a name
+func quotaWindowName(window QuotaWindow, i int) string {
+	if window.Name != "" {
+		return window.Name
+	}
+	return strconv.Itoa(i)
+}
+
+func validateQuotaWindows(windows []QuotaWindow) error {
+	names := make(map[string]bool, len(windows))
+	for i, window := range windows {
+		name := quotaWindowName(window, i)
+		if name == defaultQuotaWindow || names[name] {
+			return errors.New("quota window names must be unique and not " + defaultQuotaWindow)
+		}
+		names[name] = true
+		if err := window.QuotaSchedule.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setQuotaWindows configures the quota windows of a session, keeping the
+// counted state of the windows it already has.
+func setQuotaWindows(session *SessionState, windows []QuotaWindow) {
+	current := make(map[string]QuotaWindow, len(session.QuotaWindows))
+	for i, window := range session.QuotaWindows {
+		current[quotaWindowName(window, i)] = window
+	}
+	session.QuotaWindows = make([]QuotaWindow, len(windows))
+	for i, window := range windows {
+		if existing, ok := current[quotaWindowName(window, i)]; ok {
+			window.QuotaRenews = existing.QuotaRenews
+			window.QuotaRemaining = existing.QuotaRemaining
+		}
+		session.QuotaWindows[i] = window
+	}
+	if len(windows) == 0 {
+		session.QuotaWindows = nil
+	}
+}
+
+// mergeQuotaWindows returns the quota windows of several policies, the
+// most generous winning where they have the same name.
+func mergeQuotaWindows(merged, windows []QuotaWindow) []QuotaWindow {
+	for i, window := range windows {
+		name := quotaWindowName(window, i)
+		window.Name = name
+		found := false
+		for j := range merged {
+			if quotaWindowName(merged[j], j) != name {
+				continue
+			}
+			found = true
+			if quotaMoreGenerous(window.QuotaMax, merged[j].QuotaMax) {
+				merged[j] = window
+			}
+		}
+		if !found {
+			merged = append(merged, window)
+		}
+	}
+	return merged
+}
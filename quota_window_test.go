@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk/apidef"
+	"github.com/TykTechnologies/tyk/config"
+)
+
+type eventRecorder chan config.EventMessage
+
+func (e eventRecorder) Init(interface{}) error { return nil }
+
+func (e eventRecorder) HandleEvent(em config.EventMessage) { e <- em }
+
+func TestQuotaWindows(t *testing.T) {
+	spec := createSpecTest(t, nonExpiringDefNoWhiteList)
+	events := make(eventRecorder, 1)
+	spec.EventPaths = map[apidef.TykEvent][]config.TykEventHandler{
+		EventQuotaExceeded: {events},
+	}
+
+	renews := time.Now().Unix() + 3600
+	session := createNonThrottledSession()
+	session.QuotaMax = -1
+	session.QuotaWindows = []QuotaWindow{
+		{QuotaMax: 1, QuotaRenewalRate: 3600, QuotaRenews: renews},
+		{Name: "monthly", QuotaMax: 5, QuotaSchedule: QuotaSchedule{Period: QuotaMonthly}, QuotaRenews: renews},
+	}
+	key := testKey(t, "key")
+	spec.SessionManager.UpdateSession(key, session, 60)
+	spec.SessionManager.ResetQuota(key, session)
+	defer spec.SessionManager.ResetQuota(key, session)
+
+	chain := getChain(spec)
+	req := testReq(t, "GET", "/", nil)
+	req.Header.Set("authorization", key)
+	for i, want := range []int{200, 403} {
+		recorder := httptest.NewRecorder()
+		chain.ServeHTTP(recorder, req)
+		if recorder.Code != want {
+			t.Fatalf("wanted request %d to return %d, got %d", i+1, want, recorder.Code)
+		}
+	}
+
+	select {
+	case em := <-events:
+		// Unnamed windows are named by their index
+		if window := em.Meta.(EventQuotaExceededMeta).Window; window != "0" {
+			t.Errorf(`wanted the "0" window to be exceeded, got %q`, window)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wanted a quota exceeded event")
+	}
+
+	// The rejected request wasn't counted against the monthly window
+	store := spec.SessionManager.GetStore()
+	if count, _ := store.GetRawKey(quotaWindowKey(key, "monthly")); count != "1" {
+		t.Errorf("wanted 1 request counted against the monthly window, got %q", count)
+	}
+}
+
+func TestMergeQuotaWindows(t *testing.T) {
+	merged := mergeQuotaWindows(nil, []QuotaWindow{{Name: "hourly", QuotaMax: 10}, {QuotaMax: 1}})
+	merged = mergeQuotaWindows(merged, []QuotaWindow{{Name: "hourly", QuotaMax: -1}, {Name: "daily", QuotaMax: 100}})
+
+	want := map[string]int64{"hourly": -1, "1": 1, "daily": 100}
+	if len(merged) != len(want) {
+		t.Fatalf("wanted %d windows, got %+v", len(want), merged)
+	}
+	for _, window := range merged {
+		if window.QuotaMax != want[window.Name] {
+			t.Errorf("wanted %q window to allow %d, got %d", window.Name, want[window.Name], window.QuotaMax)
+		}
+	}
+
+	if validateQuotaWindows([]QuotaWindow{{Name: "daily"}, {Name: "daily"}}) == nil {
+		t.Error("wanted duplicate window names to be invalid")
+	}
+	if validateQuotaWindows([]QuotaWindow{{Name: defaultQuotaWindow}}) == nil {
+		t.Error("wanted the default window name to be reserved")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	headerXRateLimitLimit     = "X-RateLimit-Limit"
+	headerXRateLimitRemaining = "X-RateLimit-Remaining"
+	headerXRateLimitReset     = "X-RateLimit-Reset"
+
+	// IETF draft headers, the reset being in seconds from now
+	headerRateLimitLimit     = "RateLimit-Limit"
+	headerRateLimitRemaining = "RateLimit-Remaining"
+	headerRateLimitReset     = "RateLimit-Reset"
+
+	headerRetryAfter = "Retry-After"
+)
+
+// quotaState describes the quota of a session like a rate limit, the
+// window with the fewest requests remaining if it has several. It returns
+// nil for sessions without a quota.
+func quotaState(session *SessionState) *rateLimitState {
+	var state *rateLimitState
+	windows := append([]QuotaWindow{session.ownQuotaWindow()}, session.QuotaWindows...)
+	for i, window := range windows {
+		if window.QuotaMax == -1 {
+			continue
+		}
+		if state == nil || window.QuotaRemaining < state.Remaining {
+			state = &rateLimitState{
+				Limit:     window.QuotaMax,
+				Remaining: window.QuotaRemaining,
+				Reset:     time.Unix(window.QuotaRenews, 0),
+				Window:    quotaWindowName(window, i-1),
+			}
+		}
+	}
+	return state
+}
+
+// setRateLimitHeaders tells the client about the limit its request was
+// counted against, falling back to the quota of its session. Requests
+// over the limit are told when to retry.
+func setRateLimitHeaders(h http.Header, r *http.Request) {
+	state := ctxGetRateLimitState(r)
+	if state == nil {
+		session := ctxGetSession(r)
+		if session == nil {
+			return
+		}
+		if state = quotaState(session); state == nil {
+			// Unlimited keys report their quota as before
+			state = &rateLimitState{
+				Limit:     session.QuotaMax,
+				Remaining: session.QuotaRemaining,
+				Reset:     time.Unix(session.QuotaRenews, 0),
+			}
+		}
+	}
+
+	h.Set(headerXRateLimitLimit, strconv.FormatInt(state.Limit, 10))
+	h.Set(headerXRateLimitRemaining, strconv.FormatInt(state.Remaining, 10))
+	h.Set(headerXRateLimitReset, strconv.FormatInt(state.Reset.Unix(), 10))
+
+	resetIn := secondsUntil(state.Reset)
+	if globalConf.EnableIETFRateLimitHeaders {
+		h.Set(headerRateLimitLimit, strconv.FormatInt(state.Limit, 10))
+		h.Set(headerRateLimitRemaining, strconv.FormatInt(state.Remaining, 10))
+		h.Set(headerRateLimitReset, strconv.FormatInt(resetIn, 10))
+	}
+	if state.Exceeded {
+		h.Set(headerRetryAfter, strconv.FormatInt(resetIn, 10))
+	}
+}
+
+// secondsUntil rounds up the time until t, which may have passed
+func secondsUntil(t time.Time) int64 {
+	d := time.Until(t)
+	if d <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(d.Seconds()))
+}
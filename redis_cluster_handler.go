@@ -227,7 +227,7 @@ func (r *RedisClusterStorageManager) Decrement(keyName string) {
 	keyName = r.fixKey(keyName)
 	log.Debug("Decrementing key: ", keyName)
 	r.ensureConnection()
-	err := GetRelevantClusterReference(r.IsCache).Send("DECR", keyName)
+	_, err := GetRelevantClusterReference(r.IsCache).Do("DECR", keyName)
 	if err != nil {
 		log.Error("Error trying to decrement value:", err)
 	}
@@ -252,6 +252,24 @@ func (r *RedisClusterStorageManager) IncrememntWithExpire(keyName string, expire
 	return val
 }
 
+// IncrementRawKey will increment a raw key in redis, returning errors
+// rather than a count of 0
+func (r *RedisClusterStorageManager) IncrementRawKey(keyName string) (int64, error) {
+	r.ensureConnection()
+	return redis.Int64(GetRelevantClusterReference(r.IsCache).Do("INCR", keyName))
+}
+
+// SetRawExp will reset the expiry of a raw key in redis
+func (r *RedisClusterStorageManager) SetRawExp(keyName string, timeout int64) error {
+	r.ensureConnection()
+	// This function uses a raw key, so we shouldn't call fixKey
+	_, err := GetRelevantClusterReference(r.IsCache).Do("EXPIRE", keyName, timeout)
+	if err != nil {
+		log.Error("Could not EXPIRE key: ", err)
+	}
+	return err
+}
+
 // GetKeys will return all keys according to the filter (filter is a prefix - e.g. tyk.keys.*)
 func (r *RedisClusterStorageManager) GetKeys(filter string) []string {
 	r.ensureConnection()
@@ -496,6 +514,24 @@ func (r *RedisClusterStorageManager) AppendToSet(keyName, value string) {
 	}
 }
 
+// AppendToSetPipelined appends all values to the list in a single round
+// trip.
+func (r *RedisClusterStorageManager) AppendToSetPipelined(keyName string, values []string) {
+	if len(values) == 0 {
+		return
+	}
+	log.Debug("Pushing ", len(values), " values to raw key list: ", keyName)
+	r.ensureConnection()
+	args := make([]interface{}, 0, len(values)+1)
+	args = append(args, r.fixKey(keyName))
+	for _, v := range values {
+		args = append(args, v)
+	}
+	if _, err := GetRelevantClusterReference(r.IsCache).Do("RPUSH", args...); err != nil {
+		log.Error("Error trying to append to set keys: ", err)
+	}
+}
+
 func (r *RedisClusterStorageManager) GetSet(keyName string) (map[string]string, error) {
 	log.Debug("Getting from key set: ", keyName)
 	log.Debug("Getting from fixed key set: ", r.fixKey(keyName))
@@ -18,6 +18,7 @@ const (
 	NoticeGatewayConfigResponse  NotificationCommand = "NoticeGatewayConfigResponse"
 	NoticeGatewayDRLNotification NotificationCommand = "NoticeGatewayDRLNotification"
 	NoticeGatewayLENotification  NotificationCommand = "NoticeGatewayLENotification"
+	NoticeTokenRevoked           NotificationCommand = "NoticeTokenRevoked"
 )
 
 // Notification is a type that encodes a message published to a pub sub channel (shared between implementations)
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"time"
@@ -80,6 +82,8 @@ func handleRedisEvent(v interface{}, handled func(NotificationCommand), reloaded
 		onServerStatusReceivedHandler(notif.Payload)
 	case NoticeGatewayLENotification:
 		onLESSLStatusReceivedHandler(notif.Payload)
+	case NoticeTokenRevoked:
+		onTokenRevoked(notif.Payload)
 	case NoticeApiUpdated, NoticeApiRemoved, NoticeApiAdded, NoticePolicyChanged, NoticeGroupReload:
 		log.WithFields(logrus.Fields{
 			"prefix": "pub-sub",
@@ -105,6 +109,12 @@ func isPayloadSignatureValid(notification Notification) bool {
 	case NoticeGatewayDRLNotification, NoticeGatewayLENotification:
 		// Gateway to gateway
 		return true
+	case NoticeTokenRevoked:
+		// Gateway to gateway, but it drops sessions so it must be signed
+		if globalConf.Secret == "" {
+			return false
+		}
+		return hmac.Equal([]byte(notification.Signature), []byte(gatewayNoticeSignature(notification)))
 	}
 
 	if notification.Signature == "" && globalConf.AllowInsecureConfigs {
@@ -151,3 +161,11 @@ func isPayloadSignatureValid(notification Notification) bool {
 
 	return false
 }
+
+// gatewayNoticeSignature signs a notification between gateways with their
+// shared secret, as they have no private key to sign it with.
+func gatewayNoticeSignature(notification Notification) string {
+	mac := hmac.New(sha256.New, []byte(globalConf.Secret))
+	mac.Write([]byte(string(notification.Command) + ":" + notification.Payload))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
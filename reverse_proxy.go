@@ -15,13 +15,13 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"regexp"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -104,9 +104,14 @@ func EnsureTransport(host string) string {
 	return "http://" + host
 }
 
-func nextTarget(targetData *apidef.HostList, spec *APISpec) string {
+func nextTarget(targetData *apidef.HostList, spec *APISpec, req *http.Request) string {
 	if spec.Proxy.EnableLoadBalancing {
 		log.Debug("[PROXY] [LOAD BALANCING] Load balancer enabled, getting upstream target")
+		switch spec.Proxy.LoadBalancing.Strategy {
+		case apidef.WeightedRoundRobinStrategy, apidef.LeastConnectionsStrategy, apidef.ConsistentHashStrategy:
+			return balancedTarget(targetData, spec, req)
+		}
+
 		// Use a HostList
 		// TODO: do better than a mutex to avoid contention
 		spec.RoundRobin.Lock()
@@ -124,11 +129,8 @@ func nextTarget(targetData *apidef.HostList, spec *APISpec) string {
 
 			host := EnsureTransport(gotHost)
 
-			if !spec.Proxy.CheckHostAgainstUptimeTests {
-				return host // we don't care if it's up
-			}
-			if !GlobalHostChecker.IsHostDown(host) {
-				return host // we do care and it's up
+			if !targetIsDown(host, spec) && !ctxGetTriedTargets(req)[host] {
+				return host // it's up, or we don't care
 			}
 			// if the host is down, keep trying all the rest
 			// in order from where we started.
@@ -181,13 +183,15 @@ func TykNewSingleHostReverseProxy(target *url.URL, spec *APISpec) *ReverseProxy
 			}
 			fallthrough // implies load balancing, with replaced host list
 		case spec.Proxy.EnableLoadBalancing:
-			lbRemote, err := url.Parse(nextTarget(hostList, spec))
+			lbTarget := nextTarget(hostList, spec, req)
+			lbRemote, err := url.Parse(lbTarget)
 			if err != nil {
 				log.Error("[PROXY] [LOAD BALANCING] Couldn't parse target URL:", err)
 			} else {
 				// Only replace target if everything is OK
 				target = lbRemote
 				targetQuery = target.RawQuery
+				ctxSetUpstreamTarget(req, lbTarget)
 			}
 		}
 
@@ -404,6 +408,73 @@ func (p *ReverseProxy) CheckCircuitBreakerEnforced(spec *APISpec, req *http.Requ
 	return false, nil
 }
 
+// CheckRetryPolicyEnforced returns the retry policy for the request, a
+// policy set on the path takes precedence over the API wide one.
+func (p *ReverseProxy) CheckRetryPolicyEnforced(spec *APISpec, req *http.Request) (*apidef.RetryPolicy, bool) {
+	if IsWebsocket(req) {
+		return nil, false
+	}
+
+	policy := &spec.Proxy.RetryPolicy
+	if spec.RetryPathsEnabled {
+		_, versionPaths, _, _ := spec.Version(req)
+		found, meta := spec.CheckSpecMatchesStatus(req, versionPaths, UpstreamRetry)
+		if found {
+			policy = &meta.(*apidef.RetryMeta).RetryPolicy
+			log.Debug("Retry policy enforced for path: ", *policy)
+		}
+	}
+
+	return policy, policy.MaxAttempts > 1
+}
+
+// isIdempotentRequest returns true for requests that can be safely
+// sent more than once, either because of their method (RFC 7231) or
+// because the client sent an Idempotency-Key.
+func isIdempotentRequest(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// isDialError returns true if the upstream connection could not be
+// established, so the request was never sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func shouldRetryUpstream(policy *apidef.RetryPolicy, attempt int, req *http.Request, res *http.Response, err error) bool {
+	if attempt >= policy.MaxAttempts {
+		return false
+	}
+
+	// Nothing reached the upstream, any method is safe to send again
+	if err != nil && isDialError(err) {
+		return policy.RetryOnConnectionErrors
+	}
+
+	if !policy.RetryNonIdempotent && !isIdempotentRequest(req) {
+		return false
+	}
+
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() || strings.Contains(err.Error(), "timeout awaiting response headers") {
+			return policy.RetryOnTimeouts
+		}
+		return policy.RetryOnConnectionErrors
+	}
+
+	for _, code := range policy.RetryOnStatusCodes {
+		if res.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
 func httpTransport(timeOut int, rw http.ResponseWriter, req *http.Request, p *ReverseProxy) http.RoundTripper {
 	transport := TykDefaultTransport
 	transport.TLSClientConfig.InsecureSkipVerify = globalConf.ProxySSLInsecureSkipVerify
@@ -474,61 +545,144 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 	}
 	outreq = outreq.WithContext(ctx)
 
-	outreq.Header = cloneHeader(req.Header)
-
-	p.Director(outreq)
-	outreq.Close = false
-
-	// Remove hop-by-hop headers listed in the "Connection" header.
-	// See RFC 2616, section 14.10.
-	if c := outreq.Header.Get("Connection"); c != "" {
-		for _, f := range strings.Split(c, ",") {
-			if f = strings.TrimSpace(f); f != "" {
-				outreq.Header.Del(f)
-			}
-		}
-	}
-
-	log.Debug("Outbound Request: ", outreq.URL.String())
-
-	// Do not modify outbound request headers if they are WS
-	if !IsWebsocket(outreq) {
-		// Remove hop-by-hop headers to the backend. Especially
-		// important is "Connection" because we want a persistent
-		// connection, regardless of what the client sent to us.
-		for _, h := range hopHeaders {
-			if outreq.Header.Get(h) != "" {
-				outreq.Header.Del(h)
-				logreq.Header.Del(h)
+	// Buffer the body so that it can be replayed on retries
+	retryPolicy, retryEnforced := p.CheckRetryPolicyEnforced(p.TykAPISpec, req)
+	var replayBody []byte
+	if retryEnforced {
+		if outreq.Body != nil {
+			var err error
+			replayBody, err = ioutil.ReadAll(outreq.Body)
+			outreq.Body.Close()
+			if err != nil {
+				log.Error("Failed to buffer request body for retries: ", err)
+				p.ErrorHandler.HandleError(rw, logreq, "There was a problem proxying the request", 500)
+				return nil
 			}
 		}
+		setCtxValue(outreq, TriedTargets, make(map[string]bool))
 	}
-
+	baseReq, baseURL := outreq, *req.URL
 	addrs := requestAddrs(req)
-	outreq.Header.Set("X-Forwarded-For", addrs)
 
 	// Circuit breaker
 	breakerEnforced, breakerConf := p.CheckCircuitBreakerEnforced(p.TykAPISpec, req)
 
 	var res *http.Response
 	var err error
-	if breakerEnforced {
-		log.Debug("ON REQUEST: Breaker status: ", breakerConf.CB.Ready())
-		if breakerConf.CB.Ready() {
-			res, err = transport.RoundTrip(outreq)
-			if err != nil {
-				breakerConf.CB.Fail()
-			} else if res.StatusCode == 500 {
-				breakerConf.CB.Fail()
+	for attempt := 1; ; attempt++ {
+		outreq = new(http.Request)
+		*outreq = *baseReq
+		if attempt > 1 {
+			// the director rewrote the URL in place last time
+			retryURL := baseURL
+			outreq.URL = &retryURL
+		}
+		if replayBody != nil {
+			outreq.Body = ioutil.NopCloser(bytes.NewReader(replayBody))
+		}
+		outreq.Header = cloneHeader(req.Header)
+
+		p.Director(outreq)
+		outreq.Close = false
+
+		// Remove hop-by-hop headers listed in the "Connection" header.
+		// See RFC 2616, section 14.10.
+		if c := outreq.Header.Get("Connection"); c != "" {
+			for _, f := range strings.Split(c, ",") {
+				if f = strings.TrimSpace(f); f != "" {
+					outreq.Header.Del(f)
+				}
+			}
+		}
+
+		log.Debug("Outbound Request: ", outreq.URL.String())
+
+		// Do not modify outbound request headers if they are WS
+		if !IsWebsocket(outreq) {
+			// Remove hop-by-hop headers to the backend. Especially
+			// important is "Connection" because we want a persistent
+			// connection, regardless of what the client sent to us.
+			for _, h := range hopHeaders {
+				if outreq.Header.Get(h) != "" {
+					outreq.Header.Del(h)
+					logreq.Header.Del(h)
+				}
+			}
+		}
+
+		outreq.Header.Set("X-Forwarded-For", addrs)
+
+		span := StartSpan(req, "upstream", spanKindClient)
+		if span != nil {
+			span.SetAttribute("http.method", outreq.Method)
+			span.SetAttribute("http.url", spanURL(outreq.URL))
+			span.SetAttribute("tyk.retry_attempt", attempt)
+			outreq.Header.Set(traceParentHeader, span.TraceParent())
+		}
+
+		if breakerEnforced {
+			log.Debug("ON REQUEST: Breaker status: ", breakerConf.CB.Ready())
+			if breakerConf.CB.Ready() {
+				res, err = transport.RoundTrip(outreq)
+				if err != nil {
+					breakerConf.CB.Fail()
+				} else if res.StatusCode == 500 {
+					breakerConf.CB.Fail()
+				} else {
+					breakerConf.CB.Success()
+				}
 			} else {
-				breakerConf.CB.Success()
+				if host := ctxGetInFlightHost(outreq); host != "" {
+					p.TykAPISpec.UpstreamLoad.Release(host)
+				}
+				span.SetError("circuit breaker open")
+				span.Finish()
+				p.ErrorHandler.HandleError(rw, logreq, "Service temporarily unnavailable.", 503)
+				return nil
 			}
 		} else {
-			p.ErrorHandler.HandleError(rw, logreq, "Service temporarily unnavailable.", 503)
-			return nil
+			res, err = transport.RoundTrip(outreq)
+		}
+
+		if err != nil {
+			span.SetError(err.Error())
+		} else {
+			span.SetAttribute("http.status_code", res.StatusCode)
+		}
+		span.Finish()
+		reportUpstreamError(p.TykAPISpec, req, res, err)
+
+		target := ctxGetUpstreamTarget(outreq)
+		if p.TykAPISpec.Proxy.PassiveHealthCheck.Enabled && target != "" {
+			p.TykAPISpec.Outliers.RecordResult(p.TykAPISpec, target, res, err)
+		}
+
+		host := ctxGetInFlightHost(outreq)
+		if !retryEnforced || ctx.Err() != nil || !shouldRetryUpstream(retryPolicy, attempt, outreq, res, err) {
+			if host != "" {
+				defer p.TykAPISpec.UpstreamLoad.Release(host)
+			}
+			break
 		}
-	} else {
-		res, err = transport.RoundTrip(outreq)
+
+		// Retrying, let go of this attempt and move on to another target
+		if host != "" {
+			p.TykAPISpec.UpstreamLoad.Release(host)
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		if target != "" {
+			ctxGetTriedTargets(outreq)[target] = true
+		}
+		ctxSetRetries(req, attempt)
+		ctxSetRetries(logreq, attempt)
+		log.WithFields(logrus.Fields{
+			"prefix":      "proxy",
+			"server_name": outreq.Host,
+			"org_id":      p.TykAPISpec.OrgID,
+			"api_id":      p.TykAPISpec.APIID,
+		}).Warning("Retrying upstream request, attempt ", attempt+1, " of ", retryPolicy.MaxAttempts)
 	}
 
 	if err != nil {
@@ -614,11 +768,11 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 	// We should at least copy the status code in
 	inres.StatusCode = res.StatusCode
 	inres.ContentLength = res.ContentLength
-	p.HandleResponse(rw, res, ses)
+	p.HandleResponse(rw, res, req)
 	return inres
 }
 
-func (p *ReverseProxy) HandleResponse(rw http.ResponseWriter, res *http.Response, ses *SessionState) error {
+func (p *ReverseProxy) HandleResponse(rw http.ResponseWriter, res *http.Response, req *http.Request) error {
 
 	// Remove hop-by-hop headers listed in the
 	// "Connection" header of the response.
@@ -641,12 +795,7 @@ func (p *ReverseProxy) HandleResponse(rw http.ResponseWriter, res *http.Response
 	}
 
 	// Add resource headers
-	if ses != nil {
-		// We have found a session, lets report back
-		res.Header.Set("X-RateLimit-Limit", strconv.Itoa(int(ses.QuotaMax)))
-		res.Header.Set("X-RateLimit-Remaining", strconv.Itoa(int(ses.QuotaRemaining)))
-		res.Header.Set("X-RateLimit-Reset", strconv.Itoa(int(ses.QuotaRenews)))
-	}
+	setRateLimitHeaders(res.Header, req)
 
 	copyHeader(rw.Header(), res.Header)
 
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/TykTechnologies/tyk/apidef"
@@ -55,3 +62,120 @@ func TestReverseProxyRetainHost(t *testing.T) {
 		})
 	}
 }
+
+const retryTestAPI = `{
+	"api_id": "retries",
+	"use_keyless": true,
+	"version_data": {
+		"not_versioned": true,
+		"versions": {
+			"Default": {"name": "Default"}
+		}
+	},
+	"proxy": {
+		"listen_path": "/",
+		"enable_load_balancing": true,
+		"target_list": ["{{.Failing}}", "` + testHttpAny + `"],
+		"retry_policy": {
+			"max_attempts": 2,
+			"retry_on_status_codes": [503],
+			"retry_on_connection_errors": true
+		}
+	}
+}`
+
+func createRetrySpec(t *testing.T, failing string) *APISpec {
+	def := strings.Replace(retryTestAPI, "{{.Failing}}", failing, 1)
+	spec := createSpecTest(t, def)
+	spec.Proxy.StructuredTargetList = apidef.NewHostListFromList(spec.Proxy.Targets)
+	return spec
+}
+
+func TestProxyRetries(t *testing.T) {
+	var hits int32
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(503)
+	}))
+	defer unavailable.Close()
+
+	cases := []struct {
+		name     string
+		failing  string
+		method   string
+		want200  int
+		wantHits int32
+	}{
+		// each retry moves the round robin on as well
+		{"status-idempotent", unavailable.URL, "GET", 4, 4},
+		{"status-non-idempotent", unavailable.URL, "POST", 2, 2},
+		{"connection-refused", testHttpFailureAny, "POST", 4, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := createRetrySpec(t, tc.failing)
+			remote, _ := url.Parse(spec.Proxy.TargetURL)
+			proxyHandler := ProxyHandler(TykNewSingleHostReverseProxy(remote, spec), spec)
+			atomic.StoreInt32(&hits, 0)
+
+			// round robin alternates between the failing and the good host
+			got200 := 0
+			for i := 0; i < 4; i++ {
+				rec := httptest.NewRecorder()
+				req := testReq(t, tc.method, "/", "foo=bar")
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				proxyHandler.ServeHTTP(rec, req)
+				if rec.Code != 200 {
+					continue
+				}
+				got200++
+				var resp testHttpResponse
+				if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+					t.Fatal("JSON decoding failed:", err)
+				}
+				if tc.method == "POST" && resp.Form["foo"] != "bar" {
+					t.Fatalf("request body was not replayed, got form %v", resp.Form)
+				}
+			}
+			if got200 != tc.want200 {
+				t.Errorf("wanted %d successful requests, got %d", tc.want200, got200)
+			}
+			if got := atomic.LoadInt32(&hits); got != tc.wantHits {
+				t.Errorf("wanted %d requests to the failing host, got %d", tc.wantHits, got)
+			}
+		})
+	}
+}
+
+func TestShouldRetryUpstream(t *testing.T) {
+	policy := &apidef.RetryPolicy{MaxAttempts: 3, RetryOnStatusCodes: []int{502}, RetryOnTimeouts: true}
+	get := testReq(t, "GET", "/", nil)
+	post := testReq(t, "POST", "/", nil)
+	keyed := testReq(t, "POST", "/", nil)
+	keyed.Header.Set("Idempotency-Key", "abc")
+	res502 := &http.Response{StatusCode: 502}
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+
+	cases := []struct {
+		name    string
+		attempt int
+		req     *http.Request
+		res     *http.Response
+		err     error
+		want    bool
+	}{
+		{"status", 1, get, res502, nil, true},
+		{"status-last-attempt", 3, get, res502, nil, false},
+		{"status-not-listed", 1, get, &http.Response{StatusCode: 500}, nil, false},
+		{"status-post", 1, post, res502, nil, false},
+		{"status-idempotency-key", 1, keyed, res502, nil, true},
+		{"dial-not-enabled", 1, post, nil, dialErr, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := shouldRetryUpstream(policy, tc.attempt, tc.req, tc.res, tc.err); got != tc.want {
+				t.Fatalf("wanted %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
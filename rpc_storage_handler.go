@@ -573,6 +573,12 @@ func (r *RPCStorageHandler) AppendToSet(keyName, value string) {
 
 }
 
+func (r *RPCStorageHandler) AppendToSetPipelined(keyName string, values []string) {
+	for _, v := range values {
+		r.AppendToSet(keyName, v)
+	}
+}
+
 // SetScrollingWindow is used in the rate limiter to handle rate limits fairly.
 func (r *RPCStorageHandler) SetRollingWindow(keyName string, per int64, val string) (int, []interface{}) {
 	start := time.Now() // get current time
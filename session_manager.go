@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/TykTechnologies/leakybucket"
@@ -28,14 +29,25 @@ const (
 // check if a message should pass through or not
 type SessionLimiter struct{}
 
-func (SessionLimiter) doRollingWindowWrite(key, rateLimiterKey, rateLimiterSentinelKey string, currentSession *SessionState, store StorageHandler) bool {
+// rateLimitState describes a limit after a request was counted against
+// it, for the rate limit headers of the response.
+type rateLimitState struct {
+	Limit     int64
+	Remaining int64
+	Reset     time.Time // when the limit has room again
+	Exceeded  bool
+	Window    string // the name of a quota window
+}
+
+func (SessionLimiter) doRollingWindowWrite(key, rateLimiterKey, rateLimiterSentinelKey string, rate, per float64, store StorageHandler) rateLimitState {
 	log.Debug("[RATELIMIT] Inbound raw key is: ", key)
 	log.Debug("[RATELIMIT] Rate limiter key is: ", rateLimiterKey)
 	var ratePerPeriodNow int
+	var window []interface{}
 	if globalConf.EnableNonTransactionalRateLimiter {
-		ratePerPeriodNow, _ = store.SetRollingWindowPipeline(rateLimiterKey, int64(currentSession.Per), "-1")
+		ratePerPeriodNow, window = store.SetRollingWindowPipeline(rateLimiterKey, int64(per), "-1")
 	} else {
-		ratePerPeriodNow, _ = store.SetRollingWindow(rateLimiterKey, int64(currentSession.Per), "-1")
+		ratePerPeriodNow, window = store.SetRollingWindow(rateLimiterKey, int64(per), "-1")
 	}
 
 	//log.Info("Num Requests: ", ratePerPeriodNow)
@@ -47,17 +59,110 @@ func (SessionLimiter) doRollingWindowWrite(key, rateLimiterKey, rateLimiterSenti
 		subtractor = 2
 	}
 
-	//log.Info("break: ", (int(currentSession.Rate) - subtractor))
+	//log.Info("break: ", (int(rate) - subtractor))
+
+	allowed := int(rate) - subtractor
+	state := rateLimitState{
+		Limit:     int64(rate),
+		Remaining: int64(allowed - ratePerPeriodNow),
+		Reset:     rollingWindowReset(window, ratePerPeriodNow-allowed, per),
+	}
+	if state.Remaining < 0 {
+		state.Remaining = 0
+	}
 
-	if ratePerPeriodNow > int(currentSession.Rate)-subtractor {
+	if ratePerPeriodNow > allowed {
 		// Set a sentinel value with expire
 		if globalConf.EnableSentinelRateLImiter {
-			store.SetRawKey(rateLimiterSentinelKey, "1", int64(currentSession.Per))
+			store.SetRawKey(rateLimiterSentinelKey, "1", int64(per))
 		}
-		return true
+		state.Exceeded = true
 	}
 
-	return false
+	return state
+}
+
+// rollingWindowReset returns when the request at index i of a rolling
+// window leaves it, making room for another one. Requests are stored
+// with their time in nanoseconds, the one just made not being in the
+// window yet.
+func rollingWindowReset(window []interface{}, i int, per float64) time.Time {
+	now := time.Now()
+	if i < 0 {
+		i = 0
+	}
+	if i < len(window) {
+		if value, ok := window[i].([]byte); ok {
+			if nanos, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+				return time.Unix(0, nanos).Add(time.Duration(per) * time.Second)
+			}
+		}
+	}
+	return now.Add(time.Duration(per) * time.Second)
+}
+
+// limitRate counts a request against a limit of rate requests every per
+// seconds, with whichever rate limiter the gateway is configured to use.
+// key identifies the limit in Redis, bucketKey in memory.
+func (l SessionLimiter) limitRate(key, bucketKey string, rate, per float64, store StorageHandler) rateLimitState {
+	rateLimiterKey := RateLimitKeyPrefix + publicHash(key)
+	rateLimiterSentinelKey := RateLimitKeyPrefix + publicHash(key) + ".BLOCKED"
+
+	if globalConf.EnableSentinelRateLImiter {
+		go l.doRollingWindowWrite(key, rateLimiterKey, rateLimiterSentinelKey, rate, per, store)
+
+		// Check sentinel, the window is only known once written
+		_, sentinelActive := store.GetRawKey(rateLimiterSentinelKey)
+		if sentinelActive == nil {
+			// Sentinel is set, fail
+			return rateLimitState{
+				Limit:    int64(rate),
+				Reset:    time.Now().Add(time.Duration(per) * time.Second),
+				Exceeded: true,
+			}
+		}
+		return rateLimitState{}
+	}
+
+	if globalConf.EnableRedisRollingLimiter {
+		return l.doRollingWindowWrite(key, rateLimiterKey, rateLimiterSentinelKey, rate, per, store)
+	}
+
+	// In-memory limiter
+	if BucketStore == nil {
+		initBucketStore()
+	}
+
+	// DRL will always overflow with more servers on low rates
+	bucketRate := uint(rate * float64(DRLManager.RequestTokenValue))
+	if bucketRate < uint(DRLManager.CurrentTokenValue) {
+		bucketRate = uint(DRLManager.CurrentTokenValue)
+	}
+
+	userBucket, err := BucketStore.Create(bucketKey,
+		bucketRate,
+		time.Duration(per)*time.Second)
+	if err != nil {
+		log.Error("Failed to create bucket!")
+		return rateLimitState{
+			Limit:    int64(rate),
+			Reset:    time.Now().Add(time.Duration(per) * time.Second),
+			Exceeded: true,
+		}
+	}
+
+	//log.Info("Add is: ", DRLManager.CurrentTokenValue)
+	bucketState, errF := userBucket.Add(uint(DRLManager.CurrentTokenValue))
+
+	state := rateLimitState{
+		Limit:    int64(rate),
+		Reset:    bucketState.Reset,
+		Exceeded: errF != nil,
+	}
+	if DRLManager.CurrentTokenValue > 0 {
+		state.Remaining = int64(bucketState.Remaining) / int64(DRLManager.CurrentTokenValue)
+	}
+	return state
 }
 
 type sessionFailReason uint
@@ -71,55 +176,26 @@ const (
 // ForwardMessage will enforce rate limiting, returning a non-zero
 // sessionFailReason if session limits have been exceeded.
 // Key values to manage rate are Rate and Per, e.g. Rate of 10 messages
-// Per 10 seconds
-func (l SessionLimiter) ForwardMessage(currentSession *SessionState, key string, store StorageHandler, enableRL, enableQ bool) sessionFailReason {
-	rateLimiterKey := RateLimitKeyPrefix + publicHash(key)
-	rateLimiterSentinelKey := RateLimitKeyPrefix + publicHash(key) + ".BLOCKED"
-
+// Per 10 seconds. If the session has a limit of its own for the API, that
+// is enforced instead, apart from the session's other APIs. The state of
+// the rate limit is returned too.
+func (l SessionLimiter) ForwardMessage(currentSession *SessionState, key, apiID string, store StorageHandler, enableRL, enableQ bool) (sessionFailReason, rateLimitState) {
+	var state rateLimitState
 	if enableRL {
-		if globalConf.EnableSentinelRateLImiter {
-			go l.doRollingWindowWrite(key, rateLimiterKey, rateLimiterSentinelKey, currentSession, store)
-
-			// Check sentinel
-			_, sentinelActive := store.GetRawKey(rateLimiterSentinelKey)
-			if sentinelActive == nil {
-				// Sentinel is set, fail
-				return sessionFailRateLimit
-			}
-		} else if globalConf.EnableRedisRollingLimiter {
-			if l.doRollingWindowWrite(key, rateLimiterKey, rateLimiterSentinelKey, currentSession, store) {
-				return sessionFailRateLimit
-			}
-		} else {
-			// In-memory limiter
-			if BucketStore == nil {
-				initBucketStore()
-			}
-
-			// If a token has been updated, we must ensure we dont use
-			// an old bucket an let the cache deal with it
-			bucketKey := key + ":" + currentSession.LastUpdated
-
-			// DRL will always overflow with more servers on low rates
-			rate := uint(currentSession.Rate * float64(DRLManager.RequestTokenValue))
-			if rate < uint(DRLManager.CurrentTokenValue) {
-				rate = uint(DRLManager.CurrentTokenValue)
-			}
-
-			userBucket, err := BucketStore.Create(bucketKey,
-				rate,
-				time.Duration(currentSession.Per)*time.Second)
-			if err != nil {
-				log.Error("Failed to create bucket!")
-				return sessionFailRateLimit
-			}
+		limitKey := key
+		rate, per := currentSession.Rate, currentSession.Per
+		if access, ok := currentSession.AccessRights[apiID]; ok && access.Limit != nil {
+			limitKey = key + ":" + apiID
+			rate, per = access.Limit.Rate, access.Limit.Per
+		}
 
-			//log.Info("Add is: ", DRLManager.CurrentTokenValue)
-			_, errF := userBucket.Add(uint(DRLManager.CurrentTokenValue))
+		// If a token has been updated, we must ensure we dont use
+		// an old bucket an let the cache deal with it
+		bucketKey := limitKey + ":" + currentSession.LastUpdated
 
-			if errF != nil {
-				return sessionFailRateLimit
-			}
+		state = l.limitRate(limitKey, bucketKey, rate, per, store)
+		if state.Exceeded {
+			return sessionFailRateLimit, state
 		}
 	}
 
@@ -128,12 +204,17 @@ func (l SessionLimiter) ForwardMessage(currentSession *SessionState, key string,
 			currentSession.Allowance--
 		}
 
-		if l.IsRedisQuotaExceeded(currentSession, key, store) {
-			return sessionFailQuota
+		if window, name := l.exceededQuotaWindow(currentSession, key, store); window != nil {
+			return sessionFailQuota, rateLimitState{
+				Limit:    window.QuotaMax,
+				Reset:    time.Unix(window.QuotaRenews, 0),
+				Exceeded: true,
+				Window:   name,
+			}
 		}
 	}
 
-	return sessionFailNone
+	return sessionFailNone, state
 
 }
 
@@ -143,28 +224,93 @@ func initBucketStore() {
 	BucketStore = memorycache.New()
 }
 
-func (SessionLimiter) IsRedisQuotaExceeded(currentSession *SessionState, key string, store StorageHandler) bool {
+// IsRedisQuotaExceeded counts a request against the quotas of a session,
+// see exceededQuotaWindow.
+func (l SessionLimiter) IsRedisQuotaExceeded(currentSession *SessionState, key string, store StorageHandler) bool {
+	window, _ := l.exceededQuotaWindow(currentSession, key, store)
+	return window != nil
+}
+
+// exceededQuotaWindow counts a request against the session's own quota
+// and its quota windows, each in its own counter. It returns the first one
+// exhausted and its name. Windows are only counted once none of them is
+// exhausted, so rejected requests don't use up the others.
+func (l SessionLimiter) exceededQuotaWindow(currentSession *SessionState, key string, store StorageHandler) (*QuotaWindow, string) {
+	own := currentSession.ownQuotaWindow()
+	defer func() {
+		currentSession.QuotaRenews = own.QuotaRenews
+		currentSession.QuotaRemaining = own.QuotaRemaining
+	}()
+
+	windows := []*QuotaWindow{&own}
+	names := []string{defaultQuotaWindow}
+	rawKeys := []string{QuotaKeyPrefix + publicHash(key)}
+	for i := range currentSession.QuotaWindows {
+		name := quotaWindowName(currentSession.QuotaWindows[i], i)
+		windows = append(windows, &currentSession.QuotaWindows[i])
+		names = append(names, name)
+		rawKeys = append(rawKeys, quotaWindowKey(key, name))
+	}
+
+	for i, window := range windows {
+		if quotaWindowExhausted(window, rawKeys[i], store) {
+			window.QuotaRemaining = 0
+			return window, names[i]
+		}
+	}
+	// Concurrent requests may still exhaust a window in between
+	for i, window := range windows {
+		if l.redisQuotaExceeded(window, key, rawKeys[i], store) {
+			return window, names[i]
+		}
+	}
+	return nil, ""
+}
+
+// quotaWindowExhausted checks whether a window has no requests left,
+// without counting one against it.
+func quotaWindowExhausted(window *QuotaWindow, rawKey string, store StorageHandler) bool {
+	if window.QuotaMax == -1 {
+		return false
+	}
+	// A period that has ended is corrected once the request is counted
+	if time.Now().After(time.Unix(window.QuotaRenews, 0)) {
+		return false
+	}
+	value, err := store.GetRawKey(rawKey)
+	if err != nil {
+		return false
+	}
+	count, _ := strconv.ParseInt(value, 10, 64)
+	return count >= window.QuotaMax
+}
+
+func (SessionLimiter) redisQuotaExceeded(window *QuotaWindow, key, rawKey string, store StorageHandler) bool {
 
 	// Are they unlimited?
-	if currentSession.QuotaMax == -1 {
+	if window.QuotaMax == -1 {
 		// No quota set
 		return false
 	}
 
 	// Create the key
 	log.Debug("[QUOTA] Inbound raw key is: ", key)
-	rawKey := QuotaKeyPrefix + publicHash(key)
 	log.Debug("[QUOTA] Quota limiter key is: ", rawKey)
-	log.Debug("Renewing with TTL: ", currentSession.QuotaRenewalRate)
+
+	// Calendar schedules renew at the end of the current period,
+	// however long until then
+	now := time.Now()
+	renews := window.nextRenewal(now)
+	log.Debug("Renewing with TTL: ", renews-now.Unix())
 	// INCR the key (If it equals 1 - set EXPIRE)
-	qInt := store.IncrememntWithExpire(rawKey, currentSession.QuotaRenewalRate)
+	qInt := store.IncrememntWithExpire(rawKey, renews-now.Unix())
 
 	// if the returned val is >= quota: block
-	if qInt-1 >= currentSession.QuotaMax {
-		renewalDate := time.Unix(currentSession.QuotaRenews, 0)
+	if qInt-1 >= window.QuotaMax {
+		renewalDate := time.Unix(window.QuotaRenews, 0)
 		log.Debug("Renewal Date is: ", renewalDate)
-		log.Debug("As epoch: ", currentSession.QuotaRenews)
-		log.Debug("Session: ", currentSession)
+		log.Debug("As epoch: ", window.QuotaRenews)
+		log.Debug("Quota window: ", window.Name)
 		log.Debug("Now:", time.Now())
 		if time.Now().After(renewalDate) {
 			// The renewal date is in the past, we should update the quota!
@@ -173,7 +319,7 @@ func (SessionLimiter) IsRedisQuotaExceeded(currentSession *SessionState, key str
 			go store.DeleteRawKey(rawKey)
 			qInt = 1
 		} else {
-			// Renewal date is in the future and the quota is exceeded
+			// Renewal date is in the future and the quota is exceeded
 			return true
 		}
 
@@ -181,17 +327,16 @@ func (SessionLimiter) IsRedisQuotaExceeded(currentSession *SessionState, key str
 
 	// If this is a new Quota period, ensure we let the end user know
 	if qInt == 1 {
-		current := time.Now().Unix()
-		currentSession.QuotaRenews = current + currentSession.QuotaRenewalRate
+		window.QuotaRenews = renews
 	}
 
 	// If not, pass and set the values of the session to quotamax - counter
-	remaining := currentSession.QuotaMax - qInt
+	remaining := window.QuotaMax - qInt
 
 	if remaining < 0 {
-		currentSession.QuotaRemaining = 0
+		window.QuotaRemaining = 0
 	} else {
-		currentSession.QuotaRemaining = remaining
+		window.QuotaRemaining = remaining
 	}
 	return false
 }
@@ -20,12 +20,20 @@ type AccessSpec struct {
 	Methods []string `json:"methods" msg:"methods"`
 }
 
-// AccessDefinition defines which versions of an API a key has access to
+// APILimit is a rate limit a key has for a single API
+type APILimit struct {
+	Rate float64 `json:"rate" msg:"rate"`
+	Per  float64 `json:"per" msg:"per"`
+}
+
+// AccessDefinition defines which versions of an API a key has access to,
+// and optionally a rate limit for it replacing the key's own
 type AccessDefinition struct {
 	APIName     string       `json:"api_name" msg:"api_name"`
 	APIID       string       `json:"api_id" msg:"api_id"`
 	Versions    []string     `json:"versions" msg:"versions"`
 	AllowedURLs []AccessSpec `bson:"allowed_urls"  json:"allowed_urls" msg:"allowed_urls"` // mapped string MUST be a valid regex
+	Limit       *APILimit    `json:"limit,omitempty" msg:"limit"`
 }
 
 // SessionState objects represent a current API session, mainly used for rate limiting.
@@ -34,11 +42,14 @@ type SessionState struct {
 	Allowance        float64                     `json:"allowance" msg:"allowance"`
 	Rate             float64                     `json:"rate" msg:"rate"`
 	Per              float64                     `json:"per" msg:"per"`
+	MaxConcurrent    int64                       `json:"max_concurrent" msg:"max_concurrent"`
 	Expires          int64                       `json:"expires" msg:"expires"`
 	QuotaMax         int64                       `json:"quota_max" msg:"quota_max"`
 	QuotaRenews      int64                       `json:"quota_renews" msg:"quota_renews"`
 	QuotaRemaining   int64                       `json:"quota_remaining" msg:"quota_remaining"`
 	QuotaRenewalRate int64                       `json:"quota_renewal_rate" msg:"quota_renewal_rate"`
+	QuotaSchedule    QuotaSchedule               `json:"quota_schedule" msg:"quota_schedule"`
+	QuotaWindows     []QuotaWindow               `json:"quota_windows" msg:"quota_windows"`
 	AccessRights     map[string]AccessDefinition `json:"access_rights" msg:"access_rights"`
 	OrgID            string                      `json:"org_id" msg:"org_id"`
 	OauthClientID    string                      `json:"oauth_client_id" msg:"oauth_client_id"`
@@ -50,12 +61,15 @@ type SessionState struct {
 	JWTData struct {
 		Secret string `json:"secret" msg:"secret"`
 	} `json:"jwt_data" msg:"jwt_data"`
-	HMACEnabled   bool   `json:"hmac_enabled" msg:"hmac_enabled"`
-	HmacSecret    string `json:"hmac_string" msg:"hmac_string"`
-	IsInactive    bool   `json:"is_inactive" msg:"is_inactive"`
-	ApplyPolicyID string `json:"apply_policy_id" msg:"apply_policy_id"`
-	DataExpires   int64  `json:"data_expires" msg:"data_expires"`
-	Monitor       struct {
+	HMACEnabled        bool     `json:"hmac_enabled" msg:"hmac_enabled"`
+	HmacSecret         string   `json:"hmac_string" msg:"hmac_string"`
+	SignaturePublicKey string   `json:"signature_public_key" msg:"signature_public_key"`
+	SignatureJWKSURL   string   `json:"signature_jwks_url" msg:"signature_jwks_url"`
+	IsInactive         bool     `json:"is_inactive" msg:"is_inactive"`
+	ApplyPolicyID      string   `json:"apply_policy_id" msg:"apply_policy_id"`
+	ApplyPolicies      []string `json:"apply_policies" msg:"apply_policies"`
+	DataExpires        int64    `json:"data_expires" msg:"data_expires"`
+	Monitor            struct {
 		TriggerLimits []float64 `json:"trigger_limits" msg:"trigger_limits"`
 	} `json:"monitor" msg:"monitor"`
 	EnableDetailedRecording bool              `json:"enable_detail_recording" msg:"enable_detail_recording"`
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultTracingServiceName   = "tyk-gateway"
+	defaultTracingBatchSize     = 512
+	defaultTracingFlushInterval = 5000 // milliseconds
+	tracingQueueSize            = 4096
+
+	traceParentHeader = "traceparent"
+)
+
+// Span kinds, as numbered by OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// Span is a single timed operation of a trace. All methods are safe to
+// call on a nil span, which is what StartSpan returns when tracing is
+// disabled.
+type Span struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte
+	Sampled    bool
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      string
+
+	trace *requestTrace
+}
+
+// requestTrace keeps the spans of a request that are still running, the
+// last one is the parent of any new span.
+type requestTrace struct {
+	mu     sync.Mutex
+	active []*Span
+}
+
+func (t *requestTrace) current() *Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.active) == 0 {
+		return nil
+	}
+	return t.active[len(t.active)-1]
+}
+
+func (t *requestTrace) push(s *Span) {
+	t.mu.Lock()
+	t.active = append(t.active, s)
+	t.mu.Unlock()
+}
+
+func (t *requestTrace) pop(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.active) - 1; i >= 0; i-- {
+		if t.active[i] == s {
+			t.active = append(t.active[:i], t.active[i+1:]...)
+			return
+		}
+	}
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": "tracing",
+		}).Error("Failed to generate ID: ", err)
+	}
+}
+
+// parseTraceParent reads a W3C traceparent header, returning false if
+// it is missing or invalid.
+func parseTraceParent(value string) (traceID [16]byte, spanID [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return
+	}
+	// version 00 has exactly four fields, later ones may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == ([16]byte{}) {
+		return
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil || spanID == ([8]byte{}) {
+		return
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return
+	}
+	return traceID, spanID, flags&1 == 1, true
+}
+
+// StartTrace starts the server span of a request, continuing the trace
+// of the caller if it sent a traceparent header.
+func StartTrace(r *http.Request, name string) *Span {
+	if !globalConf.Tracing.Enabled {
+		return nil
+	}
+	span := &Span{Name: name, Kind: spanKindServer, Start: time.Now(), Sampled: true}
+	if traceID, parentID, sampled, ok := parseTraceParent(r.Header.Get(traceParentHeader)); ok {
+		span.TraceID, span.ParentID, span.Sampled = traceID, parentID, sampled
+	} else {
+		randomID(span.TraceID[:])
+	}
+	randomID(span.SpanID[:])
+
+	span.trace = &requestTrace{}
+	span.trace.push(span)
+	setCtxValue(r, TraceSpan, span.trace)
+	return span
+}
+
+// StartSpan starts a child of the innermost running span of the
+// request. It returns nil if the request is not being traced.
+func StartSpan(r *http.Request, name string, kind int) *Span {
+	v := r.Context().Value(TraceSpan)
+	if v == nil {
+		return nil
+	}
+	trace := v.(*requestTrace)
+	parent := trace.current()
+	if parent == nil {
+		return nil
+	}
+	span := &Span{
+		TraceID:  parent.TraceID,
+		ParentID: parent.SpanID,
+		Sampled:  parent.Sampled,
+		Name:     name,
+		Kind:     kind,
+		Start:    time.Now(),
+		trace:    trace,
+	}
+	randomID(span.SpanID[:])
+	trace.push(span)
+	return span
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]interface{})
+	}
+	s.Attributes[key] = value
+}
+
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.Error = msg
+}
+
+// TraceParent returns the traceparent header value that makes this span
+// the parent of the receiving service's spans.
+func (s *Span) TraceParent() string {
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.TraceID[:]) + "-" + hex.EncodeToString(s.SpanID[:]) + "-" + flags
+}
+
+// Finish ends the span and queues it for export.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	s.trace.pop(s)
+	if s.Sampled {
+		spanBatcher.add(s)
+	}
+}
+
+// spanURL returns a URL without its query string or user info, which may
+// hold credentials.
+func spanURL(u *url.URL) string {
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path, RawPath: u.RawPath}).String()
+}
+
+// TracingMiddleware wraps an API chain in a server span.
+func TracingMiddleware(spec *APISpec, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := StartTrace(r, r.Method+" "+spec.Proxy.ListenPath)
+		span.SetAttribute("tyk.api_id", spec.APIID)
+		span.SetAttribute("tyk.api_name", spec.Name)
+		span.SetAttribute("tyk.org_id", spec.OrgID)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.EscapedPath())
+		span.SetAttribute("net.peer.ip", requestIP(r))
+
+		sw := &statusRecordingWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+		span.SetAttribute("http.status_code", sw.code)
+		if sw.code >= 500 {
+			span.SetError(http.StatusText(sw.code))
+		}
+		span.Finish()
+	})
+}
+
+// SpanExporter sends finished spans to a tracing backend.
+type SpanExporter interface {
+	Export(spans []*Span) error
+}
+
+type batchingSpanExporter struct {
+	mu      sync.Mutex
+	queue   chan *Span
+	flush   chan chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+var spanBatcher = &batchingSpanExporter{}
+
+func (b *batchingSpanExporter) add(s *Span) {
+	b.mu.Lock()
+	queue := b.queue
+	b.mu.Unlock()
+	if queue == nil {
+		return
+	}
+	select {
+	case queue <- s:
+	default:
+		log.WithFields(logrus.Fields{
+			"prefix": "tracing",
+		}).Debug("Span queue is full, dropping span: ", s.Name)
+	}
+}
+
+// start replaces the exporter, flushing any spans queued for the
+// previous one.
+func (b *batchingSpanExporter) start(exporter SpanExporter, batchSize int, interval time.Duration) {
+	b.shutdown()
+
+	b.mu.Lock()
+	b.queue = make(chan *Span, tracingQueueSize)
+	b.flush = make(chan chan struct{})
+	b.stop = make(chan struct{})
+	b.stopped = make(chan struct{})
+	go b.loop(exporter, b.queue, b.flush, b.stop, b.stopped, batchSize, interval)
+	b.mu.Unlock()
+}
+
+func (b *batchingSpanExporter) loop(exporter SpanExporter, queue chan *Span, flush chan chan struct{}, stop, stopped chan struct{}, batchSize int, interval time.Duration) {
+	defer close(stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, batchSize)
+	send := func() {
+		// pick up whatever is already queued
+	drain:
+		for len(batch) < batchSize {
+			select {
+			case s := <-queue:
+				batch = append(batch, s)
+			default:
+				break drain
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := exporter.Export(batch); err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": "tracing",
+			}).Error("Failed to export spans: ", err)
+		}
+		batch = make([]*Span, 0, batchSize)
+	}
+
+	for {
+		select {
+		case s := <-queue:
+			if batch = append(batch, s); len(batch) >= batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-flush:
+			send()
+			close(done)
+		case <-stop:
+			send()
+			return
+		}
+	}
+}
+
+// Flush blocks until all queued spans have been exported.
+func (b *batchingSpanExporter) Flush() {
+	b.mu.Lock()
+	flush, stopped := b.flush, b.stopped
+	b.mu.Unlock()
+	if flush == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case flush <- done:
+		<-done
+	case <-stopped:
+	}
+}
+
+func (b *batchingSpanExporter) shutdown() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stop == nil {
+		return
+	}
+	close(b.stop)
+	<-b.stopped
+	b.queue, b.flush, b.stop, b.stopped = nil, nil, nil, nil
+}
+
+type stdoutSpanExporter struct {
+	mu          sync.Mutex
+	w           io.Writer
+	serviceName string
+}
+
+type stdoutSpan struct {
+	Service      string                 `json:"service"`
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         int                    `json:"kind"`
+	StartTime    time.Time              `json:"start_time"`
+	EndTime      time.Time              `json:"end_time"`
+	DurationMS   float64                `json:"duration_ms"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// Export writes one JSON object per line and span.
+func (e *stdoutSpanExporter) Export(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		out := stdoutSpan{
+			Service:    e.serviceName,
+			TraceID:    hex.EncodeToString(s.TraceID[:]),
+			SpanID:     hex.EncodeToString(s.SpanID[:]),
+			Name:       s.Name,
+			Kind:       s.Kind,
+			StartTime:  s.Start,
+			EndTime:    s.End,
+			DurationMS: float64(s.End.Sub(s.Start)) / float64(time.Millisecond),
+			Attributes: s.Attributes,
+			Error:      s.Error,
+		}
+		if s.ParentID != ([8]byte{}) {
+			out.ParentSpanID = hex.EncodeToString(s.ParentID[:])
+		}
+		if err := enc.Encode(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// otlpSpanExporter posts spans to an OTLP/HTTP collector, using the JSON
+// encoding of the OTLP protobuf messages.
+type otlpSpanExporter struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch x := value.(type) {
+	case bool:
+		kv.Value = map[string]interface{}{"boolValue": x}
+	case int:
+		// 64 bit integers are strings in the JSON encoding
+		kv.Value = map[string]interface{}{"intValue": strconv.Itoa(x)}
+	case float64:
+		kv.Value = map[string]interface{}{"doubleValue": x}
+	default:
+		kv.Value = map[string]interface{}{"stringValue": fmt.Sprint(x)}
+	}
+	return kv
+}
+
+func (e *otlpSpanExporter) Export(spans []*Span) error {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.ParentID != ([8]byte{}) {
+			o.ParentSpanID = hex.EncodeToString(s.ParentID[:])
+		}
+		for key, value := range s.Attributes {
+			o.Attributes = append(o.Attributes, otlpAttribute(key, value))
+		}
+		if s.Error != "" {
+			o.Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+		out[i] = o
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpKeyValue{otlpAttribute("service.name", e.serviceName)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "tyk", "version": VERSION},
+				"spans": out,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SetupTracing starts the span exporter configured in tracing options.
+func SetupTracing() {
+	conf := globalConf.Tracing
+	if !conf.Enabled {
+		spanBatcher.shutdown()
+		return
+	}
+
+	serviceName := conf.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+	batchSize := conf.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultTracingBatchSize
+	}
+	interval := conf.FlushInterval
+	if interval <= 0 {
+		interval = defaultTracingFlushInterval
+	}
+
+	var exporter SpanExporter
+	switch conf.Exporter {
+	case "otlp":
+		if conf.OTLPEndpoint == "" {
+			log.WithFields(logrus.Fields{
+				"prefix": "tracing",
+			}).Error("Tracing is enabled with the otlp exporter, but no otlp_endpoint is set")
+			return
+		}
+		exporter = &otlpSpanExporter{
+			endpoint:    conf.OTLPEndpoint,
+			headers:     conf.OTLPHeaders,
+			serviceName: serviceName,
+			client:      &http.Client{Timeout: 10 * time.Second},
+		}
+	case "stdout", "":
+		exporter = &stdoutSpanExporter{w: os.Stdout, serviceName: serviceName}
+	default:
+		log.WithFields(logrus.Fields{
+			"prefix": "tracing",
+		}).Error("Unknown tracing exporter: ", conf.Exporter)
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"prefix": "tracing",
+	}).Info("Tracing enabled, exporting spans to: ", conf.Exporter)
+	spanBatcher.start(exporter, batchSize, time.Duration(interval)*time.Millisecond)
+}
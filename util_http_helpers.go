@@ -9,7 +9,19 @@ import (
 	"strings"
 )
 
+// requestIP returns the client address of a request. Forwarding headers
+// are only believed if they come from a trusted proxy, unless no trusted
+// proxies are configured at all.
 func requestIP(r *http.Request) string {
+	tp := ctxGetTrustedProxies(r)
+	if tp == nil {
+		tp = globalTrustedProxies
+	}
+	if tp.enabled() {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		return tp.clientIP(host, forwardedChain(r))
+	}
+
 	if fw := r.Header.Get("X-Forwarded-For"); fw != "" {
 		// X-Forwarded-For has no port
 		if i := strings.IndexByte(fw, ','); i >= 0 {
@@ -31,3 +31,63 @@ func TestRequestIP(t *testing.T) {
 		}
 	}
 }
+
+func TestRequestIPTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		hops    int
+		remote  string
+		header  http.Header
+		want    string
+	}{
+		{"untrusted peer", []string{"10.0.0.0/8"}, 0, "1.2.3.4:80",
+			http.Header{"X-Forwarded-For": {"5.6.7.8"}}, "1.2.3.4"},
+		{"trusted chain", []string{"10.0.0.0/8"}, 0, "10.0.0.1:80",
+			http.Header{"X-Forwarded-For": {"6.6.6.6, 5.6.7.8, 10.0.0.2"}}, "5.6.7.8"},
+		{"single address", []string{"10.0.0.1"}, 0, "10.0.0.1:80",
+			http.Header{"X-Forwarded-For": {"5.6.7.8, 10.0.0.2"}}, "10.0.0.2"},
+		{"all trusted", []string{"10.0.0.0/8"}, 0, "10.0.0.1:80",
+			http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"unusable entry", []string{"10.0.0.0/8"}, 0, "10.0.0.1:80",
+			http.Header{"X-Forwarded-For": {"5.6.7.8, garbage"}}, "10.0.0.1"},
+		{"hops", nil, 1, "1.2.3.4:80",
+			http.Header{"X-Forwarded-For": {"6.6.6.6, 5.6.7.8"}}, "5.6.7.8"},
+		{"hops and cidrs", []string{"10.0.0.0/8"}, 1, "10.0.0.1:80",
+			http.Header{"X-Forwarded-For": {"5.6.7.8, 10.0.0.2"}}, "10.0.0.2"},
+		{"forwarded", []string{"10.0.0.0/8"}, 0, "10.0.0.1:80",
+			http.Header{
+				"Forwarded":       {`for=192.0.2.60;proto=http, For="[2001:db8:cafe::17]:4711"`},
+				"X-Forwarded-For": {"5.6.7.8"},
+			}, "2001:db8:cafe::17"},
+		{"forwarded with port", []string{"10.0.0.0/8"}, 0, "10.0.0.1:80",
+			http.Header{"Forwarded": {`for="192.0.2.43:8080";by=10.0.0.1`}}, "192.0.2.43"},
+		{"real ip", []string{"10.0.0.0/8"}, 0, "10.0.0.1:80",
+			http.Header{"X-Real-Ip": {"5.6.7.8"}}, "5.6.7.8"},
+	}
+	for _, tc := range tests {
+		r := &http.Request{RemoteAddr: tc.remote, Header: tc.header}
+		ctxSetTrustedProxies(r, newTrustedProxies(tc.proxies, tc.hops))
+		if got := requestIP(r); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRequestIPGlobalTrustedProxies(t *testing.T) {
+	globalTrustedProxies = newTrustedProxies([]string{"10.0.0.0/8"}, 0)
+	defer func() { globalTrustedProxies = nil }()
+
+	r := &http.Request{RemoteAddr: "1.2.3.4:80", Header: http.Header{
+		"X-Forwarded-For": {"5.6.7.8"},
+	}}
+	if got := requestIP(r); got != "1.2.3.4" {
+		t.Errorf("wanted the untrusted peer, got %q", got)
+	}
+
+	// the API's own proxies replace the global ones
+	ctxSetTrustedProxies(r, newTrustedProxies([]string{"1.2.3.0/24"}, 0))
+	if got := requestIP(r); got != "5.6.7.8" {
+		t.Errorf("wanted the forwarded address, got %q", got)
+	}
+}